@@ -39,6 +39,13 @@ func init() {
 	flag.StringVar(&conf.DriverName, "drivername", driverName, "Name of the driver")
 	flag.StringVar(&conf.Endpoint, "endpoint", "unix://tmp/spdkcsi.sock", "CSI endpoint")
 	flag.StringVar(&conf.NodeID, "nodeid", "", "node id")
+	flag.StringVar(&conf.MetricsAddress, "metrics-address", "", "Address to serve prometheus metrics, e.g, :9811, disabled if empty")
+	flag.StringVar(&conf.TracingEndpoint, "tracing-endpoint", "", "OTLP gRPC collector to send traces, e.g, localhost:4317, or \"stdout\" to print traces, disabled if empty")
+	flag.BoolVar(&conf.WatchStorageNodes, "watch-storage-nodes", false, "Watch SpdkStorageNode resources to add or remove spdk nodes at runtime")
+	flag.DurationVar(&conf.OrphanCheckInterval, "orphan-check-interval", 0, "Interval to check lvols and exports without persistent volume, e.g, 10m, disabled if 0")
+	flag.DurationVar(&conf.OrphanDeleteGrace, "orphan-delete-grace", 0, "Delete orphaned lvols and exports found for this long, e.g, 1h, only reported if 0")
+	flag.StringVar(&conf.OrphanLvolPrefix, "orphan-lvol-prefix", "pvc-", "Only orphaned lvols with this name prefix are deleted, others are only reported, should match --volume-name-prefix of csi-provisioner")
+	flag.BoolVar(&conf.ValidateConfig, "validate-config", false, "Check config files and spdk/xPU nodes of the selected servers, print a report and exit")
 	flag.BoolVar(&conf.IsControllerServer, "controller", false, "Start controller server")
 	flag.BoolVar(&conf.IsNodeServer, "node", false, "Start node server")
 
@@ -50,6 +57,13 @@ func init() {
 }
 
 func main() {
+	if conf.ValidateConfig {
+		if !spdk.ValidateConfig(&conf, os.Stdout) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	klog.Infof("Starting SPDK-CSI driver: %v version: %v", conf.DriverName, driverVersion)
 
 	spdk.Run(&conf)
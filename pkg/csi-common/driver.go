@@ -57,6 +57,10 @@ func NewCSIDriver(name, v, nodeID string) *CSIDriver {
 	return &driver
 }
 
+func (d *CSIDriver) GetName() string {
+	return d.name
+}
+
 func (d *CSIDriver) ValidateControllerServiceRequest(c csi.ControllerServiceCapability_RPC_Type) error {
 	if c == csi.ControllerServiceCapability_RPC_UNKNOWN {
 		return nil
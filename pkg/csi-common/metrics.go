@@ -0,0 +1,64 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csicommon
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog"
+
+	"github.com/spdk/spdk-csi/pkg/util"
+)
+
+var (
+	grpcRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: util.MetricsNamespace,
+		Subsystem: "csi",
+		Name:      "requests_total",
+		Help:      "Number of CSI requests, by grpc method and status code.",
+	}, []string{"method", "code"})
+
+	grpcDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: util.MetricsNamespace,
+		Subsystem: "csi",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of CSI requests, by grpc method.",
+		// volume creation and staging may take tens of seconds
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 14),
+	}, []string{"method"})
+)
+
+// StartMetricsServer serves prometheus metrics at http://address/metrics in background
+func StartMetricsServer(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	server := &http.Server{
+		Addr:              address,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		klog.Infof("Serving metrics on address: %s", address)
+		if err := server.ListenAndServe(); err != nil {
+			klog.Fatalf("Failed to start metrics server: %v", err)
+		}
+	}()
+}
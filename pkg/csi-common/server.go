@@ -22,6 +22,7 @@ import (
 	"sync"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
 	"k8s.io/klog"
 )
@@ -33,13 +34,17 @@ type NonBlockingGRPCServer interface {
 	ForceStop()
 }
 
-func NewNonBlockingGRPCServer() NonBlockingGRPCServer {
-	return &nonBlockingGRPCServer{}
+// NewNonBlockingGRPCServer creates a server which logs requests, and traces or
+// counts them only if tracing or metrics is enabled
+func NewNonBlockingGRPCServer(tracing, metrics bool) NonBlockingGRPCServer {
+	return &nonBlockingGRPCServer{tracing: tracing, metrics: metrics}
 }
 
 type nonBlockingGRPCServer struct {
-	wg     sync.WaitGroup
-	server *grpc.Server
+	wg      sync.WaitGroup
+	server  *grpc.Server
+	tracing bool
+	metrics bool
 }
 
 func (s *nonBlockingGRPCServer) Start(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) {
@@ -81,7 +86,7 @@ func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, c
 	}
 
 	opts := []grpc.ServerOption{
-		grpc.UnaryInterceptor(logGRPC),
+		grpc.ChainUnaryInterceptor(s.interceptors()...),
 	}
 	server := grpc.NewServer(opts...)
 	s.server = server
@@ -103,3 +108,15 @@ func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, c
 		klog.Fatalf("Failed to start GRPC server: %v", err)
 	}
 }
+
+// interceptors of enabled features, tracing span is created first to cover the others
+func (s *nonBlockingGRPCServer) interceptors() []grpc.UnaryServerInterceptor {
+	var interceptors []grpc.UnaryServerInterceptor
+	if s.tracing {
+		interceptors = append(interceptors, otelgrpc.UnaryServerInterceptor(), traceGRPC)
+	}
+	if s.metrics {
+		interceptors = append(interceptors, metricsGRPC)
+	}
+	return append(interceptors, logGRPC)
+}
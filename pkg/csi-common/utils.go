@@ -20,11 +20,16 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
 	"k8s.io/klog"
+
+	"github.com/spdk/spdk-csi/pkg/util"
 )
 
 func parseEndpoint(ep string) (proto, addr string, _ error) {
@@ -80,3 +85,28 @@ func logGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, h
 	}
 	return resp, err
 }
+
+func metricsGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	grpcDuration.WithLabelValues(info.FullMethod).Observe(time.Since(start).Seconds())
+	grpcRequests.WithLabelValues(info.FullMethod, status.Code(err).String()).Inc()
+	return resp, err
+}
+
+// add volume id to the span of CSI request created by otelgrpc interceptor
+func traceGRPC(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	var volumeID string
+	switch r := req.(type) {
+	case interface{ GetVolumeId() string }:
+		volumeID = r.GetVolumeId()
+	case *csi.CreateVolumeRequest:
+		volumeID = r.GetName() // volume id is unknown before creation
+	case *csi.CreateSnapshotRequest:
+		volumeID = r.GetSourceVolumeId()
+	}
+	if volumeID != "" {
+		trace.SpanFromContext(ctx).SetAttributes(util.AttrVolumeID.String(volumeID))
+	}
+	return handler(ctx, req)
+}
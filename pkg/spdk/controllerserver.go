@@ -18,8 +18,11 @@ package spdk
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -27,6 +30,8 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/klog"
 
 	csicommon "github.com/spdk/spdk-csi/pkg/csi-common"
@@ -35,10 +40,32 @@ import (
 
 var errVolumeInCreation = status.Error(codes.Internal, "volume in creation")
 
+const (
+	// max times to re-schedule a volume to other lvstores if the scheduled one runs out of space
+	maxScheduleRetries = 3
+
+	// spdk clears clones by its default lvol clear method
+	cloneClearMethod = "unmap"
+
+	controllerConfigEnv  = "SPDKCSI_CONFIG"
+	controllerConfigFile = "/etc/spdkcsi-config/config.json"
+	controllerSecretEnv  = "SPDKCSI_SECRET"
+	controllerSecretFile = "/etc/spdkcsi-secret/secret.json"
+)
+
 type controllerServer struct {
 	*csicommon.DefaultControllerServer
-	spdkNodeConfigs map[string]*util.SpdkNodeConfig
+	spdkNodes       *spdkNodeRegistry
+	spdkSecrets     string // controller side secrets, used when secrets are not passed in request
+	spdkSecretsFile string // reloaded on use to pick up rotated secrets, spdkSecrets is used if failed
 	volumeLocks     *util.VolumeLocks
+	keyringLocks    *util.VolumeLocks // by spdk node name, keys are written on publishing and removed once unused
+	scheduler       volumeScheduler
+	schedulePolicy  string               // not changed on config reload, scheduler may be stateful
+	kubeClient      kubernetes.Interface // nil if not running in kubernetes cluster
+	secretRefs      *secretRefCache      // secrets referenced by spdk nodes, nil without kubeClient
+	// util.NewSpdkNode, replaced by fake nodes in unit tests
+	newSpdkNode func(rpcURL, rpcUser, rpcPass, targetType, targetAddr string, tlsConfig *tls.Config) (util.SpdkNode, error)
 }
 
 type spdkVolume struct {
@@ -46,22 +73,25 @@ type spdkVolume struct {
 	nodeName string
 }
 
-func (cs *controllerServer) CreateVolume(_ context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
 	volumeID := req.GetName()
 	unlock := cs.volumeLocks.Lock(volumeID)
 	defer unlock()
 
-	csiVolume, err := cs.createVolume(req)
+	csiVolume, err := cs.createVolume(ctx, req)
 	if err != nil {
 		klog.Errorf("failed to create volume, volumeID: %s err: %v", volumeID, err)
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, toStatusError(err)
+	}
+	if spdkVol, err := getSPDKVol(csiVolume.GetVolumeId()); err == nil {
+		csiVolume.AccessibleTopology = cs.getVolumeTopology(spdkVol.nodeName)
 	}
 
-	volumeInfo, err := cs.publishVolume(csiVolume.GetVolumeId(), req.Secrets)
+	volumeInfo, err := cs.publishVolume(ctx, csiVolume.GetVolumeId(), req.GetParameters(), req.Secrets)
 	if err != nil {
 		klog.Errorf("failed to publish volume, volumeID: %s err: %v", volumeID, err)
-		cs.deleteVolume(csiVolume.GetVolumeId(), req.Secrets) //nolint:errcheck // we can do little
-		return nil, status.Error(codes.Internal, err.Error())
+		cs.deleteVolume(ctx, csiVolume.GetVolumeId(), req.Secrets) //nolint:errcheck // we can do little
+		return nil, toStatusError(err)
 	}
 	// copy volume info. node needs these info to contact target(ip, port, nqn, ...)
 	if csiVolume.VolumeContext == nil {
@@ -75,12 +105,12 @@ func (cs *controllerServer) CreateVolume(_ context.Context, req *csi.CreateVolum
 	return &csi.CreateVolumeResponse{Volume: csiVolume}, nil
 }
 
-func (cs *controllerServer) DeleteVolume(_ context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
 	volumeID := req.GetVolumeId()
 	unlock := cs.volumeLocks.Lock(volumeID)
 	defer unlock()
 	// no harm if volume already unpublished
-	err := cs.unpublishVolume(volumeID, req.Secrets)
+	err := cs.unpublishVolume(ctx, volumeID, req.Secrets)
 	switch {
 	case errors.Is(err, util.ErrVolumeUnpublished):
 		// unpublished but not deleted in last request?
@@ -91,17 +121,20 @@ func (cs *controllerServer) DeleteVolume(_ context.Context, req *csi.DeleteVolum
 		return &csi.DeleteVolumeResponse{}, nil
 	case err != nil:
 		klog.Errorf("failed to unpublish volume, volumeID: %s err: %v", volumeID, err)
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, toStatusError(err)
 	}
 
 	// no harm if volume already deleted
-	err = cs.deleteVolume(volumeID, req.Secrets)
+	err = cs.deleteVolume(ctx, volumeID, req.Secrets)
 	if errors.Is(err, util.ErrJSONNoSuchDevice) {
 		// deleted in previous request?
 		klog.Warningf("volume not exists: %s", volumeID)
 	} else if err != nil {
 		klog.Errorf("failed to delete volume, volumeID: %s err: %v", volumeID, err)
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, toStatusError(err)
+	}
+	if spdkVol, err := getSPDKVol(volumeID); err == nil {
+		cs.removeUnusedKeys(ctx, spdkVol.nodeName, req.Secrets)
 	}
 
 	return &csi.DeleteVolumeResponse{}, nil
@@ -110,6 +143,9 @@ func (cs *controllerServer) DeleteVolume(_ context.Context, req *csi.DeleteVolum
 func (cs *controllerServer) ValidateVolumeCapabilities(_ context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
 	// make sure we support all requested caps
 	for _, cap := range req.VolumeCapabilities {
+		if cap.GetMount() == nil && cap.GetBlock() == nil {
+			return &csi.ValidateVolumeCapabilitiesResponse{Message: "unsupported access type"}, nil
+		}
 		supported := false
 		for _, accessMode := range cs.Driver.GetVolumeCapabilityAccessModes() {
 			if cap.GetAccessMode().GetMode() == accessMode.GetMode() {
@@ -128,7 +164,7 @@ func (cs *controllerServer) ValidateVolumeCapabilities(_ context.Context, req *c
 	}, nil
 }
 
-func (cs *controllerServer) CreateSnapshot(_ context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+func (cs *controllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
 	volumeID := req.GetSourceVolumeId()
 	unlock := cs.volumeLocks.Lock(volumeID)
 	defer unlock()
@@ -142,39 +178,128 @@ func (cs *controllerServer) CreateSnapshot(_ context.Context, req *csi.CreateSna
 
 	node, err := cs.getSpdkNode(spdkVol.nodeName, req.Secrets)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, toStatusError(err)
 	}
-	snapshotID, err := node.CreateSnapshot(spdkVol.lvolID, snapshotName)
+	snapshotID, err := node.CreateSnapshot(ctx, spdkVol.lvolID, snapshotName)
 	if err != nil {
 		klog.Errorf("failed to create snapshot, volumeID: %s snapshotName: %s err: %v", volumeID, snapshotName, err)
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, toStatusError(err)
+	}
+
+	lvols, err := node.ListVolumes(ctx)
+	if err != nil {
+		klog.Errorf("failed to list volumes, volumeID: %s err: %v", volumeID, err)
+		return nil, toStatusError(err)
+	}
+	for i := range lvols {
+		if lvols[i].UUID == snapshotID {
+			snapshot := newSnapshot(spdkVol.nodeName, &lvols[i])
+			snapshot.SourceVolumeId = volumeID
+			return &csi.CreateSnapshotResponse{Snapshot: snapshot}, nil
+		}
+	}
+	return nil, status.Errorf(codes.Internal, "snapshot %s not found after creation", snapshotID)
+}
+
+func (cs *controllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	nodeNames, snapshotLvolID, sourceLvolID, ok := cs.parseSnapshotFilter(req)
+	if !ok {
+		// no snapshot matches the filter
+		return &csi.ListSnapshotsResponse{}, nil
+	}
+	var entries []*csi.ListSnapshotsResponse_Entry
+	for _, name := range nodeNames {
+		snapshots, err := cs.listSnapshots(ctx, name, snapshotLvolID, sourceLvolID, req.GetSecrets())
+		if err != nil {
+			klog.Errorf("failed to list snapshots, node: %s err: %v", name, err)
+			return nil, toStatusError(err)
+		}
+		for _, snapshot := range snapshots {
+			entries = append(entries, &csi.ListSnapshotsResponse_Entry{Snapshot: snapshot})
+		}
+	}
+
+	start, end, nextToken, err := paginate(req.GetStartingToken(), req.GetMaxEntries(), len(entries))
+	if err != nil {
+		return nil, err
 	}
+	return &csi.ListSnapshotsResponse{
+		Entries:   entries[start:end],
+		NextToken: nextToken,
+	}, nil
+}
+
+// narrow down to the node of the requested snapshot or source volume, return false if nothing matches
+func (cs *controllerServer) parseSnapshotFilter(req *csi.ListSnapshotsRequest) (nodeNames []string, snapshotLvolID, sourceLvolID string, ok bool) {
+	var nodeName string
+	if req.GetSnapshotId() != "" {
+		spdkVol, err := getSPDKVol(req.GetSnapshotId())
+		if err != nil {
+			return nil, "", "", false
+		}
+		nodeName, snapshotLvolID = spdkVol.nodeName, spdkVol.lvolID
+	}
+	if req.GetSourceVolumeId() != "" {
+		spdkVol, err := getSPDKVol(req.GetSourceVolumeId())
+		if err != nil || (nodeName != "" && nodeName != spdkVol.nodeName) {
+			return nil, "", "", false
+		}
+		nodeName, sourceLvolID = spdkVol.nodeName, spdkVol.lvolID
+	}
+	if nodeName == "" {
+		return cs.spdkNodes.names(), snapshotLvolID, sourceLvolID, true
+	}
+	if _, exists := cs.spdkNodes.get(nodeName); !exists {
+		return nil, "", "", false
+	}
+	return []string{nodeName}, snapshotLvolID, sourceLvolID, true
+}
 
-	volInfo, err := node.VolumeInfo(spdkVol.lvolID)
+// list snapshots of a spdk node sorted by snapshot id, filtered by snapshot or source volume if not empty
+func (cs *controllerServer) listSnapshots(ctx context.Context, nodeName, snapshotLvolID, sourceLvolID string, secrets map[string]string) ([]*csi.Snapshot, error) {
+	node, err := cs.getSpdkNode(nodeName, secrets)
 	if err != nil {
-		klog.Errorf("failed to get volume info, volumeID: %s err: %v", volumeID, err)
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, err
 	}
-	size, err := strconv.ParseInt(volInfo["lvolSize"], 10, 64)
+	lvols, err := node.ListVolumes(ctx)
 	if err != nil {
-		klog.Errorf("failed to parse volume size, lvolSize: %s err: %v", volInfo["lvolSize"], err)
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, err
+	}
+	sort.Slice(lvols, func(i, j int) bool { return lvols[i].UUID < lvols[j].UUID })
+
+	var snapshots []*csi.Snapshot
+	for i := range lvols {
+		lvol := &lvols[i]
+		if !lvol.IsSnapshot || lvol.IsHidden ||
+			(snapshotLvolID != "" && lvol.UUID != snapshotLvolID) ||
+			(sourceLvolID != "" && lvol.SourceLvolID != sourceLvolID) {
+			continue
+		}
+		snapshots = append(snapshots, newSnapshot(nodeName, lvol))
 	}
+	return snapshots, nil
+}
+
+func newSnapshot(nodeName string, lvol *util.Lvol) *csi.Snapshot {
+	// snapshots created by old versions have no creation time recorded
 	creationTime := timestamppb.Now()
-	snapshotData := csi.Snapshot{
-		SizeBytes:      size,
-		SnapshotId:     fmt.Sprintf("%s:%s", spdkVol.nodeName, snapshotID),
-		SourceVolumeId: spdkVol.lvolID,
+	if !lvol.CreationTime.IsZero() {
+		creationTime = timestamppb.New(lvol.CreationTime)
+	}
+	sourceVolumeID := ""
+	if lvol.SourceLvolID != "" {
+		sourceVolumeID = fmt.Sprintf("%s:%s", nodeName, lvol.SourceLvolID)
+	}
+	return &csi.Snapshot{
+		SizeBytes:      lvol.SizeBytes,
+		SnapshotId:     fmt.Sprintf("%s:%s", nodeName, lvol.UUID),
+		SourceVolumeId: sourceVolumeID,
 		CreationTime:   creationTime,
 		ReadyToUse:     true,
 	}
-
-	return &csi.CreateSnapshotResponse{
-		Snapshot: &snapshotData,
-	}, nil
 }
 
-func (cs *controllerServer) DeleteSnapshot(_ context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+func (cs *controllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
 	snapshotID := req.GetSnapshotId()
 	unlock := cs.volumeLocks.Lock(snapshotID)
 	defer unlock()
@@ -187,18 +312,330 @@ func (cs *controllerServer) DeleteSnapshot(_ context.Context, req *csi.DeleteSna
 
 	node, err := cs.getSpdkNode(spdkVol.nodeName, req.Secrets)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, toStatusError(err)
 	}
-	err = node.DeleteVolume(spdkVol.lvolID)
-	if err != nil {
+	err = node.DeleteVolume(ctx, spdkVol.lvolID)
+	if errors.Is(err, util.ErrJSONNoSuchDevice) {
+		// deleted in previous request?
+		klog.Warningf("snapshot not exists: %s", snapshotID)
+	} else if err != nil {
 		klog.Errorf("failed to delete snapshot, snapshotID: %s err: %v", snapshotID, err)
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, toStatusError(err)
 	}
 
 	return &csi.DeleteSnapshotResponse{}, nil
 }
 
-func (cs *controllerServer) createVolume(req *csi.CreateVolumeRequest) (*csi.Volume, error) {
+func (cs *controllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	entries := cs.listVolumes(ctx)
+	start, end, nextToken, err := paginate(req.GetStartingToken(), req.GetMaxEntries(), len(entries))
+	if err != nil {
+		return nil, err
+	}
+	return &csi.ListVolumesResponse{
+		Entries:   entries[start:end],
+		NextToken: nextToken,
+	}, nil
+}
+
+func (cs *controllerServer) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	spdkVol, err := getSPDKVol(volumeID)
+	if err != nil {
+		klog.Errorf("failed to get spdk volume, volumeID: %s err: %v", volumeID, err)
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	node, err := cs.getSpdkNode(spdkVol.nodeName, nil)
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+	lvols, err := node.ListVolumes(ctx)
+	if err != nil {
+		klog.Errorf("failed to list volumes, node: %s err: %v", spdkVol.nodeName, err)
+		return nil, toStatusError(err)
+	}
+	for i := range lvols {
+		if lvols[i].UUID == spdkVol.lvolID && !lvols[i].IsSnapshot {
+			entry := cs.newListVolumesEntry(spdkVol.nodeName, &lvols[i])
+			return &csi.ControllerGetVolumeResponse{
+				Volume: entry.Volume,
+				Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+					VolumeCondition: entry.Status.VolumeCondition,
+				},
+			}, nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "volume %s not found", volumeID)
+}
+
+// paginate returns range of the entries to be returned and the next token,
+// the token is simply the index of the next entry
+func paginate(startingToken string, maxEntries int32, count int) (start, end int, nextToken string, err error) {
+	if startingToken != "" {
+		start, err = strconv.Atoi(startingToken)
+		if err != nil || start < 0 || start > count {
+			return 0, 0, "", status.Errorf(codes.Aborted, "invalid starting token: %s", startingToken)
+		}
+	}
+	end = count
+	if maxEntries > 0 && start+int(maxEntries) < end {
+		end = start + int(maxEntries)
+	}
+	if end < count {
+		nextToken = strconv.Itoa(end)
+	}
+	return start, end, nextToken, nil
+}
+
+// listVolumes lists volumes of all spdk nodes sorted by volume id to keep pagination
+// stable, unreachable nodes are skipped so volumes of other nodes are still reported
+func (cs *controllerServer) listVolumes(ctx context.Context) []*csi.ListVolumesResponse_Entry {
+	var entries []*csi.ListVolumesResponse_Entry
+	for _, nodeName := range cs.spdkNodes.names() {
+		node, err := cs.getSpdkNode(nodeName, nil)
+		if err != nil {
+			klog.Errorf("failed to get spdk node %s, its volumes are not listed: %v", nodeName, err)
+			continue
+		}
+		lvols, err := node.ListVolumes(ctx)
+		if err != nil {
+			klog.Errorf("failed to list volumes of node %s, its volumes are not listed: %v", nodeName, err)
+			continue
+		}
+		for i := range lvols {
+			if lvols[i].IsSnapshot {
+				continue
+			}
+			entries = append(entries, cs.newListVolumesEntry(nodeName, &lvols[i]))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].GetVolume().GetVolumeId() < entries[j].GetVolume().GetVolumeId()
+	})
+	return entries
+}
+
+// volumes are exported once created, an unexported volume is not accessible from CSI nodes
+func (cs *controllerServer) newListVolumesEntry(nodeName string, lvol *util.Lvol) *csi.ListVolumesResponse_Entry {
+	condition := &csi.VolumeCondition{
+		Abnormal: false,
+		Message:  "volume is exported by spdk target",
+	}
+	if !lvol.Published {
+		condition.Abnormal = true
+		condition.Message = "volume is not exported by spdk target"
+	}
+	return &csi.ListVolumesResponse_Entry{
+		Volume: &csi.Volume{
+			VolumeId:           fmt.Sprintf("%s:%s", nodeName, lvol.UUID),
+			CapacityBytes:      lvol.SizeBytes,
+			AccessibleTopology: cs.getVolumeTopology(nodeName),
+		},
+		Status: &csi.ListVolumesResponse_VolumeStatus{
+			VolumeCondition: condition,
+		},
+	}
+}
+
+// GetCapacity reports capacity for volumes of the parameters on the spdk nodes accessible
+// from the requested topology, reserved space and overcommit ratio of nodes are applied
+// like scheduling. It can be narrowed down to a single node or lvstore by "spdkNode" and
+// "lvstore" parameters.
+func (cs *controllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	lvolOpts, err := cs.parseParameters(req.GetParameters())
+	if err != nil {
+		return nil, err
+	}
+	nodeName := req.GetParameters()["spdkNode"]
+
+	var availableMiB, maxVolumeMiB int64
+	for _, cfg := range cs.spdkNodes.list() {
+		// unschedulable nodes have no capacity for new volumes
+		if cfg.Unschedulable || (nodeName != "" && cfg.Name != nodeName) {
+			continue
+		}
+		if !topologyMatches(getSpdkNodeTopology(cfg), req.GetAccessibleTopology()) {
+			continue
+		}
+		nodeAvailableMiB, nodeMaxVolumeMiB, err := cs.getNodeCapacity(ctx, cfg, lvolOpts, req.GetParameters())
+		if err != nil {
+			klog.Errorf("failed to get capacity of node %s: %s", cfg.Name, err.Error())
+			continue
+		}
+		availableMiB += nodeAvailableMiB
+		if nodeMaxVolumeMiB > maxVolumeMiB {
+			maxVolumeMiB = nodeMaxVolumeMiB
+		}
+	}
+
+	return &csi.GetCapacityResponse{
+		AvailableCapacity: availableMiB * 1024 * 1024,
+		MaximumVolumeSize: wrapperspb.Int64(maxVolumeMiB * 1024 * 1024),
+	}, nil
+}
+
+func (cs *controllerServer) getNodeLvStores(ctx context.Context, nodeName string) ([]util.LvStore, error) {
+	node, err := cs.getSpdkNode(nodeName, nil)
+	if err != nil {
+		return nil, err
+	}
+	return node.LvStores(ctx)
+}
+
+// get total and max capacity of lvstores on a spdk node for volumes of the parameters,
+// reserved space and overcommit ratio are applied as the scheduler places volumes
+func (cs *controllerServer) getNodeCapacity(ctx context.Context, cfg *util.SpdkNodeConfig, lvolOpts *util.LvolOptions, params map[string]string) (
+	availableMiB, maxVolumeMiB int64, err error,
+) {
+	candidates, err := cs.getScheduleCandidates(ctx, cfg, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, c := range candidates {
+		if !schedulable(c, 0, lvolOpts, params, nil) {
+			continue
+		}
+		capacityMiB := c.capacityMiB(lvolOpts.ThinProvision)
+		availableMiB += capacityMiB
+		if capacityMiB > maxVolumeMiB {
+			maxVolumeMiB = capacityMiB
+		}
+	}
+	return availableMiB, maxVolumeMiB, nil
+}
+
+func (cs *controllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	unlock := cs.volumeLocks.Lock(volumeID)
+	defer unlock()
+
+	size := req.GetCapacityRange().GetRequiredBytes()
+	if size == 0 {
+		return nil, status.Error(codes.InvalidArgument, "missing required capacity")
+	}
+	sizeMiB := util.ToMiB(size)
+
+	spdkVol, err := getSPDKVol(volumeID)
+	if err != nil {
+		klog.Errorf("failed to get spdk volume, volumeID: %s err: %v", volumeID, err)
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	node, err := cs.getSpdkNode(spdkVol.nodeName, req.Secrets)
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+	err = node.ResizeVolume(ctx, spdkVol.lvolID, sizeMiB)
+	if err != nil {
+		klog.Errorf("failed to resize volume, volumeID: %s err: %v", volumeID, err)
+		return nil, toStatusError(err)
+	}
+
+	return &csi.ControllerExpandVolumeResponse{
+		CapacityBytes:         sizeMiB * 1024 * 1024,
+		NodeExpansionRequired: true,
+	}, nil
+}
+
+// ControllerPublishVolume allows the host of node to access the volume, it fails
+// with FailedPrecondition if node doesn't report its host NQN or IQN
+func (cs *controllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	if volumeID == "" || req.GetNodeId() == "" || req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "missing volume id, node id or volume capability")
+	}
+	unlock := cs.volumeLocks.Lock(volumeID)
+	defer unlock()
+
+	spdkVol, err := getSPDKVol(volumeID)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	node, err := cs.getSpdkNode(spdkVol.nodeName, req.Secrets)
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+	// keys written for the host must not be removed as unused before the host is allowed
+	unlockKeyring := cs.keyringLocks.Lock(spdkVol.nodeName)
+	defer unlockKeyring()
+	nodeName, host, opts, err := cs.getPublishHost(req, spdkVol.nodeName)
+	if err != nil {
+		return nil, err
+	}
+	// volume is published on creation, in case it's unpublished by a racing DeleteVolume
+	err = node.PublishVolume(ctx, spdkVol.lvolID, opts)
+	if err == nil {
+		err = node.AllowHost(ctx, spdkVol.lvolID, host)
+	}
+	if errors.Is(err, util.ErrVolumeDeleted) {
+		return nil, status.Errorf(codes.NotFound, "volume %s not found", volumeID)
+	}
+	if err != nil {
+		klog.Errorf("failed to publish volume to node %s, volumeID: %s err: %v", nodeName, volumeID, err)
+		return nil, toStatusError(err)
+	}
+	return &csi.ControllerPublishVolumeResponse{}, nil
+}
+
+// host of the node to access the volume, and its CHAP credentials, DH-HMAC-CHAP
+// keys or TLS pre-shared key, which must match node stage secrets used by the
+// initiator. Publish options are kept in volume context since CreateVolume.
+func (cs *controllerServer) getPublishHost(req *csi.ControllerPublishVolumeRequest, spdkNodeName string) (
+	nodeName string, host *util.HostAccess, opts *util.PublishOptions, err error,
+) {
+	nodeName, host = splitNodeID(req.GetNodeId())
+	opts, err = util.NewPublishOptions(req.GetVolumeContext())
+	if err != nil {
+		return "", nil, nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	host.CHAP, err = util.NewISCSICHAPSecret(req.GetSecrets())
+	if err != nil {
+		return "", nil, nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err = cs.setDHCHAPKeys(spdkNodeName, host, req.GetSecrets()); err != nil {
+		return "", nil, nil, err
+	}
+	if err = cs.setTLSPSK(spdkNodeName, host, req.GetSecrets(), opts.SecureChannel); err != nil {
+		return "", nil, nil, err
+	}
+	return nodeName, host, opts, nil
+}
+
+// ControllerUnpublishVolume disallows the host of node to access the volume, all
+// hosts are disallowed if node is not specified
+func (cs *controllerServer) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing volume id")
+	}
+	unlock := cs.volumeLocks.Lock(volumeID)
+	defer unlock()
+
+	spdkVol, err := getSPDKVol(volumeID)
+	if err != nil {
+		// not a volume of ours, nothing to unpublish
+		klog.Warningf("failed to get spdk volume, volumeID: %s err: %v", volumeID, err)
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+	node, err := cs.getSpdkNode(spdkVol.nodeName, req.Secrets)
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+	nodeName, host := splitNodeID(req.GetNodeId())
+	err = node.DisallowHost(ctx, spdkVol.lvolID, host)
+	if err != nil {
+		klog.Errorf("failed to unpublish volume from node %s, volumeID: %s err: %v", nodeName, volumeID, err)
+		return nil, toStatusError(err)
+	}
+	cs.removeUnusedKeys(ctx, spdkVol.nodeName, req.Secrets)
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
+}
+
+func (cs *controllerServer) createVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.Volume, error) {
+	lvolOpts, err := cs.parseParameters(req.GetParameters())
+	if err != nil {
+		return nil, err
+	}
+
 	size := req.GetCapacityRange().GetRequiredBytes()
 	if size == 0 {
 		klog.Warningln("invalid volume size, resize to 1G")
@@ -211,68 +648,73 @@ func (cs *controllerServer) createVolume(req *csi.CreateVolumeRequest) (*csi.Vol
 		ContentSource: req.GetVolumeContentSource(),
 	}
 
-	volumeID, err := cs.getVolume(req)
-	if err == nil {
-		vol.VolumeId = volumeID
-		return &vol, nil
-	}
-	var lvolID string
-
+	// cloning is idempotent, and makes sure the clone is resized/inflated on retries
 	if req.GetVolumeContentSource() != nil {
-		// if volume content source is specified, using the same node/lvstore as the source volume.
-		// find the node/lvstore of the specified content source volume
-		nodeName, lvstore, sourceLvolID, err2 := cs.getSnapshotInfo(req.GetVolumeContentSource(), req.Secrets)
-		if err2 != nil {
-			return nil, err2
-		}
-		node, err2 := cs.getSpdkNode(nodeName, req.Secrets)
-		if err2 != nil {
-			return nil, status.Error(codes.Internal, err2.Error())
-		}
-		// create a volume cloned from the source volume
-		lvolID, err = node.CloneVolume(req.GetName(), lvstore, sourceLvolID)
-		vol.VolumeId = fmt.Sprintf("%s:%s", nodeName, lvolID)
+		err = cs.cloneVolume(ctx, req, &vol)
 		if err != nil {
 			return nil, err
 		}
 		return &vol, nil
 	}
-	// schedule a SPDK node/lvstore to create the volume.
-	// schedule suitable node:lvstore
-	nodeName, lvstore, err2 := cs.schedule(sizeMiB, req.Secrets)
-	if err2 != nil {
-		return nil, err2
-	}
-	node, err2 := cs.getSpdkNode(nodeName, req.Secrets)
-	if err2 != nil {
-		return nil, status.Error(codes.Internal, err2.Error())
+
+	volumeID, err := cs.getVolume(ctx, req)
+	if err == nil {
+		vol.VolumeId = volumeID
+		return &vol, nil
 	}
-	// TODO: re-schedule on ErrJSONNoSpaceLeft per optimistic concurrency control
 	// create a new volume
-	lvolID, err = node.CreateVolume(req.GetName(), lvstore, sizeMiB)
-	// in the subsequent DeleteVolume() request, a nodeName needs to be specified,
-	// but the current CSI mechanism only passes the VolumeId to DeleteVolume().
-	// therefore, the nodeName is included as part of the VolumeId.
-	vol.VolumeId = fmt.Sprintf("%s:%s", nodeName, lvolID)
+	volumeID, err = cs.scheduleAndCreateVolume(ctx, req, sizeMiB, lvolOpts)
 	if err != nil {
 		return nil, err
 	}
+	vol.VolumeId = volumeID
 	return &vol, nil
 }
 
-func (cs *controllerServer) getVolume(req *csi.CreateVolumeRequest) (string, error) {
+// schedule a SPDK node:lvstore and create the volume on it.
+// free space got by scheduler may be consumed by concurrent requests before the
+// volume is created, re-schedule on ErrJSONNoSpaceLeft per optimistic concurrency
+// control, excluding the lvstores which are out of space.
+func (cs *controllerServer) scheduleAndCreateVolume(ctx context.Context, req *csi.CreateVolumeRequest, sizeMiB int64, lvolOpts *util.LvolOptions) (string, error) {
+	excluded := make(map[string]bool)
+	for retry := 0; ; retry++ {
+		nodeName, lvstore, err := cs.schedule(ctx, req, sizeMiB, lvolOpts, excluded)
+		if err != nil {
+			return "", err
+		}
+		node, err := cs.getSpdkNode(nodeName, req.Secrets)
+		if err != nil {
+			return "", toStatusError(err)
+		}
+		lvolID, err := node.CreateVolume(ctx, req.GetName(), lvstore, sizeMiB, lvolOpts)
+		if errors.Is(err, util.ErrJSONNoSpaceLeft) && retry < maxScheduleRetries {
+			klog.Warningf("no space left on %s:%s, re-schedule volume %s", nodeName, lvstore, req.GetName())
+			excluded[nodeName+":"+lvstore] = true
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		// in the subsequent DeleteVolume() request, a nodeName needs to be specified,
+		// but the current CSI mechanism only passes the VolumeId to DeleteVolume().
+		// therefore, the nodeName is included as part of the VolumeId.
+		return fmt.Sprintf("%s:%s", nodeName, lvolID), nil
+	}
+}
+
+func (cs *controllerServer) getVolume(ctx context.Context, req *csi.CreateVolumeRequest) (string, error) {
 	// check all SPDK nodes to see if the volume has already been created
-	for _, cfg := range cs.spdkNodeConfigs {
+	for _, cfg := range cs.spdkNodes.list() {
 		node, err := cs.getSpdkNode(cfg.Name, req.Secrets)
 		if err != nil {
-			return "nil", fmt.Errorf("failed to get spdkNode %s: %s", cfg.Name, err.Error())
+			return "", fmt.Errorf("failed to get spdkNode %s: %s", cfg.Name, err.Error())
 		}
-		lvStores, err := node.LvStores()
+		lvStores, err := node.LvStores(ctx)
 		if err != nil {
 			return "", fmt.Errorf("get lvstores of node:%s failed: %w", cfg.Name, err)
 		}
 		for lvsIdx := range lvStores {
-			volumeID, err := node.GetVolume(req.GetName(), lvStores[lvsIdx].Name)
+			volumeID, err := node.GetVolume(ctx, req.GetName(), lvStores[lvsIdx].Name)
 			if err == nil {
 				return fmt.Sprintf("%s:%s", cfg.Name, volumeID), nil
 			}
@@ -297,29 +739,58 @@ func getSPDKVol(csiVolumeID string) (*spdkVolume, error) {
 	return nil, fmt.Errorf("missing nodeName in volume: %s", csiVolumeID)
 }
 
-func (cs *controllerServer) publishVolume(volumeID string, secrets map[string]string) (map[string]string, error) {
+// convert errors from spdk nodes to grpc status errors, errors with status are returned as is
+func toStatusError(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	code := codes.Internal
+	switch {
+	case errors.Is(err, util.ErrJSONNoSuchDevice):
+		code = codes.NotFound
+	case errors.Is(err, util.ErrJSONNoSpaceLeft):
+		code = codes.ResourceExhausted
+	case errors.Is(err, util.ErrJSONAlreadyExists):
+		code = codes.AlreadyExists
+	case errors.Is(err, util.ErrCHAPConflict), errors.Is(err, util.ErrHostUnknown):
+		code = codes.FailedPrecondition
+	case errors.Is(err, context.DeadlineExceeded):
+		code = codes.DeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		code = codes.Canceled
+	}
+	return status.Error(code, err.Error())
+}
+
+// publishVolume exports the volume with publish options in StorageClass params,
+// and returns volume info for the node to connect it
+func (cs *controllerServer) publishVolume(ctx context.Context, volumeID string, params, secrets map[string]string) (map[string]string, error) {
 	spdkVol, err := getSPDKVol(volumeID)
 	if err != nil {
 		return nil, err
 	}
+	opts, err := util.NewPublishOptions(params)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 	node, err := cs.getSpdkNode(spdkVol.nodeName, secrets)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, toStatusError(err)
 	}
-	err = node.PublishVolume(spdkVol.lvolID)
+	err = node.PublishVolume(ctx, spdkVol.lvolID, opts)
 	if err != nil {
 		return nil, err
 	}
 
-	volumeInfo, err := node.VolumeInfo(spdkVol.lvolID)
+	volumeInfo, err := node.VolumeInfo(ctx, spdkVol.lvolID)
 	if err != nil {
-		cs.unpublishVolume(volumeID, secrets) //nolint:errcheck // we can do little
+		cs.unpublishVolume(ctx, volumeID, secrets) //nolint:errcheck // we can do little
 		return nil, err
 	}
 	return volumeInfo, nil
 }
 
-func (cs *controllerServer) deleteVolume(volumeID string, secrets map[string]string) error {
+func (cs *controllerServer) deleteVolume(ctx context.Context, volumeID string, secrets map[string]string) error {
 	spdkVol, err := getSPDKVol(volumeID)
 	if err != nil {
 		return err
@@ -328,10 +799,10 @@ func (cs *controllerServer) deleteVolume(volumeID string, secrets map[string]str
 	if err != nil {
 		return err
 	}
-	return node.DeleteVolume(spdkVol.lvolID)
+	return node.DeleteVolume(ctx, spdkVol.lvolID)
 }
 
-func (cs *controllerServer) unpublishVolume(volumeID string, secrets map[string]string) error {
+func (cs *controllerServer) unpublishVolume(ctx context.Context, volumeID string, secrets map[string]string) error {
 	spdkVol, err := getSPDKVol(volumeID)
 	if err != nil {
 		return err
@@ -340,104 +811,444 @@ func (cs *controllerServer) unpublishVolume(volumeID string, secrets map[string]
 	if err != nil {
 		return err
 	}
-	return node.UnpublishVolume(spdkVol.lvolID)
+	return node.UnpublishVolume(ctx, spdkVol.lvolID)
 }
 
-func (cs *controllerServer) getSnapshotInfo(vcs *csi.VolumeContentSource, secrets map[string]string) (
-	nodeName, lvstore, sourceLvolID string, err error,
-) {
-	snapshotSource := vcs.GetSnapshot()
+// create a volume cloned from a snapshot or volume, on the same node/lvstore as the source.
+// the clone is grown if a bigger size is requested, and inflated if "inflate" parameter is true.
+func (cs *controllerServer) cloneVolume(ctx context.Context, req *csi.CreateVolumeRequest, vol *csi.Volume) error {
+	sourceID, sourceVol, err := getContentSource(req.GetVolumeContentSource())
+	if err != nil {
+		return err
+	}
+	// source must not be deleted or snapshotted while cloning
+	unlock := cs.volumeLocks.Lock(sourceID)
+	defer unlock()
 
-	if snapshotSource == nil {
-		err = fmt.Errorf("invalid volume content source, only snapshot source is supported")
-		return
+	node, err := cs.getSpdkNode(sourceVol.nodeName, req.Secrets)
+	if err != nil {
+		return toStatusError(err)
+	}
+	lvstore, sourceSize, err := getLvolInfo(ctx, node, sourceVol.lvolID)
+	if errors.Is(err, util.ErrJSONNoSuchDevice) {
+		return status.Errorf(codes.NotFound, "source %s not found", sourceID)
 	}
-	snapSpdkVol, err := getSPDKVol(snapshotSource.GetSnapshotId())
 	if err != nil {
-		return
+		return err
+	}
+	inflate, err := cs.checkCloneSource(req, sourceVol.nodeName, lvstore)
+	if err != nil {
+		return err
+	}
+	sizeMiB, err := getCloneSizeMiB(req.GetCapacityRange().GetRequiredBytes(), sourceSize)
+	if err != nil {
+		return err
 	}
-	nodeName = snapSpdkVol.nodeName
-	sourceLvolID = snapSpdkVol.lvolID
 
-	node, err := cs.getSpdkNode(nodeName, secrets)
+	lvolID, err := node.CloneVolume(ctx, req.GetName(), lvstore, sourceVol.lvolID)
 	if err != nil {
-		return
+		return err
 	}
+	vol.VolumeId = fmt.Sprintf("%s:%s", sourceVol.nodeName, lvolID)
+	vol.CapacityBytes = sizeMiB * 1024 * 1024
 
-	sourceLvolInfo, err := node.VolumeInfo(sourceLvolID)
+	err = node.ResizeVolume(ctx, lvolID, sizeMiB)
 	if err != nil {
-		return
+		return err
+	}
+	if inflate {
+		return node.InflateVolume(ctx, lvolID)
 	}
-	lvstore = sourceLvolInfo["lvstore"]
-	return
+	return nil
 }
 
-// simplest volume scheduler: find first node:lvstore with enough free space
-func (cs *controllerServer) schedule(sizeMiB int64, secrets map[string]string) (nodeName, lvstore string, err error) {
-	for _, cfg := range cs.spdkNodeConfigs {
-		spdkNode, err := cs.getSpdkNode(cfg.Name, secrets)
-		if err != nil {
-			klog.Errorf("failed to get spdkNode %s: %s", nodeName, err.Error())
+// clone is created on the node:lvstore of the source, thin provisioned and cleared
+// by default method of spdk unless inflated, requests conflicting with them are invalid.
+// returns whether the clone should be inflated.
+func (cs *controllerServer) checkCloneSource(req *csi.CreateVolumeRequest, nodeName, lvstore string) (inflate bool, err error) {
+	params := req.GetParameters()
+	if value, ok := params["spdkNode"]; ok && value != nodeName {
+		return false, status.Errorf(codes.InvalidArgument, "spdkNode %s conflicts with source on node %s", value, nodeName)
+	}
+	if value, ok := params["lvstore"]; ok && value != lvstore {
+		return false, status.Errorf(codes.InvalidArgument, "lvstore %s conflicts with source on lvstore %s", value, lvstore)
+	}
+	cfg, ok := cs.spdkNodes.get(nodeName)
+	if !ok || !topologyRequirementMatches(getSpdkNodeTopology(cfg), req.GetAccessibilityRequirements()) {
+		return false, status.Errorf(codes.InvalidArgument, "source on node %s is not accessible from requisite topologies", nodeName)
+	}
+	return checkCloneOptions(params)
+}
+
+func checkCloneOptions(params map[string]string) (inflate bool, err error) {
+	inflate, err = getBoolParameter(params, "inflate")
+	if err != nil {
+		return false, err
+	}
+	lvolOpts, err := util.NewLvolOptions(params)
+	if err != nil {
+		return false, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if !lvolOpts.ThinProvision && !inflate {
+		return false, status.Error(codes.InvalidArgument, "clone is thin provisioned unless inflated")
+	}
+	if lvolOpts.ClearMethod != cloneClearMethod {
+		return false, status.Errorf(codes.InvalidArgument, "clone is cleared by %s, not %s", cloneClearMethod, lvolOpts.ClearMethod)
+	}
+	return inflate, nil
+}
+
+// clone is as big as the source by default, and cannot be smaller than the source
+func getCloneSizeMiB(requiredBytes, sourceSize int64) (int64, error) {
+	sizeMiB := util.ToMiB(sourceSize)
+	if requiredBytes != 0 {
+		sizeMiB = util.ToMiB(requiredBytes)
+	}
+	if sizeMiB*1024*1024 < sourceSize {
+		return 0, status.Errorf(codes.OutOfRange, "requested size %d is smaller than source size %d", requiredBytes, sourceSize)
+	}
+	return sizeMiB, nil
+}
+
+// validate StorageClass parameters and return lvol options to create volumes
+//   - thinProvision, clearMethod: see util.NewLvolOptions
+//   - secureChannel: see util.NewPublishOptions, checked by spdk node on publishing
+//   - spdkNode, lvstore: create volumes on the specified spdk node/lvstore
+//   - inflate: inflate cloned volumes
+func (cs *controllerServer) parseParameters(params map[string]string) (*util.LvolOptions, error) {
+	lvolOpts, err := util.NewLvolOptions(params)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if _, err = util.NewPublishOptions(params); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if nodeName, ok := params["spdkNode"]; ok {
+		if _, exists := cs.spdkNodes.get(nodeName); !exists {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid spdkNode: %s", nodeName)
+		}
+	}
+	if lvsName, ok := params["lvstore"]; ok && lvsName == "" {
+		return nil, status.Error(codes.InvalidArgument, "invalid lvstore: empty name")
+	}
+	_, err = getBoolParameter(params, "inflate")
+	if err != nil {
+		return nil, err
+	}
+	return lvolOpts, nil
+}
+
+// get lvstore name and size in bytes of a logical volume
+func getLvolInfo(ctx context.Context, node util.SpdkNode, lvolID string) (lvstore string, size int64, err error) {
+	volumeInfo, err := node.VolumeInfo(ctx, lvolID)
+	if err != nil {
+		return "", 0, err
+	}
+	size, err = strconv.ParseInt(volumeInfo["lvolSize"], 10, 64)
+	if err != nil {
+		return "", 0, err
+	}
+	return volumeInfo["lvstore"], size, nil
+}
+
+// parse an optional boolean StorageClass parameter, false if not set
+func getBoolParameter(params map[string]string, key string) (bool, error) {
+	value, ok := params[key]
+	if !ok {
+		return false, nil
+	}
+	result, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, status.Errorf(codes.InvalidArgument, "invalid %s parameter: %s", key, value)
+	}
+	return result, nil
+}
+
+// get id of the source snapshot or volume
+func getContentSource(vcs *csi.VolumeContentSource) (string, *spdkVolume, error) {
+	var sourceID string
+	switch {
+	case vcs.GetSnapshot() != nil:
+		sourceID = vcs.GetSnapshot().GetSnapshotId()
+	case vcs.GetVolume() != nil:
+		sourceID = vcs.GetVolume().GetVolumeId()
+	default:
+		return "", nil, status.Error(codes.InvalidArgument, "invalid volume content source")
+	}
+	spdkVol, err := getSPDKVol(sourceID)
+	if err != nil {
+		return "", nil, status.Error(codes.NotFound, err.Error())
+	}
+	return sourceID, spdkVol, nil
+}
+
+// schedule a node:lvstore with enough capacity for the volume by the configured policy
+//   - "spdkNode" and "lvstore" parameters restrict the candidates, same as GetCapacity
+//   - node must be accessible from one of the requisite topologies, and nodes accessible
+//     from preferred topologies are picked first
+//   - node:lvstore in excluded are skipped
+func (cs *controllerServer) schedule(ctx context.Context, req *csi.CreateVolumeRequest, sizeMiB int64, lvolOpts *util.LvolOptions,
+	excluded map[string]bool,
+) (nodeName, lvstore string, err error) {
+	var candidates []*scheduleCandidate
+	for _, cfg := range cs.spdkNodes.list() {
+		if !nodeSchedulable(cfg, req) {
 			continue
 		}
-		lvstores, err := spdkNode.LvStores()
+		nodeCandidates, err := cs.getScheduleCandidates(ctx, cfg, req.Secrets)
 		if err != nil {
-			klog.Errorf("failed to get lvstores from node %s: %s", spdkNode.Info(), err.Error())
+			klog.Errorf("failed to get lvstores from node %s: %s", cfg.Name, err.Error())
 			continue
 		}
-		// check if lvstore has enough free space
-		for i := range lvstores {
-			lvstore := &lvstores[i]
-			if lvstore.FreeSizeMiB > sizeMiB {
-				return cfg.Name, lvstore.Name, nil
+		for _, c := range nodeCandidates {
+			if schedulable(c, sizeMiB, lvolOpts, req.GetParameters(), excluded) {
+				candidates = append(candidates, c)
 			}
 		}
-		klog.Infof("not enough free space from node %s", spdkNode.Info())
 	}
+	if len(candidates) == 0 {
+		return "", "", status.Error(codes.ResourceExhausted, "failed to find accessible node with enough free space")
+	}
+	candidates = preferTopology(candidates, req.GetAccessibilityRequirements())
 
-	return "", "", fmt.Errorf("failed to find node with enough free space")
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].id() < candidates[j].id() })
+	picked := cs.scheduler.pick(candidates)
+	klog.V(5).Infof("volume scheduled to %s, size: %d MiB", picked.id(), sizeMiB)
+	return picked.nodeName, picked.lvsName, nil
 }
 
-func (cs *controllerServer) getSpdkNode(nodeName string, secrets map[string]string) (util.SpdkNode, error) {
-	spdkSecrets, err := util.NewSpdkSecrets(secrets["secret.json"])
+func nodeSchedulable(cfg *util.SpdkNodeConfig, req *csi.CreateVolumeRequest) bool {
+	if cfg.Unschedulable {
+		return false
+	}
+	if nodeName := req.GetParameters()["spdkNode"]; nodeName != "" && cfg.Name != nodeName {
+		return false
+	}
+	return topologyRequirementMatches(getSpdkNodeTopology(cfg), req.GetAccessibilityRequirements())
+}
+
+func schedulable(c *scheduleCandidate, sizeMiB int64, lvolOpts *util.LvolOptions, params map[string]string, excluded map[string]bool) bool {
+	if params["lvstore"] != "" && c.lvsName != params["lvstore"] {
+		return false
+	}
+	return !excluded[c.id()] && c.fits(sizeMiB, lvolOpts.ThinProvision)
+}
+
+// get lvstores of a spdk node with capacity info for scheduling
+func (cs *controllerServer) getScheduleCandidates(ctx context.Context, cfg *util.SpdkNodeConfig, secrets map[string]string) ([]*scheduleCandidate, error) {
+	node, err := cs.getSpdkNode(cfg.Name, secrets)
+	if err != nil {
+		return nil, err
+	}
+	lvstores, err := node.LvStores(ctx)
+	if err != nil {
+		return nil, err
+	}
+	lvols, err := node.ListVolumes(ctx)
 	if err != nil {
 		return nil, err
 	}
-	node, ok := cs.spdkNodeConfigs[nodeName]
+	provisionedMiB := make(map[string]int64, len(lvstores))
+	for i := range lvols {
+		if !lvols[i].IsSnapshot {
+			provisionedMiB[lvols[i].LvsName] += util.ToMiB(lvols[i].SizeBytes)
+		}
+	}
+
+	candidates := make([]*scheduleCandidate, 0, len(lvstores))
+	for i := range lvstores {
+		candidates = append(candidates, &scheduleCandidate{
+			nodeName:        cfg.Name,
+			lvsName:         lvstores[i].Name,
+			totalMiB:        lvstores[i].TotalSizeMiB,
+			freeMiB:         lvstores[i].FreeSizeMiB,
+			provisionedMiB:  provisionedMiB[lvstores[i].Name],
+			reservedMiB:     cfg.ReservedMiB,
+			overcommitRatio: cfg.OvercommitRatio,
+			weight:          cfg.Weight,
+			topology:        getSpdkNodeTopology(cfg),
+		})
+	}
+	return candidates, nil
+}
+
+// accessible topology of volumes on the spdk node, nil if not limited
+func (cs *controllerServer) getVolumeTopology(nodeName string) []*csi.Topology {
+	cfg, ok := cs.spdkNodes.get(nodeName)
+	if !ok {
+		return nil
+	}
+	segments := getSpdkNodeTopology(cfg)
+	if len(segments) == 0 {
+		return nil
+	}
+	return []*csi.Topology{{Segments: segments}}
+}
+
+func (cs *controllerServer) getSpdkNode(nodeName string, secrets map[string]string) (util.SpdkNode, error) {
+	node, ok := cs.spdkNodes.get(nodeName)
 	if !ok {
-		return nil, fmt.Errorf("%s spdknode not exists", node.Name)
+		return nil, fmt.Errorf("spdk node %s not exists", nodeName)
+	}
+	if noRPCAuth(node.URL) {
+		return cs.newSpdkNode(node.URL, "", "", node.TargetType, node.TargetAddr, nil)
+	}
+
+	token, err := cs.getRPCToken(node, secrets)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := util.NewRPCTLSConfig(node.TLS, token.CACert, token.ClientCert, token.ClientKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tls config of spdk node %s: %w", node.Name, err)
+	}
+	spdkNode, err := cs.newSpdkNode(node.URL, token.UserName, token.Password, node.TargetType, node.TargetAddr, tlsConfig)
+	if err != nil {
+		klog.Errorf("failed to create spdk node %s: %s", node.Name, err.Error())
+		return nil, err
+	}
+	return spdkNode, nil
+}
+
+// spdk rpc server listening on socket has no authentication
+func noRPCAuth(url string) bool {
+	return strings.HasPrefix(url, "unix://") || strings.HasPrefix(url, "tcp://")
+}
+
+// get rpc credentials of a spdk node from the kubernetes secret referenced by
+// node config, or from secret.json in request or controller side secrets
+func (cs *controllerServer) getRPCToken(node *util.SpdkNodeConfig, secrets map[string]string) (*util.RPCToken, error) {
+	if node.SecretRef != nil {
+		return cs.getSecretRefToken(node)
+	}
+
+	jsonSecrets := secrets["secret.json"]
+	if jsonSecrets == "" {
+		// some requests(e.g, ListVolumes) don't carry secrets, fallback to controller side secrets
+		jsonSecrets = cs.getControllerSecrets()
+	}
+	if jsonSecrets == "" {
+		return nil, fmt.Errorf("no rpc token of spdk node %s, neither in request nor controller secrets", node.Name)
+	}
+	spdkSecrets, err := util.NewSpdkSecrets(jsonSecrets)
+	if err != nil {
+		return nil, err
 	}
 	for i := range spdkSecrets.Tokens {
-		token := spdkSecrets.Tokens[i]
-		if token.Name == nodeName {
-			spdkNode, err := util.NewSpdkNode(node.URL, token.UserName, token.Password, node.TargetType, node.TargetAddr)
-			if err != nil {
-				klog.Errorf("failed to create spdk node %s: %s", node.Name, err.Error())
-			}
-			return spdkNode, nil
+		if spdkSecrets.Tokens[i].Name == node.Name {
+			return &spdkSecrets.Tokens[i], nil
 		}
 	}
 	return nil, fmt.Errorf("failed to find secret for spdk node %s", node.Name)
 }
 
-func newControllerServer(d *csicommon.CSIDriver) (*controllerServer, error) {
+func (cs *controllerServer) getControllerSecrets() string {
+	if cs.spdkSecretsFile == "" {
+		return cs.spdkSecrets
+	}
+	secrets, err := os.ReadFile(cs.spdkSecretsFile)
+	if err != nil {
+		klog.Warningf("failed to reload secret file %s: %s", cs.spdkSecretsFile, err.Error())
+		return cs.spdkSecrets
+	}
+	return string(secrets)
+}
+
+func getNodeConfigs(config *util.CSIControllerConfig) []*util.SpdkNodeConfig {
+	cfgs := make([]*util.SpdkNodeConfig, 0, len(config.Nodes))
+	for i := range config.Nodes {
+		cfgs = append(cfgs, &config.Nodes[i])
+	}
+	return cfgs
+}
+
+// reloadConfig swaps in spdk nodes of the changed config file, current config is
+// kept if the new one is invalid. Requests in progress keep using the node configs
+// they got, and nodes removed from config are kept unschedulable.
+func (cs *controllerServer) reloadConfig() {
+	config, err := util.NewCSIControllerConfig(controllerConfigEnv, controllerConfigFile)
+	if err == nil {
+		_, err = newVolumeScheduler(config.SchedulePolicy)
+	}
+	if err != nil {
+		klog.Errorf("failed to reload config, keep using current config: %s", err.Error())
+		return
+	}
+	if config.SchedulePolicy != cs.schedulePolicy {
+		klog.Warningf("schedulePolicy %q takes effect after restart", config.SchedulePolicy)
+	}
+	cs.spdkNodes.loadStatic(getNodeConfigs(config))
+	klog.Infof("config reloaded, spdk nodes: %v", cs.spdkNodes.names())
+}
+
+func loadControllerConfig(watchStorageNodes bool) (*util.CSIControllerConfig, error) {
+	config, err := util.NewCSIControllerConfig(controllerConfigEnv, controllerConfigFile)
+	if watchStorageNodes && os.IsNotExist(err) {
+		klog.Infof("config file not found, only spdk nodes in %s are used", storageNodeGVR.Resource)
+		return &util.CSIControllerConfig{}, nil
+	}
+	return config, err
+}
+
+// newControllerServer loads spdk nodes from config.json, and also from SpdkStorageNode
+// resources if watchStorageNodes is set, config.json is optional in the latter case
+func newControllerServer(d *csicommon.CSIDriver, watchStorageNodes bool) (*controllerServer, error) {
 	server := controllerServer{
 		DefaultControllerServer: csicommon.NewDefaultControllerServer(d),
-		spdkNodeConfigs:         map[string]*util.SpdkNodeConfig{},
+		spdkNodes:               newSpdkNodeRegistry(),
 		volumeLocks:             util.NewVolumeLocks(),
+		keyringLocks:            util.NewVolumeLocks(),
+		newSpdkNode:             util.NewSpdkNode,
 	}
 
-	config, err := util.NewCSIControllerConfig("SPDKCSI_CONFIG", "/etc/spdkcsi-config/config.json")
+	config, err := loadControllerConfig(watchStorageNodes)
 	if err != nil {
 		return nil, err
 	}
-	for i := range config.Nodes {
-		server.spdkNodeConfigs[config.Nodes[i].Name] = &config.Nodes[i]
-	}
+	server.spdkNodes.loadStatic(getNodeConfigs(config))
 
-	if len(server.spdkNodeConfigs) == 0 {
+	if err = server.initKubeClients(watchStorageNodes); err != nil {
+		return nil, err
+	}
+	// nodes may be added later by resources
+	if server.spdkNodes.len() == 0 && !watchStorageNodes {
 		return nil, fmt.Errorf("no valid spdk node found")
 	}
 
+	server.scheduler, err = newVolumeScheduler(config.SchedulePolicy)
+	if err != nil {
+		return nil, err
+	}
+	server.schedulePolicy = config.SchedulePolicy
+
+	configFile := util.FromEnv(controllerConfigEnv, controllerConfigFile)
+	if _, err = util.WatchFile(configFile, server.reloadConfig); err != nil {
+		klog.Errorf("config file %s won't be reloaded on change: %s", configFile, err.Error())
+	}
+
+	if err = server.loadControllerSecrets(); err != nil {
+		return nil, err
+	}
+	server.probeSpdkNodes()
+
 	return &server, nil
 }
+
+// controller side secrets are optional, see deploy/kubernetes/controller.yaml
+func (cs *controllerServer) loadControllerSecrets() error {
+	secretFile := util.FromEnv(controllerSecretEnv, controllerSecretFile)
+	secrets, err := os.ReadFile(secretFile)
+	switch {
+	case err == nil:
+		if _, err = util.NewSpdkSecrets(string(secrets)); err != nil {
+			return fmt.Errorf("invalid secret file %s: %w", secretFile, err)
+		}
+		cs.spdkSecrets = string(secrets)
+		cs.spdkSecretsFile = secretFile
+	case os.IsNotExist(err):
+		klog.Infof("secret file %s not found, only secrets in requests are used", secretFile)
+	default:
+		return fmt.Errorf("failed to read secret file %s: %w", secretFile, err)
+	}
+	return nil
+}
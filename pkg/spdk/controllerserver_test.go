@@ -5,11 +5,14 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	csicommon "github.com/spdk/spdk-csi/pkg/csi-common"
 	"github.com/spdk/spdk-csi/pkg/util"
@@ -39,6 +42,7 @@ func TestIscsiConcurrency(t *testing.T) {
 	testConcurrency("iscsi", t)
 }
 
+//nolint:cyclop // testVolume exceeds cyclomatic complexity of 10
 func testVolume(targetType string, t *testing.T) {
 	cs, lvss, err := createTestController(targetType)
 	if err != nil {
@@ -53,6 +57,21 @@ func testVolume(targetType string, t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	// list and get volume#1
+	err = verifyTestVolumeListed(cs, volumeID1, volumeSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// snapshot volume#1
+	err = verifyTestSnapshot(cs, volumeID1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// clone volume#1, the hidden snapshot should be deleted with the clone
+	err = verifyTestClone(cs, volumeID1, volumeSize)
+	if err != nil {
+		t.Fatal(err)
+	}
 	// delete volume#1
 	err = deleteTestVolume(cs, volumeID1)
 	if err != nil {
@@ -158,10 +177,11 @@ func createTestController(targetType string) (cs *controllerServer, lvss [][]uti
 	}()
 
 	cd := csicommon.NewCSIDriver("test-driver", "test-version", "test-node")
-	cs, err = newControllerServer(cd)
+	cs, err = newControllerServer(cd, false)
 	if err != nil {
 		return nil, nil, err
 	}
+	cs.spdkSecrets = getSpdkSecrets()["secret.json"]
 
 	lvss, err = getLVSS(cs)
 	if err != nil {
@@ -259,6 +279,102 @@ func deleteTestVolume(cs *controllerServer, volumeID string) error {
 	return err
 }
 
+func verifyTestVolumeListed(cs *controllerServer, volumeID string, size int64) error {
+	var entries []*csi.ListVolumesResponse_Entry
+	reqList := csi.ListVolumesRequest{MaxEntries: 1}
+	for {
+		resp, err := cs.ListVolumes(context.TODO(), &reqList)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, resp.GetEntries()...)
+		if resp.GetNextToken() == "" {
+			break
+		}
+		reqList.StartingToken = resp.GetNextToken()
+	}
+	found := false
+	for _, entry := range entries {
+		if entry.GetVolume().GetVolumeId() == volumeID {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("volume %s not listed", volumeID)
+	}
+
+	reqGet := csi.ControllerGetVolumeRequest{VolumeId: volumeID}
+	resp, err := cs.ControllerGetVolume(context.TODO(), &reqGet)
+	if err != nil {
+		return err
+	}
+	if resp.GetVolume().GetCapacityBytes() != size {
+		return fmt.Errorf("volume size mismatch: %d", resp.GetVolume().GetCapacityBytes())
+	}
+	if resp.GetStatus().GetVolumeCondition().GetAbnormal() {
+		return fmt.Errorf("volume abnormal: %s", resp.GetStatus().GetVolumeCondition().GetMessage())
+	}
+	return nil
+}
+
+func verifyTestSnapshot(cs *controllerServer, volumeID string) error {
+	reqCreate := csi.CreateSnapshotRequest{
+		SourceVolumeId: volumeID,
+		Name:           "test-snapshot",
+		Secrets:        getSpdkSecrets(),
+	}
+	respCreate, err := cs.CreateSnapshot(context.TODO(), &reqCreate)
+	if err != nil {
+		return err
+	}
+	snapshot := respCreate.GetSnapshot()
+
+	reqList := csi.ListSnapshotsRequest{SourceVolumeId: volumeID}
+	respList, err := cs.ListSnapshots(context.TODO(), &reqList)
+	if err != nil {
+		return err
+	}
+	if len(respList.GetEntries()) != 1 {
+		return fmt.Errorf("expect 1 snapshot of volume %s, got %d", volumeID, len(respList.GetEntries()))
+	}
+	listed := respList.GetEntries()[0].GetSnapshot()
+	if listed.GetSnapshotId() != snapshot.GetSnapshotId() ||
+		listed.GetSourceVolumeId() != volumeID ||
+		!listed.GetCreationTime().AsTime().Equal(snapshot.GetCreationTime().AsTime()) {
+		return fmt.Errorf("listed snapshot mismatch: %v, created: %v", listed, snapshot)
+	}
+
+	reqDelete := csi.DeleteSnapshotRequest{
+		SnapshotId: snapshot.GetSnapshotId(),
+		Secrets:    getSpdkSecrets(),
+	}
+	_, err = cs.DeleteSnapshot(context.TODO(), &reqDelete)
+	return err
+}
+
+func verifyTestClone(cs *controllerServer, volumeID string, size int64) error {
+	reqCreate := csi.CreateVolumeRequest{
+		Name:          "test-volume-clone",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: size * 2},
+		Secrets:       getSpdkSecrets(),
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{
+				Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: volumeID},
+			},
+		},
+	}
+	resp, err := cs.CreateVolume(context.TODO(), &reqCreate)
+	if err != nil {
+		return err
+	}
+	cloneID := resp.GetVolume().GetVolumeId()
+	if resp.GetVolume().GetCapacityBytes() != size*2 {
+		return fmt.Errorf("clone size mismatch: %d", resp.GetVolume().GetCapacityBytes())
+	}
+	return deleteTestVolume(cs, cloneID)
+}
+
 func createSameVolumeInParallel(cs *controllerServer, name string, count int, size int64) (string, error) {
 	var wg sync.WaitGroup
 	var errCount int32
@@ -335,12 +451,12 @@ func deleteSameVolumeInParallel(cs *controllerServer, volumeID string, count int
 
 func getLVSS(cs *controllerServer) ([][]util.LvStore, error) {
 	var lvss [][]util.LvStore
-	for _, cfg := range cs.spdkNodeConfigs {
+	for _, cfg := range cs.spdkNodes.list() {
 		spdkNode, err := cs.getSpdkNode(cfg.Name, getSpdkSecrets())
 		if err != nil {
 			return nil, err
 		}
-		lvs, err := spdkNode.LvStores()
+		lvs, err := spdkNode.LvStores(context.TODO())
 		if err != nil {
 			return nil, err
 		}
@@ -373,3 +489,309 @@ func verifyLVSS(cs *controllerServer, lvss [][]util.LvStore) bool {
 	}
 	return true
 }
+
+func TestCreateVolumeReschedule(t *testing.T) {
+	// each node has room for 10 volumes, but always reports all space free
+	const volumeCount = 20
+	const volumeSize = 100 * 1024 * 1024
+	node1 := newFakeSpdkNode("node1", "lvs0", 1000)
+	node2 := newFakeSpdkNode("node2", "lvs0", 1000)
+	cs, err := createFakeController(node1, node2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	var errCount int32
+	for i := 0; i < volumeCount; i++ {
+		wg.Add(1)
+		go func(volumeName string) {
+			defer wg.Done()
+			_, errLocal := cs.CreateVolume(context.TODO(), &csi.CreateVolumeRequest{
+				Name:          volumeName,
+				CapacityRange: &csi.CapacityRange{RequiredBytes: volumeSize},
+			})
+			if errLocal != nil {
+				t.Logf("CreateVolume failed: %s", errLocal)
+				atomic.AddInt32(&errCount, 1)
+			}
+		}(fmt.Sprintf("test-volume-%d", i))
+	}
+	wg.Wait()
+	if errCount != 0 {
+		t.Fatalf("%d volumes failed to create", errCount)
+	}
+	if len(node1.volumes) != 10 || len(node2.volumes) != 10 {
+		t.Fatalf("volumes not evenly placed: node1 %d, node2 %d", len(node1.volumes), len(node2.volumes))
+	}
+
+	// fails after trying all lvstores
+	createCalls := node1.createCalls + node2.createCalls
+	_, err = cs.CreateVolume(context.TODO(), &csi.CreateVolumeRequest{
+		Name:          "test-volume-full",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: volumeSize},
+	})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("CreateVolume should fail with ResourceExhausted when all lvstores are full, got %v", err)
+	}
+	if calls := node1.createCalls + node2.createCalls - createCalls; calls != 2 {
+		t.Fatalf("expected 2 create attempts, got %d", calls)
+	}
+}
+
+func TestListVolumesUnreachableNode(t *testing.T) {
+	node1 := newFakeSpdkNode("node1", "lvs0", 1000)
+	cs, err := createFakeController(node1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := cs.CreateVolume(context.TODO(), &csi.CreateVolumeRequest{
+		Name:          "test-volume",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 100 * 1024 * 1024},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// no fake node serves node0
+	cs.spdkNodes.set(&util.SpdkNodeConfig{Name: "node0", URL: "http://node0", TargetType: "nvme-tcp", TargetAddr: "127.0.0.1"})
+
+	// volumes of reachable nodes are still listed
+	list, err := cs.ListVolumes(context.TODO(), &csi.ListVolumesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.GetEntries()) != 1 || list.GetEntries()[0].GetVolume().GetVolumeId() != resp.GetVolume().GetVolumeId() {
+		t.Fatalf("unexpected volumes: %v", list.GetEntries())
+	}
+}
+
+func TestListVolumesSorted(t *testing.T) {
+	node1 := newFakeSpdkNode("node1", "lvs0", 1000)
+	node2 := newFakeSpdkNode("node2", "lvs0", 1000)
+	cs, err := createFakeController(node2, node1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		_, err = cs.CreateVolume(context.TODO(), &csi.CreateVolumeRequest{
+			Name:          fmt.Sprintf("test-volume-%d", i),
+			CapacityRange: &csi.CapacityRange{RequiredBytes: 100 * 1024 * 1024},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	list, err := cs.ListVolumes(context.TODO(), &csi.ListVolumesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := list.GetEntries()
+	if len(entries) != 4 {
+		t.Fatalf("unexpected volumes: %v", entries)
+	}
+	for i := 1; i < len(entries); i++ {
+		if entries[i-1].GetVolume().GetVolumeId() >= entries[i].GetVolume().GetVolumeId() {
+			t.Fatalf("volumes are not sorted by id: %v", entries)
+		}
+	}
+}
+
+func TestCloneVolume(t *testing.T) {
+	node1 := newFakeSpdkNode("node1", "lvs0", 1000)
+	node2 := newFakeSpdkNode("node2", "lvs0", 1000)
+	cs, err := createFakeController(node1, node2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, _ := cs.spdkNodes.get("node1")
+	cfg.Topology = map[string]string{"topology.kubernetes.io/zone": "zone1"}
+	cs.spdkNodes.set(cfg)
+	resp, err := cs.CreateVolume(context.TODO(), &csi.CreateVolumeRequest{
+		Name:          "source-volume",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 100 * 1024 * 1024},
+		Parameters:    map[string]string{"spdkNode": "node1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := &csi.VolumeContentSource{Type: &csi.VolumeContentSource_Volume{
+		Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: resp.GetVolume().GetVolumeId()},
+	}}
+	clone := func(params map[string]string, requirement *csi.TopologyRequirement) (*csi.CreateVolumeResponse, error) {
+		return cs.CreateVolume(context.TODO(), &csi.CreateVolumeRequest{
+			Name:                      "clone-volume",
+			CapacityRange:             &csi.CapacityRange{RequiredBytes: 200 * 1024 * 1024},
+			Parameters:                params,
+			VolumeContentSource:       source,
+			AccessibilityRequirements: requirement,
+		})
+	}
+
+	// clone must be placed with the source
+	zone := func(name string) *csi.TopologyRequirement {
+		return &csi.TopologyRequirement{Requisite: []*csi.Topology{{Segments: map[string]string{"topology.kubernetes.io/zone": name}}}}
+	}
+	for _, tc := range []struct {
+		params      map[string]string
+		requirement *csi.TopologyRequirement
+	}{
+		{map[string]string{"spdkNode": "node2"}, nil},
+		{map[string]string{"lvstore": "lvs1"}, nil},
+		{nil, zone("zone2")},
+		{map[string]string{"thinProvision": "false"}, nil},
+		{map[string]string{"clearMethod": "write_zeroes"}, nil},
+	} {
+		if _, err = clone(tc.params, tc.requirement); status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("clone with %v %v should fail with InvalidArgument, got %v", tc.params, tc.requirement, err)
+		}
+	}
+	if len(node1.volumes) != 1 || len(node2.volumes) != 0 {
+		t.Fatalf("conflicting clones should not be created: %v %v", node1.volumes, node2.volumes)
+	}
+
+	params := map[string]string{"spdkNode": "node1", "lvstore": "lvs0", "thinProvision": "false", "inflate": "true"}
+	resp, err = clone(params, zone("zone1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vol := resp.GetVolume(); !strings.HasPrefix(vol.GetVolumeId(), "node1:") || vol.GetCapacityBytes() != 200*1024*1024 {
+		t.Fatalf("unexpected clone: %v", vol)
+	}
+}
+
+func TestGetCapacity(t *testing.T) {
+	node1 := newFakeSpdkNode("node1", "lvs0", 1000)
+	node2 := newFakeSpdkNode("node2", "lvs0", 1000)
+	cs, err := createFakeController(node1, node2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, _ := cs.spdkNodes.get("node1")
+	cfg.ReservedMiB = 100
+	cfg.OvercommitRatio = 2
+	cs.spdkNodes.set(cfg)
+	cfg, _ = cs.spdkNodes.get("node2")
+	cfg.Unschedulable = true
+	cs.spdkNodes.set(cfg)
+	_, err = cs.CreateVolume(context.TODO(), &csi.CreateVolumeRequest{
+		Name:          "test-volume",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 300 * 1024 * 1024},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// capacity is calculated as the scheduler checks if volumes fit
+	cases := []struct {
+		params      map[string]string
+		capacityMiB int64
+	}{
+		{nil, 2*900 - 300},
+		{map[string]string{"thinProvision": "false"}, 900},
+		{map[string]string{"spdkNode": "node1", "lvstore": "lvs0"}, 2*900 - 300},
+		{map[string]string{"lvstore": "lvs1"}, 0},
+	}
+	for _, tc := range cases {
+		resp, err := cs.GetCapacity(context.TODO(), &csi.GetCapacityRequest{Parameters: tc.params})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.GetAvailableCapacity() != tc.capacityMiB*1024*1024 || resp.GetMaximumVolumeSize().GetValue() != tc.capacityMiB*1024*1024 {
+			t.Fatalf("unexpected capacity with parameters %v: %v", tc.params, resp)
+		}
+	}
+
+	if _, err = cs.GetCapacity(context.TODO(), &csi.GetCapacityRequest{
+		Parameters: map[string]string{"spdkNode": "node3"},
+	}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("capacity of unknown node should fail with InvalidArgument, got %v", err)
+	}
+}
+
+func TestControllerPublishVolume(t *testing.T) {
+	node1 := newFakeSpdkNode("node1", "lvs0", 1000)
+	cs, err := createFakeController(node1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := cs.CreateVolume(context.TODO(), &csi.CreateVolumeRequest{
+		Name:          "test-volume",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 100 * 1024 * 1024},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeID := resp.GetVolume().GetVolumeId()
+	lvolID := volumeID[len("node1:"):]
+	capability := &csi.VolumeCapability{AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER}}
+	publishWithSecrets := func(volumeID, nodeID string, secrets map[string]string) error {
+		_, err := cs.ControllerPublishVolume(context.TODO(), &csi.ControllerPublishVolumeRequest{
+			VolumeId: volumeID, NodeId: nodeID, VolumeCapability: capability, Secrets: secrets,
+		})
+		return err
+	}
+	publish := func(volumeID, nodeID string) error {
+		return publishWithSecrets(volumeID, nodeID, nil)
+	}
+	unpublish := func(nodeID string) {
+		t.Helper()
+		_, err := cs.ControllerUnpublishVolume(context.TODO(), &csi.ControllerUnpublishVolumeRequest{VolumeId: volumeID, NodeId: nodeID})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// only the host of node is allowed, duplicated requests are fine
+	const hostNQN = "nqn.2014-08.org.nvmexpress:uuid:worker1"
+	const iqn = "iqn.2016-04.com.open-iscsi:worker1"
+	nodeID, err := joinNodeID("worker1", hostNQN, iqn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err = publish(volumeID, nodeID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if hosts := node1.hosts[lvolID]; len(hosts) != 1 || hosts[0] != hostNQN {
+		t.Fatalf("unexpected allowed hosts: %v", hosts)
+	}
+	unpublish(nodeID)
+	if hosts := node1.hosts[lvolID]; len(hosts) != 0 {
+		t.Fatalf("host not disallowed: %v", hosts)
+	}
+	// node id of old versions without iscsi initiator name, CHAP credentials in secrets
+	chap := map[string]string{"node.session.auth.username": "user", "node.session.auth.password": "secret"}
+	if err = publishWithSecrets(volumeID, "worker1/"+hostNQN, chap); err != nil {
+		t.Fatal(err)
+	}
+	if hosts := node1.hosts[lvolID]; len(hosts) != 1 || hosts[0] != hostNQN {
+		t.Fatalf("unexpected allowed hosts: %v", hosts)
+	}
+	if c := node1.chaps[lvolID]; c == nil || c.User != "user" || c.Secret != "secret" || c.Mutual() {
+		t.Fatalf("unexpected CHAP credentials: %v", c)
+	}
+	unpublish("worker1/" + hostNQN)
+	if hosts := node1.hosts[lvolID]; len(hosts) != 0 {
+		t.Fatalf("host not disallowed: %v", hosts)
+	}
+
+	// no host is allowed if node reports no host nqn, e.g, xPU is used
+	if err = publish(volumeID, "worker2"); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("publishing to node without host nqn should fail with FailedPrecondition, got %v", err)
+	}
+	if hosts := node1.hosts[lvolID]; len(hosts) != 0 {
+		t.Fatalf("unexpected allowed hosts: %v", hosts)
+	}
+
+	if err = publish("node1:no-such-lvol", "worker2"); status.Code(err) != codes.NotFound {
+		t.Fatalf("publishing deleted volume should fail with NotFound, got %v", err)
+	}
+	chap["node.session.auth.username_in"] = "target"
+	if err = publishWithSecrets(volumeID, "worker2", chap); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("publishing with incomplete mutual CHAP credentials should fail with InvalidArgument, got %v", err)
+	}
+	if err = publish(volumeID, ""); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("publishing without node id should fail with InvalidArgument, got %v", err)
+	}
+}
@@ -17,7 +17,10 @@ limitations under the License.
 package spdk
 
 import (
+	"context"
+
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/prometheus/client_golang/prometheus"
 	"k8s.io/klog"
 
 	csicommon "github.com/spdk/spdk-csi/pkg/csi-common"
@@ -34,12 +37,24 @@ func Run(conf *util.Config) {
 		controllerCaps = []csi.ControllerServiceCapability_RPC_Type{
 			csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 			csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+			csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+			csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+			csi.ControllerServiceCapability_RPC_GET_VOLUME,
+			csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+			csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+			csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+			csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+			csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
 		}
 		volumeModes = []csi.VolumeCapability_AccessMode_Mode{
 			csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
 		}
 	)
 
+	if conf.TracingEndpoint != "" {
+		defer startTracing(conf)()
+	}
+
 	cd = csicommon.NewCSIDriver(conf.DriverName, conf.DriverVersion, conf.NodeID)
 	if cd == nil {
 		klog.Fatalln("Failed to initialize CSI Driver.")
@@ -60,14 +75,43 @@ func Run(conf *util.Config) {
 	}
 
 	if conf.IsControllerServer {
-		var err error
-		cs, err = newControllerServer(cd)
-		if err != nil {
-			klog.Fatalf("failed to create controller server: %s", err)
+		cs = startControllerServer(cd, conf)
+	}
+
+	if conf.MetricsAddress != "" {
+		if cs != nil {
+			prometheus.MustRegister(newLvstoreCollector(cs))
 		}
+		csicommon.StartMetricsServer(conf.MetricsAddress)
 	}
 
-	s := csicommon.NewNonBlockingGRPCServer()
+	s := csicommon.NewNonBlockingGRPCServer(conf.TracingEndpoint != "", conf.MetricsAddress != "")
 	s.Start(conf.Endpoint, ids, cs, ns)
 	s.Wait()
 }
+
+func startControllerServer(cd *csicommon.CSIDriver, conf *util.Config) *controllerServer {
+	cs, err := newControllerServer(cd, conf.WatchStorageNodes)
+	if err != nil {
+		klog.Fatalf("failed to create controller server: %s", err)
+	}
+	if conf.OrphanCheckInterval > 0 {
+		if err = cs.startOrphanReconciler(conf.OrphanCheckInterval, conf.OrphanDeleteGrace, conf.OrphanLvolPrefix); err != nil {
+			klog.Fatalf("failed to start orphan reconciler: %s", err)
+		}
+	}
+	return cs
+}
+
+// startTracing returns a function to flush pending spans on exit
+func startTracing(conf *util.Config) func() {
+	shutdown, err := util.InitTracing(conf.TracingEndpoint, conf.DriverName)
+	if err != nil {
+		klog.Fatalf("failed to initialize tracing: %s", err)
+	}
+	return func() {
+		if err := shutdown(context.Background()); err != nil {
+			klog.Errorf("failed to flush traces: %s", err)
+		}
+	}
+}
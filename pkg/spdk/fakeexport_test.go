@@ -0,0 +1,91 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"context"
+
+	"github.com/spdk/spdk-csi/pkg/util"
+)
+
+// fakeExports keeps NVMf subsystems, those of existing lvols are marked by
+// Lvol.Published
+type fakeExports struct {
+	exports map[string]bool // exports of deleted lvols, key: lvol UUID
+	secure  map[string]bool // volumes published with secure channel
+}
+
+func newFakeExports() fakeExports {
+	return fakeExports{
+		exports: make(map[string]bool),
+		secure:  make(map[string]bool),
+	}
+}
+
+// PublishVolume keeps publish options of the existing export
+func (node *fakeSpdkNode) PublishVolume(_ context.Context, lvolID string, opts *util.PublishOptions) error {
+	node.mtx.Lock()
+	defer node.mtx.Unlock()
+	lvol, ok := node.volumes[lvolID]
+	if !ok {
+		return util.ErrVolumeDeleted
+	}
+	if !lvol.Published {
+		node.secure[lvolID] = opts.SecureChannel
+	}
+	lvol.Published = true
+	return nil
+}
+
+func (node *fakeSpdkNode) UnpublishVolume(_ context.Context, lvolID string) error {
+	node.mtx.Lock()
+	defer node.mtx.Unlock()
+	lvol, ok := node.volumes[lvolID]
+	if !ok {
+		return util.ErrVolumeDeleted
+	}
+	lvol.Published = false
+	// hosts are removed with the subsystem
+	node.removeHosts(lvolID)
+	return nil
+}
+
+func (node *fakeSpdkNode) ListExports(_ context.Context) ([]string, error) {
+	node.mtx.Lock()
+	defer node.mtx.Unlock()
+	lvolIDs := make([]string, 0, len(node.exports))
+	for lvolID := range node.exports {
+		lvolIDs = append(lvolIDs, lvolID)
+	}
+	for lvolID, lvol := range node.volumes {
+		if lvol.Published {
+			lvolIDs = append(lvolIDs, lvolID)
+		}
+	}
+	return lvolIDs, nil
+}
+
+func (node *fakeSpdkNode) DeleteExport(_ context.Context, lvolID string) error {
+	node.mtx.Lock()
+	defer node.mtx.Unlock()
+	if lvol, ok := node.volumes[lvolID]; ok {
+		lvol.Published = false
+	}
+	delete(node.exports, lvolID)
+	node.removeHosts(lvolID)
+	return nil
+}
@@ -0,0 +1,120 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"context"
+	"strings"
+
+	"github.com/spdk/spdk-csi/pkg/util"
+)
+
+// fakeHosts keeps hosts allowed to access exports, and their keys added to
+// spdk keyring
+type fakeHosts struct {
+	hosts      map[string][]string // host NQNs allowed to access volume
+	chaps      map[string]*util.ISCSICHAPSecret
+	dhchapKeys map[string]*util.KeyringKey
+	psks       map[string]*util.KeyringKey
+	keyring    map[string]*util.KeyringKey // keys added to spdk keyring, key: name
+}
+
+func newFakeHosts() fakeHosts {
+	return fakeHosts{
+		hosts:      make(map[string][]string),
+		chaps:      make(map[string]*util.ISCSICHAPSecret),
+		dhchapKeys: make(map[string]*util.KeyringKey),
+		psks:       make(map[string]*util.KeyringKey),
+		keyring:    make(map[string]*util.KeyringKey),
+	}
+}
+
+// removeHosts removes all hosts of the volume, keys are kept in keyring
+func (h *fakeHosts) removeHosts(lvolID string) {
+	delete(h.hosts, lvolID)
+	delete(h.dhchapKeys, lvolID)
+	delete(h.psks, lvolID)
+}
+
+// AllowHost fails like nodeNVMf if the host has no nqn, or the volume has no
+// subsystem
+func (node *fakeSpdkNode) AllowHost(_ context.Context, lvolID string, host *util.HostAccess) error {
+	if host.NQN == "" {
+		return util.ErrHostUnknown
+	}
+	node.mtx.Lock()
+	defer node.mtx.Unlock()
+	lvol, ok := node.volumes[lvolID]
+	if !ok || !lvol.Published {
+		return util.ErrVolumeUnpublished
+	}
+	if host.CHAP != nil {
+		node.chaps[lvolID] = host.CHAP
+	}
+	if host.DHCHAPKey != nil {
+		node.dhchapKeys[lvolID] = host.DHCHAPKey
+		node.keyring[host.DHCHAPKey.Name] = host.DHCHAPKey
+	}
+	if host.PSK != nil {
+		node.psks[lvolID] = host.PSK
+		node.keyring[host.PSK.Name] = host.PSK
+	}
+	for _, hostNQN := range node.hosts[lvolID] {
+		if hostNQN == host.NQN {
+			return nil
+		}
+	}
+	node.hosts[lvolID] = append(node.hosts[lvolID], host.NQN)
+	return nil
+}
+
+func (node *fakeSpdkNode) DisallowHost(_ context.Context, lvolID string, host *util.HostAccess) error {
+	node.mtx.Lock()
+	defer node.mtx.Unlock()
+	var hosts []string
+	for _, hostNQN := range node.hosts[lvolID] {
+		if host.NQN != "" && hostNQN != host.NQN {
+			hosts = append(hosts, hostNQN)
+		}
+	}
+	if len(hosts) == 0 {
+		node.removeHosts(lvolID)
+		return nil
+	}
+	node.hosts[lvolID] = hosts
+	return nil
+}
+
+// RemoveUnusedKeys removes keys not used by hosts of any volume
+func (node *fakeSpdkNode) RemoveUnusedKeys(_ context.Context, prefix string) ([]util.KeyringKey, error) {
+	node.mtx.Lock()
+	defer node.mtx.Unlock()
+	used := make(map[string]bool)
+	for _, keys := range []map[string]*util.KeyringKey{node.dhchapKeys, node.psks} {
+		for _, key := range keys {
+			used[key.Name] = true
+		}
+	}
+	var removed []util.KeyringKey
+	for name, key := range node.keyring {
+		if strings.HasPrefix(name, prefix) && !used[name] {
+			delete(node.keyring, name)
+			removed = append(removed, *key)
+		}
+	}
+	return removed, nil
+}
@@ -0,0 +1,113 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"syscall"
+
+	csicommon "github.com/spdk/spdk-csi/pkg/csi-common"
+	"github.com/spdk/spdk-csi/pkg/util"
+)
+
+// fakeSpdkNode is an in memory NVMf SpdkNode, state of each feature is kept
+// apart: lvols in fakeLvstore, exports in fakeExports, hosts allowed to access
+// exports in fakeHosts. It fails like nodeNVMf talking to a real spdk target.
+type fakeSpdkNode struct {
+	name string
+
+	mtx sync.Mutex // protects all below
+	fakeLvstore
+	fakeExports
+	fakeHosts
+}
+
+func newFakeSpdkNode(name, lvsName string, totalMiB int64) *fakeSpdkNode {
+	return &fakeSpdkNode{
+		name:        name,
+		fakeLvstore: newFakeLvstore(lvsName, totalMiB),
+		fakeExports: newFakeExports(),
+		fakeHosts:   newFakeHosts(),
+	}
+}
+
+// errNoSuchDevice is the json response error of spdk rpcs not finding the bdev
+// or lvstore, e.g, bdev_get_bdevs, bdev_lvol_create and bdev_lvol_delete
+func errNoSuchDevice(method string) error {
+	return &util.RPCError{Method: method, Code: -int(syscall.ENODEV), Message: "No such device"}
+}
+
+// fakeSpdkNodes creates SpdkNode by rpc url, to replace controllerServer.newSpdkNode
+type fakeSpdkNodes map[string]*fakeSpdkNode
+
+func (nodes fakeSpdkNodes) newSpdkNode(rpcURL, _, _, _, _ string, _ *tls.Config) (util.SpdkNode, error) {
+	node, ok := nodes[rpcURL]
+	if !ok {
+		return nil, fmt.Errorf("unknown rpc url: %s", rpcURL)
+	}
+	return node, nil
+}
+
+// create a controller server backed by fake spdk nodes, rpc url of each node is its name
+func createFakeController(nodes ...*fakeSpdkNode) (*controllerServer, error) {
+	cd := csicommon.NewCSIDriver("test-driver", "test-version", "test-node")
+	scheduler, err := newVolumeScheduler("")
+	if err != nil {
+		return nil, err
+	}
+	cs := &controllerServer{
+		DefaultControllerServer: csicommon.NewDefaultControllerServer(cd),
+		spdkNodes:               newSpdkNodeRegistry(),
+		volumeLocks:             util.NewVolumeLocks(),
+		keyringLocks:            util.NewVolumeLocks(),
+		scheduler:               scheduler,
+	}
+
+	fakeNodes := fakeSpdkNodes{}
+	tokens := []map[string]string{}
+	for _, node := range nodes {
+		cs.spdkNodes.set(&util.SpdkNodeConfig{
+			Name:       node.name,
+			URL:        "http://" + node.name,
+			TargetType: "nvme-tcp",
+			TargetAddr: "127.0.0.1",
+		})
+		fakeNodes["http://"+node.name] = node
+		tokens = append(tokens, map[string]string{"name": node.name, "username": "user", "password": "pass"})
+	}
+	cs.newSpdkNode = fakeNodes.newSpdkNode
+
+	jsonSecrets, err := json.Marshal(map[string]interface{}{"rpcTokens": tokens})
+	if err != nil {
+		return nil, err
+	}
+	cs.spdkSecrets = string(jsonSecrets)
+	return cs, nil
+}
+
+func (node *fakeSpdkNode) Info() string {
+	return node.name
+}
+
+// CreateSnapshot is not faked, no test takes snapshots
+func (node *fakeSpdkNode) CreateSnapshot(_ context.Context, _, _ string) (string, error) {
+	return "", fmt.Errorf("fake spdk node %s: snapshot not supported", node.name)
+}
@@ -0,0 +1,185 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/spdk/spdk-csi/pkg/util"
+)
+
+// fakeLvstore is one lvstore of thick volumes. LvStores always reports the
+// initial free space, like a stale view seen by concurrent requests.
+type fakeLvstore struct {
+	lvsName      string
+	totalMiB     int64
+	volumes      map[string]*util.Lvol // key: lvol UUID
+	createCalls  int
+	nextLvolUUID int
+}
+
+func newFakeLvstore(lvsName string, totalMiB int64) fakeLvstore {
+	return fakeLvstore{
+		lvsName:  lvsName,
+		totalMiB: totalMiB,
+		volumes:  make(map[string]*util.Lvol),
+	}
+}
+
+func (lvs *fakeLvstore) allocatedMiB() int64 {
+	var allocated int64
+	for _, lvol := range lvs.volumes {
+		allocated += util.ToMiB(lvol.SizeBytes)
+	}
+	return allocated
+}
+
+// getVolume finds a lvol by alias "lvsName/lvolName" like bdev_get_bdevs
+func (lvs *fakeLvstore) getVolume(lvolName, lvsName string) *util.Lvol {
+	for _, lvol := range lvs.volumes {
+		if lvol.Name == lvolName && lvol.LvsName == lvsName {
+			return lvol
+		}
+	}
+	return nil
+}
+
+func (node *fakeSpdkNode) addVolume(lvolName, lvsName string, sizeBytes int64) string {
+	node.nextLvolUUID++
+	lvolID := fmt.Sprintf("%s-lvol-%d", node.name, node.nextLvolUUID)
+	node.volumes[lvolID] = &util.Lvol{
+		UUID:      lvolID,
+		Name:      lvolName,
+		LvsName:   lvsName,
+		SizeBytes: sizeBytes,
+	}
+	return lvolID
+}
+
+func (node *fakeSpdkNode) LvStores(_ context.Context) ([]util.LvStore, error) {
+	return []util.LvStore{{
+		Name:         node.lvsName,
+		UUID:         node.lvsName + "-uuid",
+		TotalSizeMiB: node.totalMiB,
+		FreeSizeMiB:  node.totalMiB,
+	}}, nil
+}
+
+func (node *fakeSpdkNode) VolumeInfo(_ context.Context, lvolID string) (map[string]string, error) {
+	node.mtx.Lock()
+	defer node.mtx.Unlock()
+	lvol, ok := node.volumes[lvolID]
+	if !ok {
+		return nil, errNoSuchDevice("bdev_get_bdevs")
+	}
+	info := map[string]string{
+		"model":    lvolID,
+		"lvolSize": strconv.FormatInt(lvol.SizeBytes, 10),
+		"lvstore":  lvol.LvsName,
+	}
+	if node.secure[lvolID] {
+		info["secureChannel"] = "true"
+	}
+	return info, nil
+}
+
+// CreateVolume returns the lvol of the same name if it exists. It fails like
+// spdk once the lvstore is full, i.e, bdev_lvol_create completes with invalid
+// params error and message "No space left on device".
+func (node *fakeSpdkNode) CreateVolume(_ context.Context, lvolName, lvsName string, sizeMiB int64, _ *util.LvolOptions) (string, error) {
+	node.mtx.Lock()
+	defer node.mtx.Unlock()
+	if lvol := node.getVolume(lvolName, lvsName); lvol != nil {
+		return lvol.UUID, nil
+	}
+	node.createCalls++
+	if lvsName != node.lvsName {
+		return "", errNoSuchDevice("bdev_lvol_create")
+	}
+	if node.allocatedMiB()+sizeMiB > node.totalMiB {
+		return "", &util.RPCError{Method: "bdev_lvol_create", Code: -32602, Message: "No space left on device"}
+	}
+	return node.addVolume(lvolName, lvsName, sizeMiB*1024*1024), nil
+}
+
+// CloneVolume returns the lvol of the same name if it exists, the clone is
+// created in lvstore of the source like bdev_lvol_clone
+func (node *fakeSpdkNode) CloneVolume(_ context.Context, lvolName, lvsName, sourceLvolID string) (string, error) {
+	node.mtx.Lock()
+	defer node.mtx.Unlock()
+	if lvol := node.getVolume(lvolName, lvsName); lvol != nil {
+		return lvol.UUID, nil
+	}
+	source, ok := node.volumes[sourceLvolID]
+	if !ok {
+		return "", errNoSuchDevice("bdev_get_bdevs")
+	}
+	return node.addVolume(lvolName, source.LvsName, source.SizeBytes), nil
+}
+
+func (node *fakeSpdkNode) GetVolume(_ context.Context, lvolName, lvsName string) (string, error) {
+	node.mtx.Lock()
+	defer node.mtx.Unlock()
+	if lvol := node.getVolume(lvolName, lvsName); lvol != nil {
+		return lvol.UUID, nil
+	}
+	return "", errNoSuchDevice("bdev_get_bdevs")
+}
+
+func (node *fakeSpdkNode) DeleteVolume(_ context.Context, lvolID string) error {
+	node.mtx.Lock()
+	defer node.mtx.Unlock()
+	if _, ok := node.volumes[lvolID]; !ok {
+		return errNoSuchDevice("bdev_lvol_delete")
+	}
+	delete(node.volumes, lvolID)
+	return nil
+}
+
+func (node *fakeSpdkNode) InflateVolume(_ context.Context, lvolID string) error {
+	node.mtx.Lock()
+	defer node.mtx.Unlock()
+	if _, ok := node.volumes[lvolID]; !ok {
+		return errNoSuchDevice("bdev_lvol_inflate")
+	}
+	return nil
+}
+
+func (node *fakeSpdkNode) ResizeVolume(_ context.Context, lvolID string, sizeMiB int64) error {
+	node.mtx.Lock()
+	defer node.mtx.Unlock()
+	lvol, ok := node.volumes[lvolID]
+	if !ok {
+		return errNoSuchDevice("bdev_get_bdevs")
+	}
+	if sizeMiB*1024*1024 > lvol.SizeBytes {
+		lvol.SizeBytes = sizeMiB * 1024 * 1024
+	}
+	return nil
+}
+
+func (node *fakeSpdkNode) ListVolumes(_ context.Context) ([]util.Lvol, error) {
+	node.mtx.Lock()
+	defer node.mtx.Unlock()
+	lvols := make([]util.Lvol, 0, len(node.volumes))
+	for _, lvol := range node.volumes {
+		lvols = append(lvols, *lvol)
+	}
+	return lvols, nil
+}
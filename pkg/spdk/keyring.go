@@ -0,0 +1,160 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+
+	"github.com/spdk/spdk-csi/pkg/util"
+)
+
+// prefix of key names in spdk keyring and key files in keyringDir
+const keyringKeyPrefix = "spdkcsi-"
+
+// setDHCHAPKeys writes DH-HMAC-CHAP secrets in request secrets to keyringDir of
+// the spdk node, they're added to spdk keyring when the host is allowed
+func (cs *controllerServer) setDHCHAPKeys(nodeName string, host *util.HostAccess, secrets map[string]string) error {
+	dhchap, err := util.NewNVMeDHCHAPSecret(secrets)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if dhchap == nil {
+		return nil
+	}
+	keyringDir, err := cs.getKeyringDir(nodeName, "DH-HMAC-CHAP")
+	if err != nil {
+		return err
+	}
+	host.DHCHAPKey, err = writeKeyringKey(keyringDir, "dhchap-", dhchap.Secret)
+	if err == nil && dhchap.CtrlSecret != "" {
+		host.DHCHAPCtrlKey, err = writeKeyringKey(keyringDir, "dhchap-ctrl-", dhchap.CtrlSecret)
+	}
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
+
+// setTLSPSK writes TLS pre-shared key in request secrets to keyringDir of the
+// spdk node, it's required by volumes published with secure channel and not
+// used by others
+func (cs *controllerServer) setTLSPSK(nodeName string, host *util.HostAccess, secrets map[string]string, secureChannel bool) error {
+	psk, err := util.NewNVMeTLSKey(secrets)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if !secureChannel {
+		return nil
+	}
+	if psk == "" {
+		return status.Error(codes.InvalidArgument, "TLS pre-shared key is required by secure channel")
+	}
+	if host.NQN == "" {
+		return status.Error(codes.FailedPrecondition, "host nqn of the node is required by secure channel")
+	}
+	keyringDir, err := cs.getKeyringDir(nodeName, "TLS")
+	if err != nil {
+		return err
+	}
+	host.PSK, err = writeKeyringKey(keyringDir, "psk-", psk)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
+
+// getKeyringDir returns keyringDir of the spdk node, usage is the feature
+// requiring it in errors
+func (cs *controllerServer) getKeyringDir(nodeName, usage string) (string, error) {
+	node, ok := cs.spdkNodes.get(nodeName)
+	if !ok {
+		return "", status.Errorf(codes.NotFound, "spdk node %s not exists", nodeName)
+	}
+	if node.KeyringDir == "" {
+		return "", status.Errorf(codes.FailedPrecondition, "keyringDir of spdk node %s is required by %s", nodeName, usage)
+	}
+	return node.KeyringDir, nil
+}
+
+// writeKeyringKey writes the key to a file named by its hash, which is shared
+// by volumes with the same key. Spdk only accepts key files readable by owner.
+func writeKeyringKey(keyringDir, prefix, key string) (*util.KeyringKey, error) {
+	sum := sha256.Sum256([]byte(key))
+	name := keyringKeyPrefix + prefix + hex.EncodeToString(sum[:8])
+	keyFile := filepath.Join(keyringDir, name)
+	if _, err := os.Stat(keyFile); err == nil {
+		return &util.KeyringKey{Name: name, Path: keyFile}, nil
+	}
+
+	// written to a temporary file first, so spdk never reads a partial key
+	tmpFile, err := os.CreateTemp(keyringDir, "."+name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create key file: %w", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.WriteString(key)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), keyFile)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write key file %s: %w", keyFile, err)
+	}
+	return &util.KeyringKey{Name: name, Path: keyFile}, nil
+}
+
+// removeUnusedKeys removes keys written by the driver from spdk keyring once no
+// host uses them, and deletes their files in keyringDir. Keys left on failure
+// are removed in later requests.
+func (cs *controllerServer) removeUnusedKeys(ctx context.Context, nodeName string, secrets map[string]string) {
+	cfg, ok := cs.spdkNodes.get(nodeName)
+	if !ok || cfg.KeyringDir == "" {
+		return
+	}
+	unlock := cs.keyringLocks.Lock(nodeName)
+	defer unlock()
+	node, err := cs.getSpdkNode(nodeName, secrets)
+	if err != nil {
+		klog.Warningf("failed to remove unused keys of spdk node %s: %s", nodeName, err.Error())
+		return
+	}
+	keys, err := node.RemoveUnusedKeys(ctx, keyringKeyPrefix)
+	if err != nil {
+		klog.Warningf("failed to remove unused keys of spdk node %s: %s", nodeName, err.Error())
+	}
+	for i := range keys {
+		// only files written by writeKeyringKey are deleted
+		keyFile := filepath.Join(cfg.KeyringDir, keys[i].Name)
+		if keys[i].Path != keyFile {
+			continue
+		}
+		if err = os.Remove(keyFile); err != nil && !os.IsNotExist(err) {
+			klog.Warningf("failed to delete key file %s: %s", keyFile, err.Error())
+		}
+	}
+}
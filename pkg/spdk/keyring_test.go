@@ -0,0 +1,205 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/spdk/spdk-csi/pkg/util"
+)
+
+func TestControllerPublishVolumeDHCHAP(t *testing.T) {
+	node1 := newFakeSpdkNode("node1", "lvs0", 1000)
+	cs, err := createFakeController(node1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := cs.CreateVolume(context.TODO(), &csi.CreateVolumeRequest{
+		Name:          "test-volume",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 100 * 1024 * 1024},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeID := resp.GetVolume().GetVolumeId()
+	lvolID := volumeID[len("node1:"):]
+	const secret = "DHHC-1:00:ia6zGodOr5SEG3sp7F/Fuz/UhNg6bVyLgLFeJR5GqhRJT1S9:"
+	req := &csi.ControllerPublishVolumeRequest{
+		VolumeId:         volumeID,
+		NodeId:           "worker1/nqn.2014-08.org.nvmexpress:uuid:worker1",
+		VolumeCapability: &csi.VolumeCapability{AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER}},
+		Secrets:          map[string]string{"dhchap-secret": secret},
+	}
+
+	// keys can't be passed to spdk without keyringDir
+	if _, err = cs.ControllerPublishVolume(context.TODO(), req); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("publishing without keyringDir should fail with FailedPrecondition, got %v", err)
+	}
+
+	keyringDir := t.TempDir()
+	cs.spdkNodes.set(&util.SpdkNodeConfig{Name: "node1", URL: "http://node1", TargetType: "nvme-tcp", TargetAddr: "127.0.0.1", KeyringDir: keyringDir})
+	for i := 0; i < 2; i++ {
+		if _, err = cs.ControllerPublishVolume(context.TODO(), req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	key := node1.dhchapKeys[lvolID]
+	if key == nil || filepath.Dir(key.Path) != keyringDir {
+		t.Fatalf("unexpected key: %v", key)
+	}
+	content, err := os.ReadFile(key.Path)
+	if err != nil || string(content) != secret {
+		t.Fatalf("unexpected key file: %q %v", content, err)
+	}
+	if info, err := os.Stat(key.Path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("key file should be only accessible by owner: %v %v", info.Mode(), err)
+	}
+	if files, _ := os.ReadDir(keyringDir); len(files) != 1 {
+		t.Fatalf("key file should be shared: %v", files)
+	}
+
+	req.Secrets = map[string]string{"dhchap-ctrl-secret": secret}
+	if _, err = cs.ControllerPublishVolume(context.TODO(), req); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("publishing without host secret should fail with InvalidArgument, got %v", err)
+	}
+}
+
+func TestControllerPublishVolumeTLS(t *testing.T) {
+	node1 := newFakeSpdkNode("node1", "lvs0", 1000)
+	cs, err := createFakeController(node1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyringDir := t.TempDir()
+	cs.spdkNodes.set(&util.SpdkNodeConfig{Name: "node1", URL: "http://node1", TargetType: "nvme-tcp", TargetAddr: "127.0.0.1", KeyringDir: keyringDir})
+
+	if _, err = cs.CreateVolume(context.TODO(), &csi.CreateVolumeRequest{
+		Name:       "invalid-volume",
+		Parameters: map[string]string{"secureChannel": "tls"},
+	}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("invalid secureChannel should fail with InvalidArgument, got %v", err)
+	}
+	resp, err := cs.CreateVolume(context.TODO(), &csi.CreateVolumeRequest{
+		Name:          "test-volume",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 100 * 1024 * 1024},
+		Parameters:    map[string]string{"secureChannel": "true"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumeID := resp.GetVolume().GetVolumeId()
+	lvolID := volumeID[len("node1:"):]
+	if resp.GetVolume().GetVolumeContext()["secureChannel"] != "true" {
+		t.Fatalf("secure channel should be in volume context: %v", resp.GetVolume().GetVolumeContext())
+	}
+
+	const psk = "NVMeTLSkey-1:01:VRLbtnN9AQb2WXW3c9+wEf/DRLz0QuLdbYvEhwtdWwNf9LrZ:"
+	req := &csi.ControllerPublishVolumeRequest{
+		VolumeId:         volumeID,
+		NodeId:           "worker1/nqn.2014-08.org.nvmexpress:uuid:worker1",
+		VolumeCapability: &csi.VolumeCapability{AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER}},
+		VolumeContext:    resp.GetVolume().GetVolumeContext(),
+	}
+
+	// hosts can't connect without PSK
+	if _, err = cs.ControllerPublishVolume(context.TODO(), req); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("publishing without PSK should fail with InvalidArgument, got %v", err)
+	}
+
+	req.Secrets = map[string]string{"tls-key": psk}
+	if _, err = cs.ControllerPublishVolume(context.TODO(), req); err != nil {
+		t.Fatal(err)
+	}
+	key := node1.psks[lvolID]
+	if key == nil || filepath.Dir(key.Path) != keyringDir {
+		t.Fatalf("unexpected key: %v", key)
+	}
+	if content, err := os.ReadFile(key.Path); err != nil || string(content) != psk {
+		t.Fatalf("unexpected key file: %q %v", content, err)
+	}
+
+	// PSK is only used by secure channel
+	delete(node1.psks, lvolID)
+	delete(req.VolumeContext, "secureChannel")
+	if _, err = cs.ControllerPublishVolume(context.TODO(), req); err != nil || node1.psks[lvolID] != nil {
+		t.Fatalf("PSK should not be used without secure channel: %v %v", node1.psks[lvolID], err)
+	}
+}
+
+func TestRemoveUnusedKeys(t *testing.T) {
+	node1 := newFakeSpdkNode("node1", "lvs0", 1000)
+	cs, err := createFakeController(node1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyringDir := t.TempDir()
+	cs.spdkNodes.set(&util.SpdkNodeConfig{Name: "node1", URL: "http://node1", TargetType: "nvme-tcp", TargetAddr: "127.0.0.1", KeyringDir: keyringDir})
+	// files not written by the driver are never deleted
+	otherFile := filepath.Join(keyringDir, "other-key")
+	if err = os.WriteFile(otherFile, []byte("key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	const secret = "DHHC-1:00:ia6zGodOr5SEG3sp7F/Fuz/UhNg6bVyLgLFeJR5GqhRJT1S9:"
+	capability := &csi.VolumeCapability{AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER}}
+	var volumeIDs []string
+	for _, name := range []string{"volume1", "volume2"} {
+		resp, err := cs.CreateVolume(context.TODO(), &csi.CreateVolumeRequest{
+			Name:          name,
+			CapacityRange: &csi.CapacityRange{RequiredBytes: 100 * 1024 * 1024},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		volumeID := resp.GetVolume().GetVolumeId()
+		_, err = cs.ControllerPublishVolume(context.TODO(), &csi.ControllerPublishVolumeRequest{
+			VolumeId:         volumeID,
+			NodeId:           "worker1/nqn.2014-08.org.nvmexpress:uuid:worker1",
+			VolumeCapability: capability,
+			Secrets:          map[string]string{"dhchap-secret": secret},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		volumeIDs = append(volumeIDs, volumeID)
+	}
+	key := node1.dhchapKeys[volumeIDs[0][len("node1:"):]]
+	keyExists := func() bool {
+		_, err := os.Stat(key.Path)
+		return err == nil && node1.keyring[key.Name] != nil
+	}
+
+	// the shared key is kept until neither volume uses it
+	_, err = cs.ControllerUnpublishVolume(context.TODO(), &csi.ControllerUnpublishVolumeRequest{VolumeId: volumeIDs[0], NodeId: "worker1/nqn.2014-08.org.nvmexpress:uuid:worker1"})
+	if err != nil || !keyExists() {
+		t.Fatalf("key used by %s should be kept: %v", volumeIDs[1], err)
+	}
+	_, err = cs.DeleteVolume(context.TODO(), &csi.DeleteVolumeRequest{VolumeId: volumeIDs[1]})
+	if err != nil || keyExists() {
+		t.Fatalf("unused key should be removed: %v", err)
+	}
+	if _, err = os.Stat(otherFile); err != nil {
+		t.Fatalf("other files should be kept: %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"k8s.io/klog"
+
+	"github.com/spdk/spdk-csi/pkg/util"
+)
+
+// max time to query lvstores of all spdk nodes on a metrics scrape
+const lvstoreScrapeTimeout = 10 * time.Second
+
+var (
+	spdkNodeUpDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(util.MetricsNamespace, "spdk_node", "up"),
+		"Whether lvstores of the spdk node are queried successfully on last scrape.",
+		[]string{"node"}, nil)
+	lvstoreTotalDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(util.MetricsNamespace, "lvstore", "total_bytes"),
+		"Total capacity of the lvstore.",
+		[]string{"node", "lvstore"}, nil)
+	lvstoreFreeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(util.MetricsNamespace, "lvstore", "free_bytes"),
+		"Free capacity of the lvstore.",
+		[]string{"node", "lvstore"}, nil)
+
+	orphanCount = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: util.MetricsNamespace,
+		Subsystem: "orphan",
+		Name:      "objects",
+		Help:      "Number of lvols and exports on the spdk node without a persistent volume, found on last check. Foreign lvols are not named by the driver and never deleted.",
+	}, []string{"node", "kind"})
+)
+
+// lvstoreCollector reports capacity of lvstores on the spdk nodes configured
+// in controller, lvstores are queried on each scrape so the values are never stale
+type lvstoreCollector struct {
+	cs *controllerServer
+}
+
+func newLvstoreCollector(cs *controllerServer) *lvstoreCollector {
+	return &lvstoreCollector{cs: cs}
+}
+
+func (c *lvstoreCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- spdkNodeUpDesc
+	ch <- lvstoreTotalDesc
+	ch <- lvstoreFreeDesc
+}
+
+func (c *lvstoreCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), lvstoreScrapeTimeout)
+	defer cancel()
+
+	for _, nodeName := range c.cs.spdkNodes.names() {
+		lvstores, err := c.cs.getNodeLvStores(ctx, nodeName)
+		if err != nil {
+			klog.Errorf("failed to get lvstores of node %s: %s", nodeName, err.Error())
+			ch <- prometheus.MustNewConstMetric(spdkNodeUpDesc, prometheus.GaugeValue, 0, nodeName)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(spdkNodeUpDesc, prometheus.GaugeValue, 1, nodeName)
+		for i := range lvstores {
+			lvs := &lvstores[i]
+			ch <- prometheus.MustNewConstMetric(lvstoreTotalDesc, prometheus.GaugeValue,
+				float64(lvs.TotalSizeMiB*1024*1024), nodeName, lvs.Name)
+			ch <- prometheus.MustNewConstMetric(lvstoreFreeDesc, prometheus.GaugeValue,
+				float64(lvs.FreeSizeMiB*1024*1024), nodeName, lvs.Name)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/spdk/spdk-csi/pkg/util"
+)
+
+func TestLvstoreCollector(t *testing.T) {
+	node1 := newFakeSpdkNode("node1", "lvs0", 1000)
+	node2 := newFakeSpdkNode("node2", "lvs1", 2000)
+	cs, err := createFakeController(node1, node2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// node3 is not reachable
+	cs.spdkNodes.set(&util.SpdkNodeConfig{Name: "node3", URL: "node3"})
+
+	expected := `
+# HELP spdkcsi_lvstore_free_bytes Free capacity of the lvstore.
+# TYPE spdkcsi_lvstore_free_bytes gauge
+spdkcsi_lvstore_free_bytes{lvstore="lvs0",node="node1"} 1.048576e+09
+spdkcsi_lvstore_free_bytes{lvstore="lvs1",node="node2"} 2.097152e+09
+# HELP spdkcsi_lvstore_total_bytes Total capacity of the lvstore.
+# TYPE spdkcsi_lvstore_total_bytes gauge
+spdkcsi_lvstore_total_bytes{lvstore="lvs0",node="node1"} 1.048576e+09
+spdkcsi_lvstore_total_bytes{lvstore="lvs1",node="node2"} 2.097152e+09
+# HELP spdkcsi_spdk_node_up Whether lvstores of the spdk node are queried successfully on last scrape.
+# TYPE spdkcsi_spdk_node_up gauge
+spdkcsi_spdk_node_up{node="node1"} 1
+spdkcsi_spdk_node_up{node="node2"} 1
+spdkcsi_spdk_node_up{node="node3"} 0
+`
+	if err := testutil.CollectAndCompare(newLvstoreCollector(cs), strings.NewReader(expected)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,59 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spdk/spdk-csi/pkg/util"
+)
+
+// Node ID reported to CO is "<node name>/<host nqn>/<iscsi initiator name>" if
+// this host connects targets itself, none of them contains "/". Kubelet
+// registers node ID of its own node only, so a node can't take host identities
+// of other nodes. Node IDs of old versions are "<node name>/<host nqn>" or
+// "<node name>".
+const nodeIDSeparator = "/"
+
+// kubernetes rejects CSINode with longer node ID
+const maxNodeIDLength = 192
+
+// joinNodeID returns node name if neither host nqn nor initiator name is known
+func joinNodeID(nodeName, hostNQN, iqn string) (string, error) {
+	if hostNQN == "" && iqn == "" {
+		return nodeName, nil
+	}
+	nodeID := strings.Join([]string{nodeName, hostNQN, iqn}, nodeIDSeparator)
+	if len(nodeID) > maxNodeIDLength {
+		return "", fmt.Errorf("node id %q exceeds %d bytes", nodeID, maxNodeIDLength)
+	}
+	return nodeID, nil
+}
+
+// splitNodeID returns host identities in node ID, which are empty if unknown
+func splitNodeID(nodeID string) (nodeName string, host *util.HostAccess) {
+	parts := strings.SplitN(nodeID, nodeIDSeparator, 3)
+	host = &util.HostAccess{}
+	if len(parts) > 1 {
+		host.NQN = parts[1]
+	}
+	if len(parts) > 2 {
+		host.IQN = parts[2]
+	}
+	return parts[0], host
+}
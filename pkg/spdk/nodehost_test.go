@@ -0,0 +1,48 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNodeID(t *testing.T) {
+	const hostNQN = "nqn.2014-08.org.nvmexpress:uuid:worker1"
+	const iqn = "iqn.2016-04.com.open-iscsi:worker1"
+	for _, want := range [][2]string{{hostNQN, iqn}, {hostNQN, ""}, {"", iqn}, {"", ""}} {
+		nodeID, err := joinNodeID("worker1", want[0], want[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nodeName, host := splitNodeID(nodeID); nodeName != "worker1" || host.NQN != want[0] || host.IQN != want[1] {
+			t.Fatalf("unexpected host of %s: %s %v", nodeID, nodeName, host)
+		}
+	}
+	if nodeID, _ := joinNodeID("worker1", "", ""); nodeID != "worker1" {
+		t.Fatalf("node id without host identities should be node name, got %s", nodeID)
+	}
+
+	// node id of old versions without iscsi initiator name
+	if nodeName, host := splitNodeID("worker1/" + hostNQN); nodeName != "worker1" || host.NQN != hostNQN || host.IQN != "" {
+		t.Fatalf("unexpected host of old node id: %s %v", nodeName, host)
+	}
+
+	if _, err := joinNodeID("worker1", hostNQN, strings.Repeat("i", maxNodeIDLength)); err == nil {
+		t.Fatal("too long node id should be rejected")
+	}
+}
@@ -0,0 +1,149 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"sort"
+	"sync"
+
+	"k8s.io/klog"
+
+	"github.com/spdk/spdk-csi/pkg/util"
+)
+
+// spdkNodeRegistry holds configs of spdk nodes known to the controller
+//   - static nodes from config.json, replaced as a whole when the file is reloaded
+//   - nodes registered by SpdkStorageNode resources at runtime
+//
+// Static node takes precedence if a node is defined in both. Configs are replaced
+// but never modified once registered, so requests can keep using the config they
+// got without lock even if it's replaced later.
+type spdkNodeRegistry struct {
+	mtx     sync.RWMutex
+	static  map[string]*util.SpdkNodeConfig
+	dynamic map[string]*util.SpdkNodeConfig
+}
+
+func newSpdkNodeRegistry() *spdkNodeRegistry {
+	return &spdkNodeRegistry{
+		static:  map[string]*util.SpdkNodeConfig{},
+		dynamic: map[string]*util.SpdkNodeConfig{},
+	}
+}
+
+func (r *spdkNodeRegistry) get(name string) (*util.SpdkNodeConfig, bool) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	if cfg, ok := r.static[name]; ok {
+		return cfg, true
+	}
+	cfg, ok := r.dynamic[name]
+	return cfg, ok
+}
+
+// list configs of all nodes sorted by name
+func (r *spdkNodeRegistry) list() []*util.SpdkNodeConfig {
+	r.mtx.RLock()
+	cfgs := make([]*util.SpdkNodeConfig, 0, len(r.static)+len(r.dynamic))
+	for _, cfg := range r.static {
+		cfgs = append(cfgs, cfg)
+	}
+	for name, cfg := range r.dynamic {
+		if _, ok := r.static[name]; !ok {
+			cfgs = append(cfgs, cfg)
+		}
+	}
+	r.mtx.RUnlock()
+	sort.Slice(cfgs, func(i, j int) bool { return cfgs[i].Name < cfgs[j].Name })
+	return cfgs
+}
+
+// names of all nodes in sorted order
+func (r *spdkNodeRegistry) names() []string {
+	cfgs := r.list()
+	names := make([]string, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		names = append(names, cfg.Name)
+	}
+	return names
+}
+
+func (r *spdkNodeRegistry) len() int {
+	return len(r.list())
+}
+
+func (r *spdkNodeRegistry) isStatic(name string) bool {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	_, ok := r.static[name]
+	return ok
+}
+
+// loadStatic replaces static nodes with cfgs. Nodes not in cfgs are kept but
+// unschedulable, so their existing volumes can still be accessed and deleted,
+// unless they are also registered at runtime.
+func (r *spdkNodeRegistry) loadStatic(cfgs []*util.SpdkNodeConfig) {
+	static := make(map[string]*util.SpdkNodeConfig, len(cfgs))
+	for _, cfg := range cfgs {
+		static[cfg.Name] = cfg
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for name, cfg := range r.static {
+		if _, ok := static[name]; ok {
+			continue
+		}
+		if _, ok := r.dynamic[name]; ok {
+			klog.Infof("spdk node %s removed from config, use the runtime one", name)
+			continue
+		}
+		if !cfg.Unschedulable {
+			klog.Infof("spdk node %s removed from config, set unschedulable", name)
+			removed := *cfg
+			removed.Unschedulable = true
+			cfg = &removed
+		}
+		static[name] = cfg
+	}
+	r.static = static
+}
+
+// add a runtime node or replace config of an existing one
+func (r *spdkNodeRegistry) set(cfg *util.SpdkNodeConfig) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.dynamic[cfg.Name] = cfg
+}
+
+// setUnschedulable keeps a runtime node registered but unschedulable, like
+// static nodes removed from config, so its existing volumes can still be
+// accessed and deleted. Returns false if the node is not registered at runtime.
+func (r *spdkNodeRegistry) setUnschedulable(name string) bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	cfg, ok := r.dynamic[name]
+	if !ok {
+		return false
+	}
+	if !cfg.Unschedulable {
+		removed := *cfg
+		removed.Unschedulable = true
+		r.dynamic[name] = &removed
+	}
+	return true
+}
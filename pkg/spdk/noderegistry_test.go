@@ -0,0 +1,101 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spdk/spdk-csi/pkg/util"
+)
+
+func TestSpdkNodeRegistry(t *testing.T) {
+	r := newSpdkNodeRegistry()
+	node1 := &util.SpdkNodeConfig{Name: "node1", URL: "node1"}
+	r.loadStatic([]*util.SpdkNodeConfig{node1, {Name: "node2", URL: "node2"}})
+	r.set(&util.SpdkNodeConfig{Name: "node2", URL: "runtime-node2"})
+	r.set(&util.SpdkNodeConfig{Name: "node3", URL: "node3"})
+	if cfg, _ := r.get("node2"); cfg.URL != "node2" {
+		t.Fatalf("static node should take precedence: %s", cfg.URL)
+	}
+	if names := r.names(); len(names) != 3 || names[0] != "node1" || names[2] != "node3" {
+		t.Fatalf("unexpected nodes: %v", names)
+	}
+
+	// requests keep the config they got
+	r.loadStatic([]*util.SpdkNodeConfig{{Name: "node1", URL: "new-node1"}})
+	if node1.URL != "node1" {
+		t.Fatalf("config modified: %s", node1.URL)
+	}
+	if cfg, _ := r.get("node1"); cfg.URL != "new-node1" || cfg.Unschedulable {
+		t.Fatalf("unexpected node1: %+v", cfg)
+	}
+	// removed static node is replaced by the runtime one if any
+	if cfg, _ := r.get("node2"); cfg.URL != "runtime-node2" || cfg.Unschedulable {
+		t.Fatalf("unexpected node2: %+v", cfg)
+	}
+
+	// removed static node is kept unschedulable
+	r.loadStatic(nil)
+	if cfg, ok := r.get("node1"); !ok || !cfg.Unschedulable {
+		t.Fatalf("unexpected removed node1: %+v", cfg)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	cs, err := createFakeController(newFakeSpdkNode("node1", "lvs0", 1000), newFakeSpdkNode("node2", "lvs0", 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	node1, _ := cs.spdkNodes.get("node1")
+	cs.spdkNodes = newSpdkNodeRegistry()
+	cs.spdkNodes.loadStatic([]*util.SpdkNodeConfig{node1})
+
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	t.Setenv(controllerConfigEnv, configFile)
+	reload := func(config string) {
+		t.Helper()
+		if err := os.WriteFile(configFile, []byte(config), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		cs.reloadConfig()
+	}
+
+	reload(`{"nodes": [{"name": "node2", "rpcURL": "http://node2", "targetType": "nvme-tcp", "targetAddr": "127.0.0.1"}]}`)
+	if cfg, ok := cs.spdkNodes.get("node2"); !ok || cfg.Unschedulable {
+		t.Fatalf("node2 not added: %+v", cfg)
+	}
+	if cfg, ok := cs.spdkNodes.get("node1"); !ok || !cfg.Unschedulable {
+		t.Fatalf("removed node1 should be unschedulable: %+v", cfg)
+	}
+
+	// invalid config is not applied
+	for _, config := range []string{
+		`{"nodes": [{"name": "node3"`,
+		`{"nodes": [{"name": "node3", "rpcURL": "node3"}]}`,
+		`{"nodes": [], "schedulePolicy": "random"}`,
+	} {
+		reload(config)
+		if names := cs.spdkNodes.names(); len(names) != 2 {
+			t.Fatalf("invalid config %s applied: %v", config, names)
+		}
+		if cfg, _ := cs.spdkNodes.get("node2"); cfg.Unschedulable {
+			t.Fatalf("invalid config %s applied", config)
+		}
+	}
+}
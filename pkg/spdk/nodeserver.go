@@ -20,10 +20,16 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
@@ -37,12 +43,28 @@ import (
 	"github.com/spdk/spdk-csi/pkg/util"
 )
 
+const (
+	nodeServerConfigEnv  = "SPDKCSI_CONFIG_NODESERVER"
+	nodeServerConfigFile = "/etc/spdkcsi-nodeserver-config/nodeserver-config.json"
+)
+
 type nodeServer struct {
 	*csicommon.DefaultNodeServer
-	mounter       mount.Interface
-	volumeLocks   *util.VolumeLocks
-	xpuConnClient *grpc.ClientConn
-	xpuConfigInfo *util.XpuConfig
+	mounter     mount.Interface
+	volumeLocks *util.VolumeLocks
+
+	// connected xPU node, replaced when xpuList in config file changes
+	xpuMtx    sync.RWMutex
+	xpu       *xpuConnection
+	reloadMtx sync.Mutex
+	xpuList   []*util.XpuConfig
+}
+
+// xpuConnection is closed once replaced and no longer used by any request
+type xpuConnection struct {
+	client   *grpc.ClientConn
+	config   *util.XpuConfig
+	inflight sync.WaitGroup
 }
 
 // try to set up a connection to the first available xPU node in the list via grpc
@@ -53,17 +75,7 @@ func connectXpuNode(xpuList []*util.XpuConfig) (*grpc.ClientConn, *util.XpuConfi
 	var xpuConfigInfo *util.XpuConfig
 
 	for i := range xpuList {
-		conn, err := grpc.Dial(
-			xpuList[i].TargetAddr,
-			grpc.WithTransportCredentials(insecure.NewCredentials()),
-			grpc.WithBlock(),
-			grpc.WithKeepaliveParams(keepalive.ClientParameters{
-				Time:                10 * time.Second,
-				Timeout:             1 * time.Second,
-				PermitWithoutStream: true,
-			}),
-			grpc.FailOnNonTempDialError(true),
-		)
+		conn, err := dialXpu(context.Background(), xpuList[i].TargetAddr)
 		if err != nil {
 			klog.Errorf("connect to xPU node: TargetType (%v), TargetAddr (%v) with err (%v)", xpuList[i].TargetType, xpuList[i].TargetAddr, err)
 		} else {
@@ -78,6 +90,24 @@ func connectXpuNode(xpuList []*util.XpuConfig) (*grpc.ClientConn, *util.XpuConfi
 	return xpuConnClient, xpuConfigInfo
 }
 
+// dialXpu blocks until the xPU node is connected or ctx is done
+func dialXpu(ctx context.Context, targetAddr string) (*grpc.ClientConn, error) {
+	return grpc.DialContext(
+		ctx,
+		targetAddr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithBlock(),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                10 * time.Second,
+			Timeout:             1 * time.Second,
+			PermitWithoutStream: true,
+		}),
+		grpc.FailOnNonTempDialError(true),
+		// span of each sma/opi call, trace context is propagated to xPU
+		grpc.WithUnaryInterceptor(otelgrpc.UnaryClientInterceptor()),
+	)
+}
+
 func newNodeServer(d *csicommon.CSIDriver) (*nodeServer, error) {
 	ns := &nodeServer{
 		DefaultNodeServer: csicommon.NewDefaultNodeServer(d),
@@ -87,45 +117,106 @@ func newNodeServer(d *csicommon.CSIDriver) (*nodeServer, error) {
 
 	// get xPU nodes' configs, see deploy/kubernetes/nodeserver-config-map.yaml
 	// as spdkcsi-nodeservercm configMap volume is optional when deploying k8s, check nodeserver-config-map.yaml is missing or empty
-	spdkcsiNodeServerConfigFile := "/etc/spdkcsi-nodeserver-config/nodeserver-config.json"
-	spdkcsiNodeServerConfigFileEnv := "SPDKCSI_CONFIG_NODESERVER"
-	configFile := util.FromEnv(spdkcsiNodeServerConfigFileEnv, spdkcsiNodeServerConfigFile)
-	_, err := os.Stat(configFile)
-	klog.Infof("check whether the configuration file (%s) which is supposed to contain xPU info exists", spdkcsiNodeServerConfigFile)
-	if os.IsNotExist(err) {
-		klog.Infof("configuration file specified in %s (%s by default) is missing or empty", spdkcsiNodeServerConfigFileEnv, spdkcsiNodeServerConfigFile)
-		return ns, nil
+	configFile := util.FromEnv(nodeServerConfigEnv, nodeServerConfigFile)
+	if err := ns.loadXpuConfig(configFile); err != nil {
+		return nil, err
 	}
+	// xPU is connected or switched once the file is created or changed
+	if _, err := util.WatchFile(configFile, ns.reloadXpuConfig); err != nil {
+		klog.Errorf("config file %s won't be reloaded on change: %s", configFile, err.Error())
+	}
+	return ns, nil
+}
 
-	//nolint:tagliatelle // not using json:snake case
-	var config struct {
-		XpuList []*util.XpuConfig `json:"xpuList"`
+func (ns *nodeServer) loadXpuConfig(configFile string) error {
+	_, err := os.Stat(configFile)
+	klog.Infof("check whether the configuration file (%s) which is supposed to contain xPU info exists", configFile)
+	if os.IsNotExist(err) {
+		klog.Infof("configuration file specified in %s (%s by default) is missing or empty", nodeServerConfigEnv, nodeServerConfigFile)
+		return nil
 	}
 
-	err = util.ParseJSONFile(configFile, &config)
+	config, err := util.NewNodeServerConfig(configFile)
 	if err != nil {
-		return nil, fmt.Errorf("error in the configuration file specified in %s (%s by default): %w", spdkcsiNodeServerConfigFileEnv, spdkcsiNodeServerConfigFile, err)
+		return fmt.Errorf("error in the configuration file specified in %s (%s by default): %w", nodeServerConfigEnv, nodeServerConfigFile, err)
 	}
-	klog.Infof("obtained xPU info (%v) from configuration file (%s)", config.XpuList, spdkcsiNodeServerConfigFile)
+	klog.Infof("obtained xPU info (%v) from configuration file (%s)", config.XpuList, configFile)
 
-	// try to connect a valid xPU node
-	ns.xpuConnClient, ns.xpuConfigInfo = connectXpuNode(config.XpuList)
+	ns.xpuList = config.XpuList
+	ns.xpu = connectXpu(config.XpuList)
+	return nil
+}
 
-	if ns.xpuConfigInfo != nil {
-		if ns.xpuConfigInfo.TargetType == "xpu-opi-virtioblk" && !util.IsKvm(&ns.xpuConfigInfo.PciIDs) {
-			klog.Errorf("Creating OPI VirtioBlk device on xPU hardware is not supported yet")
-			ns.xpuConnClient = nil
+// try to connect a valid xPU node in the list, nil if none is connected
+func connectXpu(xpuList []*util.XpuConfig) *xpuConnection {
+	conn, xpuConfig := connectXpuNode(xpuList)
+	if xpuConfig != nil {
+		if err := checkXpuSupported(xpuConfig); err != nil {
+			klog.Errorf("xPU node %s: %s", xpuConfig.Name, err.Error())
+			conn.Close()
+			conn = nil
 		}
 	}
 
-	if ns.xpuConnClient == nil {
+	if conn == nil {
 		klog.Infof("failed to connect to any xPU node in the xpuList or xpuList is empty or wrong configuration, will continue without xPU node")
+		return nil
 	}
+	return &xpuConnection{client: conn, config: xpuConfig}
+}
 
-	return ns, nil
+func checkXpuSupported(xpuConfig *util.XpuConfig) error {
+	if xpuConfig.TargetType == "xpu-opi-virtioblk" && !util.IsKvm(&xpuConfig.PciIDs) {
+		return fmt.Errorf("creating OPI VirtioBlk device on xPU hardware is not supported yet")
+	}
+	return nil
+}
+
+// reloadXpuConfig connects to xPU nodes in the changed config file, current
+// config is kept if the new one is invalid. Requests in progress keep using
+// the xPU connection they got.
+func (ns *nodeServer) reloadXpuConfig() {
+	ns.reloadMtx.Lock()
+	defer ns.reloadMtx.Unlock()
+
+	configFile := util.FromEnv(nodeServerConfigEnv, nodeServerConfigFile)
+	config, err := util.NewNodeServerConfig(configFile)
+	if err != nil {
+		klog.Errorf("failed to reload config, keep using current config: %s", err.Error())
+		return
+	}
+	if reflect.DeepEqual(config.XpuList, ns.xpuList) {
+		return
+	}
+	klog.Infof("xPU config changed, reconnecting: %v", config.XpuList)
+	ns.xpuList = config.XpuList
+	xpu := connectXpu(config.XpuList)
+
+	ns.xpuMtx.Lock()
+	old := ns.xpu
+	ns.xpu = xpu
+	ns.xpuMtx.Unlock()
+	if old != nil {
+		go func() {
+			old.inflight.Wait()
+			old.client.Close()
+		}()
+	}
 }
 
-func (ns *nodeServer) NodeStageVolume(_ context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+// acquireXpu gets current xPU connection, nil if not connected. Release must be
+// called once the connection is not used by the request.
+func (ns *nodeServer) acquireXpu() (xpu *xpuConnection, release func()) {
+	ns.xpuMtx.RLock()
+	defer ns.xpuMtx.RUnlock()
+	if ns.xpu == nil {
+		return nil, func() {}
+	}
+	ns.xpu.inflight.Add(1)
+	return ns.xpu, ns.xpu.inflight.Done
+}
+
+func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
 	volumeID := req.GetVolumeId()
 	unlock := ns.volumeLocks.Lock(volumeID)
 	defer unlock()
@@ -143,27 +234,23 @@ func (ns *nodeServer) NodeStageVolume(_ context.Context, req *csi.NodeStageVolum
 		return &csi.NodeStageVolumeResponse{}, nil
 	}
 
-	var initiator util.SpdkCsiInitiator
-	if ns.xpuConnClient != nil {
-		vc := req.GetVolumeContext()
-		vc["stagingParentPath"] = stagingParentPath
-		initiator, err = util.NewSpdkCsiXpuInitiator(vc, ns.xpuConnClient, ns.xpuConfigInfo)
-	} else {
-		initiator, err = util.NewSpdkCsiInitiator(req.GetVolumeContext())
-	}
+	initiator, release, err := ns.newInitiator(req.GetVolumeContext(), req.GetSecrets(), stagingParentPath)
 	if err != nil {
 		klog.Errorf("failed to create spdk initiator, volumeID: %s err: %v", volumeID, err)
 		return nil, status.Error(codes.Internal, err.Error())
 	}
+	defer release()
 
-	devicePath, err := initiator.Connect() // idempotent
+	start := time.Now()
+	devicePath, err := initiator.Connect(ctx) // idempotent
+	util.ObserveInitiator("connect", req.GetVolumeContext()["targetType"], start, err)
 	if err != nil {
 		klog.Errorf("failed to connect initiator, volumeID: %s err: %v", volumeID, err)
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 	defer func() {
 		if err != nil {
-			initiator.Disconnect() //nolint:errcheck // ignore error
+			initiator.Disconnect(ctx) //nolint:errcheck // ignore error
 		}
 	}()
 	if err = ns.stageVolume(devicePath, stagingTargetPath, req); err != nil { // idempotent
@@ -180,7 +267,7 @@ func (ns *nodeServer) NodeStageVolume(_ context.Context, req *csi.NodeStageVolum
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
-func (ns *nodeServer) NodeUnstageVolume(_ context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
 	volumeID := req.GetVolumeId()
 	unlock := ns.volumeLocks.Lock(volumeID)
 	defer unlock()
@@ -209,19 +296,15 @@ func (ns *nodeServer) NodeUnstageVolume(_ context.Context, req *csi.NodeUnstageV
 		klog.Errorf("failed to lookup volume context, volumeID: %s err: %v", volumeID, err)
 		return nil, status.Error(codes.Internal, err.Error())
 	}
-	var initiator util.SpdkCsiInitiator
-	if ns.xpuConnClient != nil {
-		vc := volumeContext
-		vc["stagingParentPath"] = stagingParentPath
-		initiator, err = util.NewSpdkCsiXpuInitiator(vc, ns.xpuConnClient, ns.xpuConfigInfo)
-	} else {
-		initiator, err = util.NewSpdkCsiInitiator(volumeContext)
-	}
+	initiator, release, err := ns.newInitiator(volumeContext, nil, stagingParentPath)
 	if err != nil {
 		klog.Errorf("failed to create spdk initiator, volumeID: %s err: %v", volumeID, err)
 		return nil, status.Error(codes.Internal, err.Error())
 	}
-	err = initiator.Disconnect() // idempotent
+	defer release()
+	start := time.Now()
+	err = initiator.Disconnect(ctx) // idempotent
+	util.ObserveInitiator("disconnect", volumeContext["targetType"], start, err)
 	if err != nil {
 		klog.Errorf("failed to disconnect initiator, volumeID: %s err: %v", volumeID, err)
 		return nil, status.Error(codes.Internal, err.Error())
@@ -259,6 +342,174 @@ func (ns *nodeServer) NodeUnpublishVolume(_ context.Context, req *csi.NodeUnpubl
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
+func (ns *nodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	unlock := ns.volumeLocks.Lock(volumeID)
+	defer unlock()
+
+	stagingParentPath := req.GetStagingTargetPath()
+	if stagingParentPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "staging target path missing in request")
+	}
+	stagingTargetPath := getStagingTargetPath(req)
+
+	volumeContext, err := util.LookupVolumeContext(stagingParentPath)
+	if err != nil {
+		klog.Errorf("failed to lookup volume context, volumeID: %s err: %v", volumeID, err)
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	initiator, release, err := ns.newInitiator(volumeContext, nil, stagingParentPath)
+	if err != nil {
+		klog.Errorf("failed to create spdk initiator, volumeID: %s err: %v", volumeID, err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	defer release()
+	err = initiator.Rescan(ctx)
+	if err != nil {
+		klog.Errorf("failed to rescan device, volumeID: %s err: %v", volumeID, err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// nothing more to do for raw block volume, the device itself is resized
+	if req.GetVolumeCapability().GetBlock() != nil {
+		return &csi.NodeExpandVolumeResponse{CapacityBytes: req.GetCapacityRange().GetRequiredBytes()}, nil
+	}
+
+	devicePath, _, err := mount.GetDeviceNameFromMount(ns.mounter, stagingTargetPath)
+	if err != nil {
+		klog.Errorf("failed to get device from mount point, targetPath: %s err: %v", stagingTargetPath, err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if devicePath == "" {
+		return nil, status.Errorf(codes.NotFound, "volume %s is not staged", volumeID)
+	}
+	err = ns.resizeFilesystem(devicePath, stagingTargetPath)
+	if err != nil {
+		klog.Errorf("failed to resize filesystem, volumeID: %s devicePath: %s err: %v", volumeID, devicePath, err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &csi.NodeExpandVolumeResponse{CapacityBytes: req.GetCapacityRange().GetRequiredBytes()}, nil
+}
+
+// NodeGetVolumeStats reports filesystem usage of mounted volumes, or device size of
+// raw block volumes. Volume is abnormal if the connection to spdk target is broken.
+func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	volumeID := req.GetVolumeId()
+	volumePath := req.GetVolumePath()
+	if volumeID == "" || volumePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id or volume path missing in request")
+	}
+
+	info, err := os.Stat(volumePath)
+	if os.IsNotExist(err) {
+		return nil, status.Errorf(codes.NotFound, "volume path %s not found", volumePath)
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	var usage []*csi.VolumeUsage
+	if info.Mode()&os.ModeDevice != 0 {
+		usage, err = getBlockUsage(volumePath)
+	} else {
+		usage, err = getFilesystemUsage(volumePath)
+	}
+	if err != nil {
+		klog.Errorf("failed to get volume stats, volumeID: %s volumePath: %s err: %v", volumeID, volumePath, err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage:           usage,
+		VolumeCondition: ns.getVolumeCondition(ctx, req.GetStagingTargetPath()),
+	}, nil
+}
+
+func getFilesystemUsage(path string) ([]*csi.VolumeUsage, error) {
+	var statfs syscall.Statfs_t
+	if err := syscall.Statfs(path, &statfs); err != nil {
+		return nil, err
+	}
+	blockSize := statfs.Bsize
+	return []*csi.VolumeUsage{
+		{
+			Unit:      csi.VolumeUsage_BYTES,
+			Total:     int64(statfs.Blocks) * blockSize,
+			Available: int64(statfs.Bavail) * blockSize,
+			Used:      int64(statfs.Blocks-statfs.Bfree) * blockSize,
+		},
+		{
+			Unit:      csi.VolumeUsage_INODES,
+			Total:     int64(statfs.Files),
+			Available: int64(statfs.Ffree),
+			Used:      int64(statfs.Files - statfs.Ffree),
+		},
+	}, nil
+}
+
+// used and available space of a raw block device is unknown, only report the total size
+func getBlockUsage(path string) ([]*csi.VolumeUsage, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	return []*csi.VolumeUsage{
+		{
+			Unit:  csi.VolumeUsage_BYTES,
+			Total: size,
+		},
+	}, nil
+}
+
+// check connection to spdk target of a staged volume, nil if staging path is unknown
+func (ns *nodeServer) getVolumeCondition(ctx context.Context, stagingParentPath string) *csi.VolumeCondition {
+	if stagingParentPath == "" {
+		return nil
+	}
+	volumeContext, err := util.LookupVolumeContext(stagingParentPath)
+	if err != nil {
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("volume is not staged: %s", err)}
+	}
+	initiator, release, err := ns.newInitiator(volumeContext, nil, stagingParentPath)
+	if err == nil {
+		err = initiator.Health(ctx)
+		release()
+	}
+	if err != nil {
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("volume is not accessible: %s", err)}
+	}
+	return &csi.VolumeCondition{Abnormal: false, Message: "volume is connected to spdk target"}
+}
+
+// NodeGetInfo reports topology of this node, volumes are placed on spdk targets accessible from it
+func (ns *nodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	resp, err := ns.DefaultNodeServer.NodeGetInfo(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	nodeName := resp.GetNodeId()
+	resp.AccessibleTopology = &csi.Topology{Segments: getNodeTopology(nodeName)}
+	klog.Infof("node %s topology: %v", nodeName, resp.AccessibleTopology.Segments)
+	// controller allows the host NQN or IQN to access volumes in ControllerPublishVolume,
+	// targets are connected by xPU instead of this host if xPU is used
+	hostNQN, iqn := "", ""
+	xpu, release := ns.acquireXpu()
+	release()
+	if xpu == nil {
+		hostNQN, iqn = util.NVMeHostNQN(), util.ISCSIInitiatorName()
+	}
+	resp.NodeId, err = joinNodeID(nodeName, hostNQN, iqn)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	klog.Infof("node %s host nqn: %q, iscsi initiator name: %q", nodeName, hostNQN, iqn)
+	return resp, nil
+}
+
 func (ns *nodeServer) NodeGetCapabilities(_ context.Context, _ *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
 	return &csi.NodeGetCapabilitiesResponse{
 		Capabilities: []*csi.NodeServiceCapability{
@@ -269,15 +520,57 @@ func (ns *nodeServer) NodeGetCapabilities(_ context.Context, _ *csi.NodeGetCapab
 					},
 				},
 			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+					},
+				},
+			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+					},
+				},
+			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+					},
+				},
+			},
 		},
 	}, nil
 }
 
+// create initiator of a staged volume, by xPU if connected. Release must be
+// called once the initiator is not used.
+// secrets are only passed by NodeStageVolume, they're not stored with volume context
+func (ns *nodeServer) newInitiator(volumeContext, secrets map[string]string, stagingParentPath string) (
+	initiator util.SpdkCsiInitiator, release func(), err error,
+) {
+	xpu, release := ns.acquireXpu()
+	if xpu != nil {
+		volumeContext["stagingParentPath"] = stagingParentPath
+		initiator, err = util.NewSpdkCsiXpuInitiator(volumeContext, xpu.client, xpu.config)
+	} else {
+		initiator, err = util.NewSpdkCsiInitiator(volumeContext, secrets)
+	}
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	return initiator, release, nil
+}
+
 // must be idempotent
 //
 //nolint:cyclop // many cases in switch increases complexity
 func (ns *nodeServer) stageVolume(devicePath, stagingPath string, req *csi.NodeStageVolumeRequest) error {
-	mounted, err := ns.createMountPoint(stagingPath)
+	isBlock := req.GetVolumeCapability().GetBlock() != nil
+	mounted, err := ns.createMountPoint(stagingPath, isBlock)
 	if err != nil {
 		return err
 	}
@@ -301,6 +594,13 @@ func (ns *nodeServer) stageVolume(devicePath, stagingPath string, req *csi.NodeS
 	case csi.VolumeCapability_AccessMode_UNKNOWN:
 	}
 
+	// raw block volume, bind mount the device file without formatting it
+	if isBlock {
+		mntFlags = append(mntFlags, "bind")
+		klog.Infof("mount %s to %s, flags: %v", devicePath, stagingPath, mntFlags)
+		return ns.mounter.Mount(devicePath, stagingPath, "", mntFlags)
+	}
+
 	klog.Infof("mount %s to %s, fstype: %s, flags: %v", devicePath, stagingPath, fsType, mntFlags)
 	mounter := mount.SafeFormatAndMount{Interface: ns.mounter, Exec: exec.New()}
 	err = mounter.FormatAndMount(devicePath, stagingPath, fsType, mntFlags)
@@ -310,6 +610,31 @@ func (ns *nodeServer) stageVolume(devicePath, stagingPath string, req *csi.NodeS
 	return nil
 }
 
+// grow the filesystem on a mounted device to fill the whole device
+func (ns *nodeServer) resizeFilesystem(devicePath, mountPath string) error {
+	mounter := mount.SafeFormatAndMount{Interface: ns.mounter, Exec: exec.New()}
+	fsType, err := mounter.GetDiskFormat(devicePath)
+	if err != nil {
+		return err
+	}
+
+	var cmdLine []string
+	switch fsType {
+	case "ext3", "ext4":
+		cmdLine = []string{"resize2fs", devicePath}
+	case "xfs":
+		cmdLine = []string{"xfs_growfs", "-d", mountPath}
+	default:
+		return fmt.Errorf("resizing filesystem %q is not supported", fsType)
+	}
+	klog.Infof("resize filesystem on %s, fstype: %s", devicePath, fsType)
+	output, err := mounter.Exec.Command(cmdLine[0], cmdLine[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("command %v failed: %w, output: %s", cmdLine, err, output)
+	}
+	return nil
+}
+
 // isStaged if stagingPath is a mount point, it means it is already staged, and vice versa
 func (ns *nodeServer) isStaged(stagingPath string) (bool, error) {
 	unmounted, err := mount.IsNotMountPoint(ns.mounter, stagingPath)
@@ -326,7 +651,7 @@ func (ns *nodeServer) isStaged(stagingPath string) (bool, error) {
 // must be idempotent
 func (ns *nodeServer) publishVolume(stagingPath string, req *csi.NodePublishVolumeRequest) error {
 	targetPath := req.GetTargetPath()
-	mounted, err := ns.createMountPoint(targetPath)
+	mounted, err := ns.createMountPoint(targetPath, req.GetVolumeCapability().GetBlock() != nil)
 	if err != nil {
 		return err
 	}
@@ -337,16 +662,24 @@ func (ns *nodeServer) publishVolume(stagingPath string, req *csi.NodePublishVolu
 	fsType := req.GetVolumeCapability().GetMount().GetFsType()
 	mntFlags := req.GetVolumeCapability().GetMount().GetMountFlags()
 	mntFlags = append(mntFlags, "bind")
+	if req.GetReadonly() {
+		mntFlags = append(mntFlags, "ro")
+	}
 	klog.Infof("mount %s to %s, fstype: %s, flags: %v", stagingPath, targetPath, fsType, mntFlags)
 	return ns.mounter.Mount(stagingPath, targetPath, fsType, mntFlags)
 }
 
 // create mount point if not exists, return whether already mounted
-func (ns *nodeServer) createMountPoint(path string) (bool, error) {
+// raw block volumes are bind mounted to a file instead of a directory
+func (ns *nodeServer) createMountPoint(path string, isBlock bool) (bool, error) {
 	unmounted, err := mount.IsNotMountPoint(ns.mounter, path)
 	if os.IsNotExist(err) {
 		unmounted = true
-		err = os.MkdirAll(path, 0o755)
+		if isBlock {
+			err = createMountFile(path)
+		} else {
+			err = os.MkdirAll(path, 0o755)
+		}
 	}
 	if !unmounted {
 		klog.Infof("%s already mounted", path)
@@ -373,6 +706,19 @@ func (ns *nodeServer) deleteMountPoint(path string) error {
 	return os.RemoveAll(path)
 }
 
+// create an empty file as bind mount target of a block device
+func createMountFile(path string) error {
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE, 0o640)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
 func getStagingTargetPath(req interface{}) string {
 	switch vr := req.(type) {
 	case *csi.NodeStageVolumeRequest:
@@ -381,6 +727,8 @@ func getStagingTargetPath(req interface{}) string {
 		return vr.GetStagingTargetPath() + "/" + vr.GetVolumeId()
 	case *csi.NodePublishVolumeRequest:
 		return vr.GetStagingTargetPath() + "/" + vr.GetVolumeId()
+	case *csi.NodeExpandVolumeRequest:
+		return vr.GetStagingTargetPath() + "/" + vr.GetVolumeId()
 	}
 	return ""
 }
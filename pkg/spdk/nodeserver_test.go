@@ -0,0 +1,120 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+func TestVolumeUsage(t *testing.T) {
+	dir := t.TempDir()
+	usage, err := getFilesystemUsage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usage) != 2 || usage[0].GetUnit() != csi.VolumeUsage_BYTES || usage[1].GetUnit() != csi.VolumeUsage_INODES {
+		t.Fatalf("unexpected filesystem usage: %v", usage)
+	}
+	if usage[0].GetTotal() <= 0 || usage[0].GetUsed()+usage[0].GetAvailable() > usage[0].GetTotal() {
+		t.Fatalf("invalid filesystem usage: %v", usage[0])
+	}
+
+	// seeking to the end works same for regular files and block devices
+	const size = 1024 * 1024
+	path := filepath.Join(dir, "block")
+	if err := os.WriteFile(path, make([]byte, size), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	usage, err = getBlockUsage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usage) != 1 || usage[0].GetTotal() != size {
+		t.Fatalf("unexpected block usage: %v", usage)
+	}
+}
+
+func TestVolumeConditionNotStaged(t *testing.T) {
+	ns := &nodeServer{}
+	if condition := ns.getVolumeCondition(context.TODO(), ""); condition != nil {
+		t.Fatalf("condition should be unknown without staging path: %v", condition)
+	}
+	if condition := ns.getVolumeCondition(context.TODO(), t.TempDir()); !condition.GetAbnormal() {
+		t.Fatal("volume without stashed volume context should be abnormal")
+	}
+}
+
+func TestReloadXpuConfig(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	go server.Serve(listener) //nolint:errcheck // stopped by test
+	defer server.Stop()
+
+	configFile := filepath.Join(t.TempDir(), "nodeserver-config.json")
+	t.Setenv(nodeServerConfigEnv, configFile)
+	reload := func(ns *nodeServer, config string) {
+		t.Helper()
+		if err := os.WriteFile(configFile, []byte(config), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		ns.reloadXpuConfig()
+	}
+
+	ns := &nodeServer{}
+	reload(ns, `{"xpuList": [{"name": "xpu0", "targetType": "xpu-sma-nvmftcp", "targetAddr": "`+listener.Addr().String()+`"}]}`)
+	xpu, release := ns.acquireXpu()
+	if xpu == nil || xpu.config.Name != "xpu0" {
+		t.Fatal("xPU not connected")
+	}
+
+	// invalid config is not applied
+	reload(ns, `{"xpuList": [{"name": "xpu1", "targetType": "sma-nvmftcp", "targetAddr": "127.0.0.1:1"}]}`)
+	if current, currentRelease := ns.acquireXpu(); current != xpu {
+		t.Fatal("invalid config applied")
+	} else {
+		currentRelease()
+	}
+
+	// replaced connection is closed once released
+	reload(ns, `{"xpuList": []}`)
+	if current, _ := ns.acquireXpu(); current != nil {
+		t.Fatal("xPU not disconnected")
+	}
+	if state := xpu.client.GetState(); state == connectivity.Shutdown {
+		t.Fatal("connection in use should not be closed")
+	}
+	release()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for state := xpu.client.GetState(); state != connectivity.Shutdown; state = xpu.client.GetState() {
+		if !xpu.client.WaitForStateChange(ctx, state) {
+			t.Fatal("released connection not closed")
+		}
+	}
+}
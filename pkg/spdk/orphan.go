@@ -0,0 +1,210 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+
+	"github.com/spdk/spdk-csi/pkg/util"
+)
+
+// max time of a reconcile pass
+const orphanReconcileTimeout = 5 * time.Minute
+
+const (
+	orphanLvol        = "lvol"         // lvol without PV, named by the driver
+	orphanForeignLvol = "foreign-lvol" // lvol without PV, not proved to be created by the driver
+	orphanExport      = "export"       // nvmf subsystem or iscsi target node of a deleted lvol
+)
+
+type orphanKey struct {
+	kind     string
+	nodeName string
+	lvolID   string
+}
+
+// orphanReconciler finds lvols and exports on spdk nodes without a PV of this
+// driver, which are left behind by failed or interrupted requests, e.g, the
+// controller crashed after creating a lvol but before returning the volume.
+// Orphans are reported by log and metrics, and deleted once they've been seen
+// for deleteGrace if it's not zero. Lvstores may be shared with other users of
+// the spdk target, lvols without lvolPrefix in their names are never deleted.
+type orphanReconciler struct {
+	cs         *controllerServer
+	driverName string
+	// should be longer than any CreateVolume request, lvols being created have no PV yet
+	deleteGrace time.Duration
+	// lvols are named after CreateVolume request, i.e, PV name with the prefix
+	lvolPrefix string
+	// orphans found in last pass and when they were first seen
+	orphans map[orphanKey]time.Time
+}
+
+func newOrphanReconciler(cs *controllerServer, deleteGrace time.Duration, lvolPrefix string) *orphanReconciler {
+	return &orphanReconciler{
+		cs:          cs,
+		driverName:  cs.Driver.GetName(),
+		deleteGrace: deleteGrace,
+		lvolPrefix:  lvolPrefix,
+		orphans:     map[orphanKey]time.Time{},
+	}
+}
+
+// startOrphanReconciler checks orphans every interval until the process exits
+func (cs *controllerServer) startOrphanReconciler(interval, deleteGrace time.Duration, lvolPrefix string) error {
+	if cs.kubeClient == nil {
+		return fmt.Errorf("orphan reconciler is only supported in kubernetes cluster")
+	}
+	if lvolPrefix == "" {
+		return fmt.Errorf("orphan lvol prefix is required to tell lvols created by the driver")
+	}
+	r := newOrphanReconciler(cs, deleteGrace, lvolPrefix)
+	go wait.Until(r.reconcile, interval, wait.NeverStop)
+	klog.Infof("orphan reconciler started, interval: %s, delete grace: %s, lvol prefix: %s", interval, deleteGrace, lvolPrefix)
+	return nil
+}
+
+func (r *orphanReconciler) reconcile() {
+	ctx, cancel := context.WithTimeout(context.Background(), orphanReconcileTimeout)
+	defer cancel()
+
+	// nothing is an orphan if PVs are unknown
+	volumeIDs, err := r.listVolumeIDs(ctx)
+	if err != nil {
+		klog.Errorf("failed to list persistent volumes: %s", err.Error())
+		return
+	}
+
+	now := time.Now()
+	orphans := map[orphanKey]time.Time{}
+	orphanCount.Reset()
+	for _, nodeName := range r.cs.spdkNodes.names() {
+		keys, err := r.findOrphans(ctx, nodeName, volumeIDs)
+		if err != nil {
+			klog.Errorf("failed to check orphans on spdk node %s: %s", nodeName, err.Error())
+			continue
+		}
+		orphanCount.WithLabelValues(nodeName, orphanLvol).Set(0)
+		orphanCount.WithLabelValues(nodeName, orphanForeignLvol).Set(0)
+		orphanCount.WithLabelValues(nodeName, orphanExport).Set(0)
+		for _, key := range keys {
+			firstSeen, seen := r.orphans[key]
+			if !seen {
+				firstSeen = now
+				klog.Warningf("found orphaned %s %s on spdk node %s", key.kind, key.lvolID, key.nodeName)
+			}
+			// deleted only if seen in previous passes, and none of them found a PV
+			if seen && r.deletable(key) && now.Sub(firstSeen) >= r.deleteGrace {
+				if err := r.delete(ctx, key); err == nil {
+					continue
+				}
+			}
+			orphans[key] = firstSeen
+			orphanCount.WithLabelValues(key.nodeName, key.kind).Inc()
+		}
+	}
+	r.orphans = orphans
+}
+
+// IDs of volumes in PVs of this driver
+func (r *orphanReconciler) listVolumeIDs(ctx context.Context) (map[string]bool, error) {
+	pvs, err := r.cs.kubeClient.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	volumeIDs := make(map[string]bool, len(pvs.Items))
+	for i := range pvs.Items {
+		source := pvs.Items[i].Spec.CSI
+		if source != nil && source.Driver == r.driverName {
+			volumeIDs[source.VolumeHandle] = true
+		}
+	}
+	return volumeIDs, nil
+}
+
+// deletable returns if the orphan can be deleted, foreign lvols are only reported
+func (r *orphanReconciler) deletable(key orphanKey) bool {
+	return r.deleteGrace > 0 && key.kind != orphanForeignLvol
+}
+
+// lvols not in volumeIDs, and exports of lvols not exist. Snapshots are not
+// checked, they're owned by VolumeSnapshotContents or kept for clones.
+func (r *orphanReconciler) findOrphans(ctx context.Context, nodeName string, volumeIDs map[string]bool) ([]orphanKey, error) {
+	node, err := r.cs.getSpdkNode(nodeName, nil)
+	if err != nil {
+		return nil, err
+	}
+	// exports are listed before lvols, so export of a lvol created in between
+	// is not taken as an orphan
+	exports, err := node.ListExports(ctx)
+	if err != nil {
+		return nil, err
+	}
+	lvols, err := node.ListVolumes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []orphanKey
+	lvolIDs := make(map[string]bool, len(lvols))
+	for i := range lvols {
+		lvolIDs[lvols[i].UUID] = true
+		if lvols[i].IsSnapshot || volumeIDs[fmt.Sprintf("%s:%s", nodeName, lvols[i].UUID)] {
+			continue
+		}
+		kind := orphanLvol
+		if !strings.HasPrefix(lvols[i].Name, r.lvolPrefix) {
+			kind = orphanForeignLvol
+		}
+		keys = append(keys, orphanKey{kind: kind, nodeName: nodeName, lvolID: lvols[i].UUID})
+	}
+	for _, lvolID := range exports {
+		if !lvolIDs[lvolID] {
+			keys = append(keys, orphanKey{kind: orphanExport, nodeName: nodeName, lvolID: lvolID})
+		}
+	}
+	return keys, nil
+}
+
+func (r *orphanReconciler) delete(ctx context.Context, key orphanKey) error {
+	var err error
+	switch key.kind {
+	case orphanLvol:
+		// unpublished and deleted like a volume, under the same volume lock
+		_, err = r.cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: fmt.Sprintf("%s:%s", key.nodeName, key.lvolID)})
+	case orphanExport:
+		var node util.SpdkNode
+		node, err = r.cs.getSpdkNode(key.nodeName, nil)
+		if err == nil {
+			err = node.DeleteExport(ctx, key.lvolID)
+		}
+	}
+	if err != nil {
+		klog.Errorf("failed to delete orphaned %s %s on spdk node %s: %s", key.kind, key.lvolID, key.nodeName, err.Error())
+		return err
+	}
+	klog.Infof("deleted orphaned %s %s on spdk node %s", key.kind, key.lvolID, key.nodeName)
+	return nil
+}
@@ -0,0 +1,108 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+
+	"github.com/spdk/spdk-csi/pkg/util"
+)
+
+func newCSIPersistentVolume(name, driver, volumeHandle string) *corev1.PersistentVolume {
+	return &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{Driver: driver, VolumeHandle: volumeHandle},
+			},
+		},
+	}
+}
+
+func TestOrphanReconciler(t *testing.T) {
+	node := newFakeSpdkNode("node1", "lvs0", 1000)
+	cs, err := createFakeController(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.TODO()
+	createVolume := func(name string, publish bool) string {
+		t.Helper()
+		lvolID, err := node.CreateVolume(ctx, name, "lvs0", 10, &util.LvolOptions{})
+		if err == nil && publish {
+			err = node.PublishVolume(ctx, lvolID, &util.PublishOptions{})
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return lvolID
+	}
+	volume := createVolume("pvc-1", true)
+	orphan := createVolume("pvc-2", true)
+	foreign := createVolume("manual-lvol", false) // not created by the driver
+	node.volumes["snapshot"] = &util.Lvol{UUID: "snapshot", IsSnapshot: true}
+	node.exports["deleted"] = true
+
+	cs.kubeClient = kubefake.NewSimpleClientset(
+		newCSIPersistentVolume("pv1", "test-driver", "node1:"+volume),
+		newCSIPersistentVolume("pv2", "other-driver", "node1:"+orphan),
+	)
+
+	// orphans are only reported
+	r := newOrphanReconciler(cs, 0, "pvc-")
+	r.reconcile()
+	if len(r.orphans) != 3 || len(node.volumes) != 4 || !node.exports["deleted"] {
+		t.Fatalf("unexpected orphans: %v", r.orphans)
+	}
+	if count := testutil.ToFloat64(orphanCount.WithLabelValues("node1", orphanLvol)); count != 1 {
+		t.Fatalf("unexpected orphaned lvols: %v", count)
+	}
+	if count := testutil.ToFloat64(orphanCount.WithLabelValues("node1", orphanForeignLvol)); count != 1 {
+		t.Fatalf("unexpected foreign lvols: %v", count)
+	}
+
+	// orphans seen in previous pass are deleted, new ones are kept
+	r.deleteGrace = time.Nanosecond
+	newOrphan := createVolume("pvc-3", false)
+	r.reconcile()
+	if _, ok := node.volumes[orphan]; ok || node.exports["deleted"] {
+		t.Fatal("orphans not deleted")
+	}
+	if _, ok := node.volumes[volume]; !ok {
+		t.Fatal("volume with PV deleted")
+	}
+	if _, ok := node.volumes["snapshot"]; !ok {
+		t.Fatal("snapshot deleted")
+	}
+	// foreign lvols are reported but never deleted
+	if _, ok := node.volumes[foreign]; !ok {
+		t.Fatal("foreign lvol deleted")
+	}
+	if _, ok := r.orphans[orphanKey{kind: orphanForeignLvol, nodeName: "node1", lvolID: foreign}]; !ok {
+		t.Fatalf("foreign lvol not reported: %v", r.orphans)
+	}
+	if _, ok := r.orphans[orphanKey{kind: orphanLvol, nodeName: "node1", lvolID: newOrphan}]; !ok || len(r.orphans) != 2 {
+		t.Fatalf("unexpected orphans: %v", r.orphans)
+	}
+}
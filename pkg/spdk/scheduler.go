@@ -0,0 +1,171 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// volume scheduling policies, see deploy/kubernetes/config-map.yaml
+const (
+	scheduleMostFree       = "most-free"       // lvstore with most free space
+	scheduleLeastAllocated = "least-allocated" // lvstore with lowest provisioned/usable ratio
+	scheduleRoundRobin     = "round-robin"     // lvstores in turn
+	scheduleWeighted       = "weighted"        // random lvstore, probability proportional to node weight
+)
+
+// scheduleCandidate is a node:lvstore to place a volume
+type scheduleCandidate struct {
+	nodeName        string
+	lvsName         string
+	totalMiB        int64
+	freeMiB         int64
+	provisionedMiB  int64 // total size of volumes, may exceed totalMiB with thin provisioning
+	reservedMiB     int64
+	overcommitRatio float64 // max provisioned/usable ratio of thin volumes, 0 if not limited
+	weight          int
+	topology        map[string]string // topology segments of the node
+}
+
+func (c *scheduleCandidate) id() string {
+	return c.nodeName + ":" + c.lvsName
+}
+
+// usable capacity excluding the reserved space
+func (c *scheduleCandidate) usableMiB() int64 {
+	return c.totalMiB - c.reservedMiB
+}
+
+// fits checks if a volume can be placed on the candidate
+func (c *scheduleCandidate) fits(sizeMiB int64, thinProvision bool) bool {
+	return sizeMiB <= c.capacityMiB(thinProvision)
+}
+
+// capacityMiB returns size of the largest volume which can be placed on the candidate
+//   - thick volume allocates all clusters on creation, it must fit in free space
+//   - thin volume must fit in free space, or in the overcommitted capacity if overcommit ratio is set
+func (c *scheduleCandidate) capacityMiB(thinProvision bool) int64 {
+	freeMiB := c.freeMiB - c.reservedMiB
+	if freeMiB <= 0 {
+		return 0
+	}
+	if !thinProvision || c.overcommitRatio <= 0 {
+		return freeMiB
+	}
+	capacityMiB := int64(math.Floor(float64(c.usableMiB())*c.overcommitRatio)) - c.provisionedMiB
+	if capacityMiB < 0 {
+		return 0
+	}
+	return capacityMiB
+}
+
+// volumeScheduler picks a candidate from a non empty list of candidates sorted by id,
+// all candidates have enough capacity for the volume
+type volumeScheduler interface {
+	pick(candidates []*scheduleCandidate) *scheduleCandidate
+}
+
+func newVolumeScheduler(policy string) (volumeScheduler, error) {
+	switch policy {
+	case "", scheduleMostFree:
+		return &mostFreeScheduler{}, nil
+	case scheduleLeastAllocated:
+		return &leastAllocatedScheduler{}, nil
+	case scheduleRoundRobin:
+		return &roundRobinScheduler{}, nil
+	case scheduleWeighted:
+		return &weightedScheduler{}, nil
+	default:
+		return nil, fmt.Errorf("unknown schedule policy: %s", policy)
+	}
+}
+
+type mostFreeScheduler struct{}
+
+func (s *mostFreeScheduler) pick(candidates []*scheduleCandidate) *scheduleCandidate {
+	picked := candidates[0]
+	for _, c := range candidates[1:] {
+		if c.freeMiB-c.reservedMiB > picked.freeMiB-picked.reservedMiB {
+			picked = c
+		}
+	}
+	return picked
+}
+
+type leastAllocatedScheduler struct{}
+
+func (s *leastAllocatedScheduler) pick(candidates []*scheduleCandidate) *scheduleCandidate {
+	ratio := func(c *scheduleCandidate) float64 {
+		if c.usableMiB() <= 0 {
+			return 1
+		}
+		return float64(c.provisionedMiB) / float64(c.usableMiB())
+	}
+	picked := candidates[0]
+	for _, c := range candidates[1:] {
+		if ratio(c) < ratio(picked) {
+			picked = c
+		}
+	}
+	return picked
+}
+
+type roundRobinScheduler struct {
+	mtx  sync.Mutex
+	last string // id of the candidate picked last time
+}
+
+func (s *roundRobinScheduler) pick(candidates []*scheduleCandidate) *scheduleCandidate {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	// first candidate after the last picked one, candidates may change between calls
+	idx := sort.Search(len(candidates), func(i int) bool {
+		return candidates[i].id() > s.last
+	})
+	picked := candidates[idx%len(candidates)]
+	s.last = picked.id()
+	return picked
+}
+
+type weightedScheduler struct{}
+
+func (s *weightedScheduler) pick(candidates []*scheduleCandidate) *scheduleCandidate {
+	weight := func(c *scheduleCandidate) int {
+		if c.weight <= 0 {
+			return 1
+		}
+		return c.weight
+	}
+	total := 0
+	for _, c := range candidates {
+		total += weight(c)
+	}
+	//nolint:gosec // no need of crypto random for scheduling
+	n := rand.Intn(total)
+	for _, c := range candidates {
+		n -= weight(c)
+		if n < 0 {
+			return c
+		}
+	}
+	return candidates[len(candidates)-1]
+}
@@ -0,0 +1,148 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"testing"
+)
+
+func testCandidates() []*scheduleCandidate {
+	return []*scheduleCandidate{
+		{nodeName: "node1", lvsName: "lvs0", totalMiB: 1000, freeMiB: 500, provisionedMiB: 500, weight: 1},
+		{nodeName: "node2", lvsName: "lvs0", totalMiB: 4000, freeMiB: 800, provisionedMiB: 3200, weight: 3},
+		{nodeName: "node3", lvsName: "lvs0", totalMiB: 2000, freeMiB: 1000, provisionedMiB: 800, reservedMiB: 400},
+	}
+}
+
+func TestScheduleCandidateFits(t *testing.T) {
+	c := &scheduleCandidate{totalMiB: 1000, freeMiB: 300, provisionedMiB: 1200, reservedMiB: 100}
+	cases := []struct {
+		sizeMiB         int64
+		thinProvision   bool
+		overcommitRatio float64
+		expected        bool
+	}{
+		{200, false, 0, true},
+		{201, false, 0, false},
+		{201, true, 0, false},
+		{201, false, 2, false},
+		{600, true, 2, true},
+		{601, true, 2, false},
+	}
+	for _, tc := range cases {
+		c.overcommitRatio = tc.overcommitRatio
+		if c.fits(tc.sizeMiB, tc.thinProvision) != tc.expected {
+			t.Fatalf("fits(%d, %v) with overcommit ratio %v should be %v",
+				tc.sizeMiB, tc.thinProvision, tc.overcommitRatio, tc.expected)
+		}
+	}
+
+	// no more thin volume if free space is exhausted
+	c.freeMiB = c.reservedMiB
+	if c.fits(1, true) {
+		t.Fatal("thin volume should not fit without free space")
+	}
+}
+
+func TestScheduleCandidateCapacity(t *testing.T) {
+	c := &scheduleCandidate{totalMiB: 1000, freeMiB: 300, provisionedMiB: 1200, reservedMiB: 100}
+	cases := []struct {
+		thinProvision   bool
+		overcommitRatio float64
+		expected        int64
+	}{
+		{false, 0, 200},
+		{true, 0, 200},
+		{false, 2, 200},
+		{true, 2, 600},
+		{true, 1.5, 150},
+		{true, 1, 0},
+	}
+	for _, tc := range cases {
+		c.overcommitRatio = tc.overcommitRatio
+		capacityMiB := c.capacityMiB(tc.thinProvision)
+		if capacityMiB != tc.expected {
+			t.Fatalf("capacity(%v) with overcommit ratio %v should be %d, got %d",
+				tc.thinProvision, tc.overcommitRatio, tc.expected, capacityMiB)
+		}
+		if capacityMiB > 0 && !c.fits(capacityMiB, tc.thinProvision) || c.fits(capacityMiB+1, tc.thinProvision) {
+			t.Fatalf("capacity(%v) with overcommit ratio %v doesn't match fits", tc.thinProvision, tc.overcommitRatio)
+		}
+	}
+}
+
+func TestVolumeScheduler(t *testing.T) {
+	cases := []struct {
+		policy   string
+		expected []string // ids of consecutive picks
+	}{
+		{"", []string{"node2:lvs0", "node2:lvs0"}},
+		{scheduleMostFree, []string{"node2:lvs0"}},
+		{scheduleLeastAllocated, []string{"node1:lvs0"}},
+		{scheduleRoundRobin, []string{"node1:lvs0", "node2:lvs0", "node3:lvs0", "node1:lvs0"}},
+	}
+	for _, tc := range cases {
+		scheduler, err := newVolumeScheduler(tc.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, id := range tc.expected {
+			picked := scheduler.pick(testCandidates())
+			if picked.id() != id {
+				t.Fatalf("policy %q pick %d: expected %s, got %s", tc.policy, i, id, picked.id())
+			}
+		}
+	}
+
+	if _, err := newVolumeScheduler("unknown"); err == nil {
+		t.Fatal("unknown policy should fail")
+	}
+}
+
+func TestRoundRobinSchedulerCandidatesChanged(t *testing.T) {
+	scheduler := &roundRobinScheduler{}
+	candidates := testCandidates()
+	if picked := scheduler.pick(candidates); picked.id() != "node1:lvs0" {
+		t.Fatalf("expected node1:lvs0, got %s", picked.id())
+	}
+	// node2 is full, skip to the next one
+	if picked := scheduler.pick([]*scheduleCandidate{candidates[0], candidates[2]}); picked.id() != "node3:lvs0" {
+		t.Fatalf("expected node3:lvs0, got %s", picked.id())
+	}
+	if picked := scheduler.pick(candidates[:2]); picked.id() != "node1:lvs0" {
+		t.Fatalf("expected node1:lvs0, got %s", picked.id())
+	}
+}
+
+func TestWeightedScheduler(t *testing.T) {
+	scheduler, err := newVolumeScheduler(scheduleWeighted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	candidates := testCandidates()
+	picks := make(map[string]int)
+	for i := 0; i < 5000; i++ {
+		picks[scheduler.pick(candidates).id()]++
+	}
+	// weights 1:3:1, node3 weight defaults to 1
+	if picks["node2:lvs0"] < 2*picks["node1:lvs0"] || picks["node2:lvs0"] < 2*picks["node3:lvs0"] {
+		t.Fatalf("picks not proportional to weights: %v", picks)
+	}
+	if picks["node1:lvs0"] == 0 || picks["node3:lvs0"] == 0 {
+		t.Fatalf("all candidates should be picked: %v", picks)
+	}
+}
@@ -0,0 +1,128 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+
+	"github.com/spdk/spdk-csi/pkg/util"
+)
+
+// informers of secrets not referenced for this long are stopped, e.g, the
+// secretRef of the node is changed
+const secretRefIdleTimeout = 10 * time.Minute
+
+// secretRefCache serves secrets referenced by spdk nodes from informers, each
+// watches a single secret, so requests don't get the secret from api server
+// and rotated secrets are picked up once updated
+type secretRefCache struct {
+	client    kubernetes.Interface
+	mtx       sync.Mutex
+	informers map[util.SecretReference]*secretInformer
+}
+
+type secretInformer struct {
+	store    cache.Store
+	stopCh   chan struct{}
+	lastUsed time.Time
+}
+
+func newSecretRefCache(client kubernetes.Interface) *secretRefCache {
+	return &secretRefCache{
+		client:    client,
+		informers: map[util.SecretReference]*secretInformer{},
+	}
+}
+
+// get returns the referenced secret, the informer is started on first use
+func (c *secretRefCache) get(ref util.SecretReference) (*corev1.Secret, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.stopIdle()
+
+	informer, ok := c.informers[ref]
+	if !ok {
+		var err error
+		informer, err = c.startInformer(ref)
+		if err != nil {
+			return nil, err
+		}
+		c.informers[ref] = informer
+	}
+	informer.lastUsed = time.Now()
+
+	obj, exists, err := informer.store.GetByKey(ref.Namespace + "/" + ref.Name)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("secret %s/%s not found", ref.Namespace, ref.Name)
+	}
+	secret, ok := obj.(*corev1.Secret)
+	if !ok {
+		return nil, fmt.Errorf("unexpected object type %T", obj)
+	}
+	return secret, nil
+}
+
+// startInformer returns after the secret is loaded
+func (c *secretRefCache) startInformer(ref util.SecretReference) (*secretInformer, error) {
+	selector := fields.OneTermEqualSelector("metadata.name", ref.Name).String()
+	lw := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = selector
+			return c.client.CoreV1().Secrets(ref.Namespace).List(context.Background(), options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = selector
+			return c.client.CoreV1().Secrets(ref.Namespace).Watch(context.Background(), options)
+		},
+	}
+	store, controller := cache.NewInformer(lw, &corev1.Secret{}, 0, cache.ResourceEventHandlerFuncs{})
+	informer := &secretInformer{store: store, stopCh: make(chan struct{})}
+	go controller.Run(informer.stopCh)
+
+	timer := time.AfterFunc(storageNodeTimeout, func() { close(informer.stopCh) })
+	synced := cache.WaitForCacheSync(informer.stopCh, controller.HasSynced)
+	if !timer.Stop() || !synced {
+		return nil, fmt.Errorf("failed to load secret %s/%s", ref.Namespace, ref.Name)
+	}
+	klog.V(5).Infof("watching secret %s/%s", ref.Namespace, ref.Name)
+	return informer, nil
+}
+
+func (c *secretRefCache) stopIdle() {
+	for ref, informer := range c.informers {
+		if time.Since(informer.lastUsed) > secretRefIdleTimeout {
+			close(informer.stopCh)
+			delete(c.informers, ref)
+			klog.V(5).Infof("stopped watching secret %s/%s", ref.Namespace, ref.Name)
+		}
+	}
+}
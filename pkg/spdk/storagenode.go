@@ -0,0 +1,309 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+
+	"github.com/spdk/spdk-csi/pkg/util"
+)
+
+const (
+	storageNodeResync         = 10 * time.Minute
+	storageNodeStatusInterval = time.Minute
+	// max time to probe a spdk node or to access kubernetes api
+	storageNodeTimeout = 10 * time.Second
+)
+
+// SpdkStorageNode custom resource, see deploy/kubernetes/storagenode-crd.yaml
+var storageNodeGVR = schema.GroupVersionResource{
+	Group:    "csi.spdk.io",
+	Version:  "v1alpha1",
+	Resource: "spdkstoragenodes",
+}
+
+// spdkStorageNode is a cluster scoped resource, resource name is the spdk node name
+type spdkStorageNode struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   spdkStorageNodeSpec   `json:"spec"`
+	Status spdkStorageNodeStatus `json:"status,omitempty"`
+}
+
+//nolint:tagliatelle // not using json:snake case
+type spdkStorageNodeSpec struct {
+	URL        string                  `json:"rpcURL"`
+	TargetType string                  `json:"targetType"`
+	TargetAddr string                  `json:"targetAddr"`
+	SecretRef  *util.SecretReference   `json:"secretRef,omitempty"`
+	TLS        *util.RPCTLSConfig      `json:"tls,omitempty"`
+	Topology   map[string]string       `json:"topology,omitempty"`
+	Capacity   spdkStorageNodeCapacity `json:"capacity,omitempty"`
+	// new volumes are not scheduled to the node if false, default true
+	Schedulable *bool  `json:"schedulable,omitempty"`
+	KeyringDir  string `json:"keyringDir,omitempty"`
+}
+
+//nolint:tagliatelle // not using json:snake case
+type spdkStorageNodeCapacity struct {
+	ReservedMiB     int64   `json:"reservedMiB,omitempty"`
+	OvercommitRatio float64 `json:"overcommitRatio,omitempty"`
+	Weight          int     `json:"weight,omitempty"`
+}
+
+type spdkStorageNodeStatus struct {
+	// whether lvstores of the node are queried successfully on last probe
+	Reachable bool        `json:"reachable"`
+	Message   string      `json:"message,omitempty"`
+	LastProbe metav1.Time `json:"lastProbeTime,omitempty"`
+	LvStores  []lvsStatus `json:"lvstores,omitempty"`
+}
+
+type lvsStatus struct {
+	Name       string `json:"name"`
+	TotalBytes int64  `json:"totalBytes"`
+	FreeBytes  int64  `json:"freeBytes"`
+}
+
+// storageNodeWatcher adds, updates and removes spdk nodes of the controller
+// by SpdkStorageNode resources, and reports reachability and capacity of the
+// nodes in resource status periodically
+type storageNodeWatcher struct {
+	cs     *controllerServer
+	client dynamic.Interface
+	lister cache.GenericLister
+}
+
+// initKubeClients creates kubernetes client to read secrets referenced by spdk nodes,
+// and starts watching SpdkStorageNode resources if watchStorageNodes is set
+func (cs *controllerServer) initKubeClients(watchStorageNodes bool) error {
+	kubeConfig, err := rest.InClusterConfig()
+	if err != nil {
+		if watchStorageNodes {
+			return fmt.Errorf("%s are only supported in kubernetes cluster: %w", storageNodeGVR.Resource, err)
+		}
+		klog.Infof("not running in kubernetes cluster, secretRef of spdk nodes is not supported: %s", err.Error())
+		return nil
+	}
+	cs.kubeClient, err = kubernetes.NewForConfig(kubeConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create kubernetes client: %w", err)
+	}
+	cs.secretRefs = newSecretRefCache(cs.kubeClient)
+	if !watchStorageNodes {
+		return nil
+	}
+	client, err := dynamic.NewForConfig(kubeConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create kubernetes dynamic client: %w", err)
+	}
+	// the controller runs until the process exits
+	return cs.watchStorageNodes(client, wait.NeverStop)
+}
+
+// watchStorageNodes returns after SpdkStorageNode resources are loaded, nodes
+// are updated in background until stopCh is closed
+func (cs *controllerServer) watchStorageNodes(client dynamic.Interface, stopCh <-chan struct{}) error {
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(client, storageNodeResync)
+	informer := factory.ForResource(storageNodeGVR)
+	w := &storageNodeWatcher{
+		cs:     cs,
+		client: client,
+		lister: informer.Lister(),
+	}
+
+	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    w.onUpdate,
+		UpdateFunc: func(_, obj interface{}) { w.onUpdate(obj) },
+		DeleteFunc: w.onDelete,
+	})
+	factory.Start(stopCh)
+	if !cache.WaitForCacheSync(stopCh, informer.Informer().HasSynced) {
+		return fmt.Errorf("failed to sync %s", storageNodeGVR.Resource)
+	}
+	klog.Infof("watching %s, %d spdk nodes registered", storageNodeGVR.Resource, cs.spdkNodes.len())
+
+	go wait.Until(w.reportStatus, storageNodeStatusInterval, stopCh)
+	return nil
+}
+
+func (w *storageNodeWatcher) onUpdate(obj interface{}) {
+	node, err := toStorageNode(obj)
+	if err != nil {
+		klog.Errorf("invalid %s resource: %s", storageNodeGVR.Resource, err.Error())
+		return
+	}
+	if w.cs.spdkNodes.isStatic(node.Name) {
+		// registered anyway, in case the node is removed from config.json later
+		klog.Warningf("spdk node %s is defined in config.json, resource is not used", node.Name)
+	}
+	cfg, err := node.toSpdkNodeConfig()
+	if err != nil {
+		// no new volumes until it's fixed, existing ones are accessed with last valid config
+		klog.Errorf("invalid spdk node %s: %s", node.Name, err.Error())
+		if w.cs.spdkNodes.setUnschedulable(node.Name) {
+			klog.Infof("spdk node %s set unschedulable", node.Name)
+		}
+		return
+	}
+	if old, ok := w.cs.spdkNodes.get(cfg.Name); !ok {
+		klog.Infof("spdk node %s registered, rpcURL: %s", cfg.Name, cfg.URL)
+	} else if old.Unschedulable != cfg.Unschedulable {
+		klog.Infof("spdk node %s unschedulable: %v", cfg.Name, cfg.Unschedulable)
+	}
+	w.cs.spdkNodes.set(cfg)
+}
+
+func (w *storageNodeWatcher) onDelete(obj interface{}) {
+	name, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		klog.Errorf("invalid deleted %s resource: %s", storageNodeGVR.Resource, err.Error())
+		return
+	}
+	// kept until restart, existing volumes on the node may still be unpublished and deleted
+	if w.cs.spdkNodes.setUnschedulable(name) {
+		klog.Infof("spdk node %s resource deleted, set unschedulable", name)
+	}
+}
+
+// probe nodes registered by resources and update their status
+func (w *storageNodeWatcher) reportStatus() {
+	objs, err := w.lister.List(labels.Everything())
+	if err != nil {
+		klog.Errorf("failed to list %s: %s", storageNodeGVR.Resource, err.Error())
+		return
+	}
+	for _, obj := range objs {
+		u, ok := obj.(*unstructured.Unstructured)
+		if !ok || w.cs.spdkNodes.isStatic(u.GetName()) {
+			continue
+		}
+		if _, registered := w.cs.spdkNodes.get(u.GetName()); !registered {
+			continue
+		}
+		if err := w.updateStatus(u, w.probe(u.GetName())); err != nil {
+			klog.Errorf("failed to update status of spdk node %s: %s", u.GetName(), err.Error())
+		}
+	}
+}
+
+func (w *storageNodeWatcher) probe(nodeName string) *spdkStorageNodeStatus {
+	status := &spdkStorageNodeStatus{LastProbe: metav1.Now()}
+	ctx, cancel := context.WithTimeout(context.Background(), storageNodeTimeout)
+	defer cancel()
+
+	lvstores, err := w.cs.getNodeLvStores(ctx, nodeName)
+	if err != nil {
+		status.Message = err.Error()
+		return status
+	}
+	status.Reachable = true
+	for i := range lvstores {
+		status.LvStores = append(status.LvStores, lvsStatus{
+			Name:       lvstores[i].Name,
+			TotalBytes: lvstores[i].TotalSizeMiB * 1024 * 1024,
+			FreeBytes:  lvstores[i].FreeSizeMiB * 1024 * 1024,
+		})
+	}
+	return status
+}
+
+func (w *storageNodeWatcher) updateStatus(u *unstructured.Unstructured, status *spdkStorageNodeStatus) error {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(status)
+	if err != nil {
+		return err
+	}
+	u = u.DeepCopy()
+	if err := unstructured.SetNestedMap(u.Object, content, "status"); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), storageNodeTimeout)
+	defer cancel()
+	_, err = w.client.Resource(storageNodeGVR).UpdateStatus(ctx, u, metav1.UpdateOptions{})
+	return err
+}
+
+func toStorageNode(obj interface{}) (*spdkStorageNode, error) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, fmt.Errorf("unexpected object type %T", obj)
+	}
+	var node spdkStorageNode
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), &node); err != nil {
+		return nil, fmt.Errorf("%s: %w", u.GetName(), err)
+	}
+	return &node, nil
+}
+
+func (node *spdkStorageNode) toSpdkNodeConfig() (*util.SpdkNodeConfig, error) {
+	spec := &node.Spec
+	cfg := &util.SpdkNodeConfig{
+		Name:            node.Name,
+		URL:             spec.URL,
+		TargetType:      spec.TargetType,
+		TargetAddr:      spec.TargetAddr,
+		Topology:        spec.Topology,
+		ReservedMiB:     spec.Capacity.ReservedMiB,
+		OvercommitRatio: spec.Capacity.OvercommitRatio,
+		Weight:          spec.Capacity.Weight,
+		TLS:             spec.TLS,
+		SecretRef:       spec.SecretRef,
+		Unschedulable:   spec.Schedulable != nil && !*spec.Schedulable,
+		KeyringDir:      spec.KeyringDir,
+	}
+	// checked like nodes in config.json
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// get rpc credentials of a spdk node from the kubernetes secret referenced by
+// node config, the secret is served from cache and updated by watch
+func (cs *controllerServer) getSecretRefToken(node *util.SpdkNodeConfig) (*util.RPCToken, error) {
+	if cs.secretRefs == nil {
+		return nil, fmt.Errorf("secretRef of spdk node %s is only supported in kubernetes cluster", node.Name)
+	}
+	secret, err := cs.secretRefs.get(*node.SecretRef)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get secret of spdk node %s: %w", node.Name, err)
+	}
+	return &util.RPCToken{
+		Name:       node.Name,
+		UserName:   string(secret.Data["username"]),
+		Password:   string(secret.Data["password"]),
+		CACert:     string(secret.Data["caCert"]),
+		ClientCert: string(secret.Data["clientCert"]),
+		ClientKey:  string(secret.Data["clientKey"]),
+	}, nil
+}
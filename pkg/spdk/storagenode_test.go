@@ -0,0 +1,226 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+
+	"github.com/spdk/spdk-csi/pkg/util"
+)
+
+func newStorageNodeObject(name, rpcURL string, schedulable bool) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": storageNodeGVR.GroupVersion().String(),
+		"kind":       "SpdkStorageNode",
+		"metadata":   map[string]interface{}{"name": name},
+		"spec": map[string]interface{}{
+			"rpcURL":      rpcURL,
+			"targetType":  "nvme-tcp",
+			"targetAddr":  "127.0.0.1",
+			"schedulable": schedulable,
+		},
+	}}
+}
+
+func getStorageNodeStatus(client *dynamicfake.FakeDynamicClient, name string) (*spdkStorageNodeStatus, error) {
+	obj, err := client.Resource(storageNodeGVR).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	node, err := toStorageNode(obj)
+	if err != nil {
+		return nil, err
+	}
+	return &node.Status, nil
+}
+
+func TestWatchStorageNodes(t *testing.T) {
+	cs, err := createFakeController(
+		newFakeSpdkNode("static", "lvs0", 1000),
+		newFakeSpdkNode("node1", "lvs1", 1000),
+		newFakeSpdkNode("node2", "lvs2", 1000),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only "static" node is in config.json, others are added by resources
+	staticNode, _ := cs.spdkNodes.get("static")
+	cs.spdkNodes = newSpdkNodeRegistry()
+	cs.spdkNodes.loadStatic([]*util.SpdkNodeConfig{staticNode})
+
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{storageNodeGVR: "SpdkStorageNodeList"},
+		newStorageNodeObject("node1", "http://node1", true),
+		newStorageNodeObject("node3", "http://node3", true), // not reachable
+		newStorageNodeObject("static", "invalid", true),
+	)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	if err = cs.watchStorageNodes(client, stopCh); err != nil {
+		t.Fatal(err)
+	}
+	if names := cs.spdkNodes.names(); len(names) != 3 || names[0] != "node1" || names[1] != "node3" || names[2] != "static" {
+		t.Fatalf("unexpected spdk nodes: %v", names)
+	}
+	if cfg, _ := cs.spdkNodes.get("static"); cfg.URL != "http://static" {
+		t.Fatalf("static node overridden by resource: %s", cfg.URL)
+	}
+
+	// status is reported once resources are loaded
+	err = wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		status, err := getStorageNodeStatus(client, "node3")
+		return err == nil && !status.LastProbe.IsZero(), err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := getStorageNodeStatus(client, "node1")
+	if err != nil || !status.Reachable || len(status.LvStores) != 1 || status.LvStores[0].Name != "lvs1" ||
+		status.LvStores[0].FreeBytes != 1000*1024*1024 {
+		t.Fatalf("unexpected status of node1: %+v, err: %v", status, err)
+	}
+	status, err = getStorageNodeStatus(client, "node3")
+	if err != nil || status.Reachable || status.Message == "" {
+		t.Fatalf("unexpected status of node3: %+v, err: %v", status, err)
+	}
+
+	// nodes are added at runtime, and set unschedulable once removed, so volumes on them are still accessible
+	_, err = client.Resource(storageNodeGVR).Create(context.TODO(), newStorageNodeObject("node2", "http://node2", false), metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Resource(storageNodeGVR).Delete(context.TODO(), "node1", metav1.DeleteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		cfg, ok := cs.spdkNodes.get("node2")
+		removed, exists := cs.spdkNodes.get("node1")
+		return ok && cfg.Unschedulable && exists && removed.Unschedulable, nil
+	})
+	if err != nil {
+		t.Fatalf("spdk nodes not updated: %v", cs.spdkNodes.names())
+	}
+
+	// invalid resource keeps the last valid config
+	_, err = client.Resource(storageNodeGVR).Update(context.TODO(), newStorageNodeObject("node3", "", true), metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		cfg, ok := cs.spdkNodes.get("node3")
+		return ok && cfg.Unschedulable && cfg.URL == "http://node3", nil
+	})
+	if err != nil {
+		t.Fatal("invalid spdk node should be kept unschedulable")
+	}
+
+	// unschedulable node is not picked for new volumes
+	_, _, err = cs.schedule(context.TODO(), &csi.CreateVolumeRequest{Parameters: map[string]string{"spdkNode": "node2"}},
+		100, &util.LvolOptions{}, nil)
+	if err == nil {
+		t.Fatal("volume scheduled to unschedulable node")
+	}
+}
+
+func TestSecretRefToken(t *testing.T) {
+	cs, err := createFakeController(newFakeSpdkNode("node1", "lvs0", 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &util.SpdkNodeConfig{Name: "node1", URL: "node1", SecretRef: &util.SecretReference{Name: "node1-secret", Namespace: "spdk"}}
+	if _, err = cs.getRPCToken(cfg, nil); err == nil {
+		t.Fatal("secretRef should fail without kubernetes client")
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "node1-secret", Namespace: "spdk"},
+		Data:       map[string][]byte{"username": []byte("admin"), "password": []byte("secret")},
+	}
+	cs.kubeClient = kubefake.NewSimpleClientset(secret)
+	cs.secretRefs = newSecretRefCache(cs.kubeClient)
+	token, err := cs.getRPCToken(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.UserName != "admin" || token.Password != "secret" {
+		t.Fatalf("unexpected token: %+v", token)
+	}
+
+	// served from cache, rotated secret is picked up by watch
+	secret.Data["password"] = []byte("rotated")
+	_, err = cs.kubeClient.CoreV1().Secrets("spdk").Update(context.TODO(), secret, metav1.UpdateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		token, err = cs.getRPCToken(cfg, nil)
+		return err == nil && token.Password == "rotated", err
+	})
+	if err != nil {
+		t.Fatalf("rotated secret not picked up: %v", err)
+	}
+	for _, action := range cs.kubeClient.(*kubefake.Clientset).Actions() {
+		if action.GetVerb() == "get" {
+			t.Fatalf("secret should not be get from api server: %v", action)
+		}
+	}
+
+	cfg.SecretRef.Name = "not-exist"
+	if _, err = cs.getRPCToken(cfg, nil); err == nil {
+		t.Fatal("secretRef to missing secret should fail")
+	}
+	for _, informer := range cs.secretRefs.informers {
+		close(informer.stopCh)
+	}
+}
+
+func TestStorageNodeConfig(t *testing.T) {
+	node, err := toStorageNode(newStorageNodeObject("node1", "http://127.0.0.1:9009", true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = node.toSpdkNodeConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	// resources are validated like nodes in config.json
+	for name, update := range map[string]func(spec *spdkStorageNodeSpec){
+		"targetType": func(spec *spdkStorageNodeSpec) { spec.TargetType = "nvmf-tcp" },
+		"rpcURL":     func(spec *spdkStorageNodeSpec) { spec.URL = "ftp://127.0.0.1" },
+		"secretRef":  func(spec *spdkStorageNodeSpec) { spec.SecretRef = &util.SecretReference{Name: "secret"} },
+		"keyringDir": func(spec *spdkStorageNodeSpec) { spec.KeyringDir = "keys" },
+	} {
+		invalid := *node
+		update(&invalid.Spec)
+		if _, err = invalid.toSpdkNodeConfig(); err == nil {
+			t.Fatalf("invalid %s should fail", name)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog"
+
+	"github.com/spdk/spdk-csi/pkg/util"
+)
+
+const (
+	// "true" if the node has RDMA devices and can reach nvme-rdma targets
+	topologyKeyRDMA = util.TopologyKeyRDMA
+
+	// sysfs directory of RDMA devices
+	rdmaSysfsDir = "/sys/class/infiniband"
+)
+
+// node labels reported as topology segments if present
+var topologyNodeLabels = []string{
+	util.TopologyKeyRegion,
+	util.TopologyKeyZone,
+}
+
+// getNodeTopology discovers topology segments of the node which the node server runs on
+//   - well known topology labels of the kubernetes node
+//   - whether RDMA fabric is reachable
+func getNodeTopology(nodeID string) map[string]string {
+	segments := getNodeLabelTopology(nodeID)
+	if segments == nil {
+		segments = make(map[string]string)
+	}
+	segments[topologyKeyRDMA] = strconv.FormatBool(hasRDMADevice())
+	return segments
+}
+
+func getNodeLabelTopology(nodeID string) map[string]string {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		klog.Infof("not running in kubernetes cluster, skip node labels: %s", err.Error())
+		return nil
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		klog.Errorf("failed to create kubernetes client: %s", err.Error())
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	node, err := clientset.CoreV1().Nodes().Get(ctx, nodeID, metav1.GetOptions{})
+	if err != nil {
+		klog.Errorf("failed to get kubernetes node %s: %s", nodeID, err.Error())
+		return nil
+	}
+
+	segments := make(map[string]string)
+	for _, label := range topologyNodeLabels {
+		if value, ok := node.Labels[label]; ok {
+			segments[label] = value
+		}
+	}
+	return segments
+}
+
+func hasRDMADevice() bool {
+	entries, err := os.ReadDir(rdmaSysfsDir)
+	if err != nil {
+		return false
+	}
+	return len(entries) > 0
+}
+
+// getSpdkNodeTopology returns topology segments of a spdk node, nil if not limited
+//   - segments in the node config
+//   - nvme-rdma target is only accessible from nodes with RDMA devices
+func getSpdkNodeTopology(cfg *util.SpdkNodeConfig) map[string]string {
+	if !strings.EqualFold(cfg.TargetType, "nvme-rdma") {
+		return cfg.Topology
+	}
+	segments := make(map[string]string, len(cfg.Topology)+1)
+	for key, value := range cfg.Topology {
+		segments[key] = value
+	}
+	segments[topologyKeyRDMA] = "true"
+	return segments
+}
+
+// topologyMatches checks if a spdk node is accessible from the topology segment,
+// keys not specified in either side are treated as wildcard
+func topologyMatches(nodeTopology map[string]string, topology *csi.Topology) bool {
+	for key, value := range topology.GetSegments() {
+		if nodeValue, ok := nodeTopology[key]; ok && nodeValue != value {
+			return false
+		}
+	}
+	return true
+}
+
+// topologyRequirementMatches checks if a spdk node satisfies the requisite topologies,
+// any requisite topology matches is enough
+func topologyRequirementMatches(nodeTopology map[string]string, requirement *csi.TopologyRequirement) bool {
+	if len(requirement.GetRequisite()) == 0 {
+		return true
+	}
+	for _, topology := range requirement.GetRequisite() {
+		if topologyMatches(nodeTopology, topology) {
+			return true
+		}
+	}
+	return false
+}
+
+// preferTopology narrows candidates to those matching the first preferred topology
+// which has any, all candidates are kept if none matches
+func preferTopology(candidates []*scheduleCandidate, requirement *csi.TopologyRequirement) []*scheduleCandidate {
+	for _, topology := range requirement.GetPreferred() {
+		var preferred []*scheduleCandidate
+		for _, c := range candidates {
+			if topologyMatches(c.topology, topology) {
+				preferred = append(preferred, c)
+			}
+		}
+		if len(preferred) > 0 {
+			return preferred
+		}
+	}
+	return candidates
+}
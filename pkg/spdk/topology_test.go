@@ -0,0 +1,145 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+
+	"github.com/spdk/spdk-csi/pkg/util"
+)
+
+func TestTopologyMatches(t *testing.T) {
+	nodeTopology := map[string]string{"topology.kubernetes.io/zone": "zone1"}
+	cases := []struct {
+		segments map[string]string
+		expected bool
+	}{
+		{nil, true},
+		{map[string]string{"topology.kubernetes.io/zone": "zone1"}, true},
+		{map[string]string{"topology.kubernetes.io/zone": "zone2"}, false},
+		{map[string]string{"topology.kubernetes.io/region": "region1"}, true},
+	}
+	for _, c := range cases {
+		var topology *csi.Topology
+		if c.segments != nil {
+			topology = &csi.Topology{Segments: c.segments}
+		}
+		if topologyMatches(nodeTopology, topology) != c.expected {
+			t.Fatalf("topologyMatches(%v) should be %v", c.segments, c.expected)
+		}
+	}
+	if !topologyMatches(nil, &csi.Topology{Segments: map[string]string{"topology.kubernetes.io/zone": "zone1"}}) {
+		t.Fatal("node without topology should match any segment")
+	}
+}
+
+func TestSpdkNodeTopology(t *testing.T) {
+	cfg := &util.SpdkNodeConfig{
+		TargetType: "nvme-tcp",
+		Topology:   map[string]string{"topology.kubernetes.io/zone": "zone1"},
+	}
+	if segments := getSpdkNodeTopology(cfg); len(segments) != 1 {
+		t.Fatalf("unexpected nvme-tcp topology: %v", segments)
+	}
+	cfg.TargetType = "nvme-rdma"
+	segments := getSpdkNodeTopology(cfg)
+	if len(segments) != 2 || segments[topologyKeyRDMA] != "true" {
+		t.Fatalf("unexpected nvme-rdma topology: %v", segments)
+	}
+	if len(cfg.Topology) != 1 {
+		t.Fatal("node config should not be modified")
+	}
+}
+
+func TestTopologyRequirement(t *testing.T) {
+	zone := func(name string) *csi.Topology {
+		return &csi.Topology{Segments: map[string]string{"topology.kubernetes.io/zone": name}}
+	}
+	candidates := []*scheduleCandidate{
+		{nodeName: "node1", topology: map[string]string{"topology.kubernetes.io/zone": "zone1"}},
+		{nodeName: "node2", topology: map[string]string{"topology.kubernetes.io/zone": "zone2"}},
+		{nodeName: "node3"},
+	}
+
+	requirement := &csi.TopologyRequirement{Requisite: []*csi.Topology{zone("zone2"), zone("zone3")}}
+	if topologyRequirementMatches(candidates[0].topology, requirement) {
+		t.Fatal("node1 should not match requisite topologies")
+	}
+	if !topologyRequirementMatches(candidates[1].topology, requirement) {
+		t.Fatal("node2 should match requisite topologies")
+	}
+	if !topologyRequirementMatches(candidates[0].topology, nil) {
+		t.Fatal("any node should match empty requirement")
+	}
+
+	// node3 without topology is accessible from any zone
+	requirement.Preferred = []*csi.Topology{zone("zone1"), zone("zone2")}
+	preferred := preferTopology(candidates, requirement)
+	if len(preferred) != 2 || preferred[0].nodeName != "node1" || preferred[1].nodeName != "node3" {
+		t.Fatalf("unexpected preferred candidates: %v, %v", preferred[0].nodeName, preferred[len(preferred)-1].nodeName)
+	}
+	requirement.Preferred = []*csi.Topology{zone("zone3"), zone("zone1")}
+	if preferred := preferTopology(candidates[:2], requirement); len(preferred) != 1 || preferred[0].nodeName != "node1" {
+		t.Fatal("node1 should be preferred")
+	}
+	requirement.Preferred = []*csi.Topology{zone("zone3")}
+	if preferred := preferTopology(candidates[:2], requirement); len(preferred) != 2 {
+		t.Fatal("all candidates should be kept if no preferred topology matches")
+	}
+}
+
+func TestCreateVolumeTopology(t *testing.T) {
+	cs, err := createFakeController(
+		newFakeSpdkNode("node1", "lvs0", 1000),
+		newFakeSpdkNode("node2", "lvs0", 1000),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node1, _ := cs.spdkNodes.get("node1")
+	node1.Topology = map[string]string{"topology.kubernetes.io/zone": "zone1"}
+	node2, _ := cs.spdkNodes.get("node2")
+	node2.TargetType = "nvme-rdma"
+
+	rdma := &csi.Topology{Segments: map[string]string{topologyKeyRDMA: "true", "topology.kubernetes.io/zone": "zone2"}}
+	resp, err := cs.CreateVolume(context.TODO(), &csi.CreateVolumeRequest{
+		Name:                      "test-volume-rdma",
+		CapacityRange:             &csi.CapacityRange{RequiredBytes: 100 * 1024 * 1024},
+		AccessibilityRequirements: &csi.TopologyRequirement{Requisite: []*csi.Topology{rdma}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	volume := resp.GetVolume()
+	topology := volume.GetAccessibleTopology()
+	if len(topology) != 1 || topology[0].GetSegments()[topologyKeyRDMA] != "true" {
+		t.Fatalf("volume %s has unexpected topology: %v", volume.GetVolumeId(), topology)
+	}
+
+	noRDMA := &csi.Topology{Segments: map[string]string{topologyKeyRDMA: "false", "topology.kubernetes.io/zone": "zone2"}}
+	_, err = cs.CreateVolume(context.TODO(), &csi.CreateVolumeRequest{
+		Name:                      "test-volume-inaccessible",
+		CapacityRange:             &csi.CapacityRange{RequiredBytes: 100 * 1024 * 1024},
+		AccessibilityRequirements: &csi.TopologyRequirement{Requisite: []*csi.Topology{noRDMA}},
+	})
+	if err == nil {
+		t.Fatal("no spdk node should be accessible from zone2 without RDMA")
+	}
+}
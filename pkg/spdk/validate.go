@@ -0,0 +1,202 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+
+	"github.com/spdk/spdk-csi/pkg/util"
+)
+
+// max time to probe a spdk or xPU node
+const probeTimeout = 10 * time.Second
+
+// configReport prints results of config checks and counts problems
+type configReport struct {
+	w        io.Writer
+	problems int
+}
+
+func (r *configReport) ok(format string, args ...interface{}) {
+	fmt.Fprintf(r.w, "[ OK ] "+format+"\n", args...)
+}
+
+func (r *configReport) warn(format string, args ...interface{}) {
+	fmt.Fprintf(r.w, "[WARN] "+format+"\n", args...)
+}
+
+func (r *configReport) fail(format string, args ...interface{}) {
+	r.problems++
+	fmt.Fprintf(r.w, "[FAIL] "+format+"\n", args...)
+}
+
+// ValidateConfig checks config files and secrets of the controller and node
+// server, and probes spdk and xPU nodes in them. Only the server selected by
+// conf is checked, or both if neither is selected. The report is printed to
+// w, returns false if any problem is found.
+func ValidateConfig(conf *util.Config, w io.Writer) bool {
+	r := &configReport{w: w}
+	all := !conf.IsControllerServer && !conf.IsNodeServer
+	if conf.IsControllerServer || all {
+		validateControllerConfig(r, conf.WatchStorageNodes)
+	}
+	if conf.IsNodeServer || all {
+		validateNodeServerConfig(r)
+	}
+	fmt.Fprintf(w, "%d problems found\n", r.problems)
+	return r.problems == 0
+}
+
+func validateControllerConfig(r *configReport, watchStorageNodes bool) {
+	configFile := util.FromEnv(controllerConfigEnv, controllerConfigFile)
+	config, err := loadControllerConfig(watchStorageNodes)
+	if err != nil {
+		r.fail("controller config %s: %s", configFile, err)
+		return
+	}
+	if _, err = newVolumeScheduler(config.SchedulePolicy); err != nil {
+		r.fail("controller config %s: %s", configFile, err)
+	} else {
+		r.ok("controller config %s: %d spdk nodes", configFile, len(config.Nodes))
+	}
+	if len(config.Nodes) == 0 && !watchStorageNodes {
+		r.fail("controller config %s: no spdk node", configFile)
+	}
+
+	// nodes of SpdkStorageNode resources are probed by the running controller
+	cs := &controllerServer{
+		spdkNodes:   newSpdkNodeRegistry(),
+		newSpdkNode: util.NewSpdkNode,
+	}
+	cs.spdkNodes.loadStatic(getNodeConfigs(config))
+	if err = cs.loadControllerSecrets(); err != nil {
+		r.fail("controller secrets: %s", err)
+	} else if cs.spdkSecretsFile == "" {
+		r.warn("controller secrets not found, rpc tokens must be passed in requests")
+	} else {
+		r.ok("controller secrets %s", cs.spdkSecretsFile)
+	}
+	if err = cs.initKubeClients(false); err != nil {
+		r.fail("kubernetes client: %s", err)
+	}
+	cs.validateSpdkNodes(r)
+}
+
+func (cs *controllerServer) validateSpdkNodes(r *configReport) {
+	for _, cfg := range cs.spdkNodes.list() {
+		if cfg.KeyringDir != "" {
+			if info, err := os.Stat(cfg.KeyringDir); err != nil || !info.IsDir() {
+				r.fail("spdk node %s: keyringDir %s is not a directory", cfg.Name, cfg.KeyringDir)
+			}
+		}
+		if err := cs.checkRPCToken(cfg); err != nil {
+			r.fail("spdk node %s: %s", cfg.Name, err)
+			continue
+		}
+		lvstores, err := cs.probeSpdkNode(cfg.Name)
+		if err != nil {
+			r.fail("spdk node %s: %s", cfg.Name, err)
+			continue
+		}
+		names := make([]string, 0, len(lvstores))
+		for i := range lvstores {
+			names = append(names, lvstores[i].Name)
+		}
+		r.ok("spdk node %s: %s, lvstores: [%s]", cfg.Name, cfg.URL, strings.Join(names, " "))
+	}
+}
+
+func validateNodeServerConfig(r *configReport) {
+	configFile := util.FromEnv(nodeServerConfigEnv, nodeServerConfigFile)
+	if _, err := os.Stat(configFile); os.IsNotExist(err) {
+		r.ok("node server config %s not found, xPU is not used", configFile)
+		return
+	}
+	config, err := util.NewNodeServerConfig(configFile)
+	if err != nil {
+		r.fail("node server config %s: %s", configFile, err)
+		return
+	}
+	r.ok("node server config %s: %d xPU nodes", configFile, len(config.XpuList))
+
+	for _, xpu := range config.XpuList {
+		if err := probeXpu(xpu); err != nil {
+			r.fail("xPU node %s: %s", xpu.Name, err)
+			continue
+		}
+		r.ok("xPU node %s: %s %s", xpu.Name, xpu.TargetType, xpu.TargetAddr)
+	}
+}
+
+// probeSpdkNode checks rpc credentials and connection of a spdk node
+func (cs *controllerServer) probeSpdkNode(nodeName string) ([]util.LvStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	return cs.getNodeLvStores(ctx, nodeName)
+}
+
+// checkRPCToken checks the rpc token of a spdk node is found in controller
+// secrets or the referenced kubernetes secret, tokens in requests are not known
+func (cs *controllerServer) checkRPCToken(cfg *util.SpdkNodeConfig) error {
+	if noRPCAuth(cfg.URL) {
+		return nil
+	}
+	_, err := cs.getRPCToken(cfg, nil)
+	return err
+}
+
+// probeSpdkNodes logs spdk nodes without rpc token as errors and nodes not
+// accessible as warnings at startup, they are still used as tokens may be
+// passed in requests, and nodes may recover or be fixed later
+func (cs *controllerServer) probeSpdkNodes() {
+	var wg sync.WaitGroup
+	for _, cfg := range cs.spdkNodes.list() {
+		if err := cs.checkRPCToken(cfg); err != nil {
+			klog.Errorf("spdk node %s has no rpc token: %s", cfg.Name, err.Error())
+			continue
+		}
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			if _, err := cs.probeSpdkNode(name); err != nil {
+				klog.Warningf("spdk node %s is not accessible: %s", name, err.Error())
+			}
+		}(cfg.Name)
+	}
+	wg.Wait()
+}
+
+func probeXpu(xpu *util.XpuConfig) error {
+	if err := checkXpuSupported(xpu); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	conn, err := dialXpu(ctx, xpu.TargetAddr)
+	if err != nil {
+		return fmt.Errorf("failed to connect %s: %w", xpu.TargetAddr, err)
+	}
+	return conn.Close()
+}
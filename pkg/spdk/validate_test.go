@@ -0,0 +1,109 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package spdk
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+
+	"github.com/spdk/spdk-csi/pkg/util"
+)
+
+func TestValidateConfig(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	go server.Serve(listener) //nolint:errcheck // stopped by test
+	defer server.Stop()
+
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.json")
+	nodeServerConfigFile := filepath.Join(dir, "nodeserver-config.json")
+	t.Setenv(controllerConfigEnv, configFile)
+	t.Setenv(nodeServerConfigEnv, nodeServerConfigFile)
+	t.Setenv(controllerSecretEnv, filepath.Join(dir, "secret.json"))
+
+	validate := func(conf *util.Config, config, nodeServerConfig string) (bool, string) {
+		t.Helper()
+		if err := os.WriteFile(configFile, []byte(config), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(nodeServerConfigFile, []byte(nodeServerConfig), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		var report bytes.Buffer
+		ok := ValidateConfig(conf, &report)
+		return ok, report.String()
+	}
+	xpuConfig := `{"xpuList": [{"name": "xpu0", "targetType": "xpu-sma-nvmftcp", "targetAddr": "` + listener.Addr().String() + `"}]}`
+
+	// node server only, xPU is reachable
+	ok, report := validate(&util.Config{IsNodeServer: true}, "", xpuConfig)
+	if !ok || !strings.Contains(report, "[ OK ] xPU node xpu0") {
+		t.Fatalf("unexpected report:\n%s", report)
+	}
+
+	// both servers are checked if none is selected, spdk node is not reachable
+	ok, report = validate(&util.Config{},
+		`{"nodes": [{"name": "node1", "rpcURL": "tcp://127.0.0.1:1", "targetType": "nvme-tcp", "targetAddr": "127.0.0.1"}]}`,
+		`{"xpuList": [{"name": "xpu1", "targetType": "xpu-sma-nvmftcp", "targetAddr": "127.0.0.1:1"}]}`)
+	if ok || !strings.Contains(report, "[FAIL] spdk node node1") || !strings.Contains(report, "[FAIL] xPU node xpu1") {
+		t.Fatalf("unexpected report:\n%s", report)
+	}
+
+	// no rpc token of http node, as secret.json is not found
+	ok, report = validate(&util.Config{IsControllerServer: true},
+		`{"nodes": [{"name": "node2", "rpcURL": "http://127.0.0.1:1", "targetType": "nvme-tcp", "targetAddr": "127.0.0.1"}]}`, xpuConfig)
+	if ok || !strings.Contains(report, "[FAIL] spdk node node2: no rpc token of spdk node node2") {
+		t.Fatalf("unexpected report:\n%s", report)
+	}
+
+	// invalid config
+	ok, report = validate(&util.Config{IsControllerServer: true},
+		`{"nodes": [{"name": "node1", "rpcURL": "tcp://127.0.0.1:1", "targetType": "nvmf-tcp", "targetAddr": "127.0.0.1"}]}`, xpuConfig)
+	if ok || !strings.Contains(report, "unknown targetType: nvmf-tcp") || strings.Contains(report, "xPU") {
+		t.Fatalf("unexpected report:\n%s", report)
+	}
+}
+
+func TestCheckRPCToken(t *testing.T) {
+	cs, err := createFakeController(newFakeSpdkNode("node1", "lvs0", 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs.spdkNodes.set(&util.SpdkNodeConfig{Name: "node2", URL: "http://node2", TargetType: "nvme-tcp", TargetAddr: "127.0.0.1"})
+	cs.spdkNodes.set(&util.SpdkNodeConfig{Name: "node3", URL: "unix:///var/tmp/spdk.sock", TargetType: "nvme-tcp", TargetAddr: "127.0.0.1"})
+
+	for name, hasToken := range map[string]bool{"node1": true, "node2": false, "node3": true} {
+		cfg, _ := cs.spdkNodes.get(name)
+		err := cs.checkRPCToken(cfg)
+		if hasToken != (err == nil) {
+			t.Fatalf("unexpected token check of %s: %v", name, err)
+		}
+		if err != nil && !strings.Contains(err.Error(), name) {
+			t.Fatalf("node name is not reported: %v", err)
+		}
+	}
+}
@@ -16,17 +16,38 @@ limitations under the License.
 
 package util
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
 
 const (
 	// TODO: move hardcoded settings to config map
-	cfgRPCTimeoutSeconds = 20
-	cfgLvolClearMethod   = "unmap" // none, unmap, write_zeroes
-	cfgLvolThinProvision = true
+	cfgRPCTimeoutSeconds = 20 // per attempt, also limited by request context
+	cfgRPCRetries        = 5  // max attempts of idempotent read rpc on transient errors
+	cfgRPCBackoffMs      = 200
+	cfgRPCMaxBackoffMs   = 3000
+	cfgLvolClearMethod   = "unmap" // default, can be overridden by StorageClass parameter
+	cfgLvolThinProvision = true    // ditto
 	cfgNVMfSvcPort       = "4420"
+	cfgNVMfSecureSvcPort = "4421" // TLS listeners, spdk doesn't mix plain and TLS connections on a port
 	cfgISCSISvcPort      = "3260"
-	cfgAllowAnyHost      = true
+	cfgAllowAnyHost      = false  // hosts are allowed by ControllerPublishVolume
 	cfgAddrFamily        = "IPv4" // IPv4, IPv6, IB, FC
+	cfgLvolNameMaxLen    = 63     // SPDK_LVOL_NAME_MAX excluding the terminating null
+	cfgNVMeFabricsDevice = "/dev/nvme-fabrics"
+)
+
+// host identities of initiators, allowed to access volumes by controller
+const (
+	cfgNVMeHostNQNFile        = "/etc/nvme/hostnqn"              // read by nvme-cli
+	cfgNVMeHostIDFile         = "/etc/nvme/hostid"               // ditto
+	cfgISCSIInitiatorNameFile = "/etc/iscsi/initiatorname.iscsi" // read by iscsid
+	cfgISCSINodesDir          = "/etc/iscsi/nodes"               // node records created by discovery
 )
 
 // Config stores parsed command line parameters
@@ -35,6 +56,22 @@ type Config struct {
 	DriverVersion string
 	Endpoint      string
 	NodeID        string
+	// prometheus metrics are served at http://MetricsAddress/metrics, disabled if empty
+	MetricsAddress string
+	// spans are sent to OTLP collector at TracingEndpoint(host:port), or printed
+	// if it's "stdout", disabled if empty
+	TracingEndpoint string
+	// spdk nodes are also loaded from SpdkStorageNode resources and updated at runtime
+	WatchStorageNodes bool
+	// check config files and nodes in them, print a report and exit
+	ValidateConfig bool
+	// check lvols and exports without PV periodically, disabled if zero
+	OrphanCheckInterval time.Duration
+	// delete orphans found for this long, orphans are only reported if zero
+	OrphanDeleteGrace time.Duration
+	// lvols named with the prefix are taken as created by the driver, others
+	// are never deleted as orphans, should match --volume-name-prefix of csi-provisioner
+	OrphanLvolPrefix string
 
 	IsControllerServer bool
 	IsNodeServer       bool
@@ -45,8 +82,18 @@ type Config struct {
 //nolint:tagliatelle // not using json:snake case
 type CSIControllerConfig struct {
 	Nodes []SpdkNodeConfig `json:"Nodes"`
+	// volume scheduling policy: most-free(default), least-allocated, round-robin, weighted
+	SchedulePolicy string `json:"schedulePolicy,omitempty"`
 }
 
+// topology keys reported by CSI nodes, only these keys can be matched by
+// topology segments of spdk nodes
+const (
+	TopologyKeyRegion = "topology.kubernetes.io/region" // label of the kubernetes node
+	TopologyKeyZone   = "topology.kubernetes.io/zone"   // ditto
+	TopologyKeyRDMA   = "topology.csi.spdk.io/rdma"     // "true" if the node has RDMA devices
+)
+
 // SpdkNodeConfig config for spdk storage cluster
 //
 //nolint:tagliatelle // not using json:snake case
@@ -55,6 +102,29 @@ type SpdkNodeConfig struct {
 	URL        string `json:"rpcURL"`
 	TargetType string `json:"targetType"`
 	TargetAddr string `json:"targetAddr"`
+	// optional topology segments this node is accessible from, e.g, {"topology.kubernetes.io/zone": "zone1"},
+	// keys are limited to those reported by CSI nodes
+	Topology map[string]string `json:"topology,omitempty"`
+	// optional capacity settings for volume scheduling
+	ReservedMiB     int64   `json:"reservedMiB,omitempty"`     // space of each lvstore not used for new volumes
+	OvercommitRatio float64 `json:"overcommitRatio,omitempty"` // max provisioned/usable ratio of thin volumes
+	Weight          int     `json:"weight,omitempty"`          // used by weighted scheduling policy
+	// optional TLS settings of https rpcURL
+	TLS *RPCTLSConfig `json:"tls,omitempty"`
+	// optional kubernetes secret with rpc credentials of this node, keys are the
+	// same as rpcTokens in secret.json, used instead of secret.json if set
+	SecretRef *SecretReference `json:"secretRef,omitempty"`
+	// new volumes are not scheduled to unschedulable node, e.g, when draining it
+	Unschedulable bool `json:"unschedulable,omitempty"`
+	// optional directory shared by the controller and the spdk target at the
+	// same path, key files of the spdk file keyring are written there
+	KeyringDir string `json:"keyringDir,omitempty"`
+}
+
+// SecretReference locates a kubernetes secret
+type SecretReference struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
 }
 
 func NewCSIControllerConfig(env, def string) (*CSIControllerConfig, error) {
@@ -64,18 +134,169 @@ func NewCSIControllerConfig(env, def string) (*CSIControllerConfig, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err = config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", configFile, err)
+	}
 	return &config, nil
 }
 
+// Validate checks fields of spdk nodes and duplicated node names, nodes are not connected
+func (config *CSIControllerConfig) Validate() error {
+	names := make(map[string]bool, len(config.Nodes))
+	for i := range config.Nodes {
+		node := &config.Nodes[i]
+		if node.Name == "" {
+			return fmt.Errorf("node %d: name is required", i)
+		}
+		if err := node.Validate(); err != nil {
+			return fmt.Errorf("node %s: %w", node.Name, err)
+		}
+		if names[node.Name] {
+			return fmt.Errorf("duplicated node name: %s", node.Name)
+		}
+		names[node.Name] = true
+	}
+	return nil
+}
+
+// Validate checks fields of a spdk node from config.json or SpdkStorageNode
+// resource, the node is not connected
+func (node *SpdkNodeConfig) Validate() error {
+	if err := node.validateTarget(); err != nil {
+		return err
+	}
+	for key := range node.Topology {
+		switch key {
+		case TopologyKeyRegion, TopologyKeyZone, TopologyKeyRDMA:
+		default:
+			return fmt.Errorf("topology key %s is not reported by CSI nodes, supported keys: %s, %s, %s",
+				key, TopologyKeyRegion, TopologyKeyZone, TopologyKeyRDMA)
+		}
+	}
+	if node.SecretRef != nil && (node.SecretRef.Name == "" || node.SecretRef.Namespace == "") {
+		return fmt.Errorf("name and namespace of secretRef are required")
+	}
+	if node.KeyringDir != "" && !filepath.IsAbs(node.KeyringDir) {
+		return fmt.Errorf("keyringDir must be an absolute path: %s", node.KeyringDir)
+	}
+	return nil
+}
+
+// validateTarget checks rpc url and target of the node
+func (node *SpdkNodeConfig) validateTarget() error {
+	if node.URL == "" || node.TargetType == "" || node.TargetAddr == "" {
+		return fmt.Errorf("rpcURL, targetType and targetAddr are required")
+	}
+	switch strings.ToLower(node.TargetType) {
+	case "nvme-rdma", "nvme-tcp", "iscsi":
+	default:
+		return fmt.Errorf("unknown targetType: %s", node.TargetType)
+	}
+	// only parsed, no connection is made
+	_, err := newRPCTransport(node.URL, "", "", nil)
+	return err
+}
+
+// NodeServerConfig config for csi driver node server, see deploy/kubernetes/nodeserver-config-map.yaml
+//
+//nolint:tagliatelle // not using json:snake case
+type NodeServerConfig struct {
+	XpuList []*XpuConfig `json:"xpuList"`
+}
+
+func NewNodeServerConfig(configFile string) (*NodeServerConfig, error) {
+	var config NodeServerConfig
+	err := ParseJSONFile(configFile, &config)
+	if err != nil {
+		return nil, err
+	}
+	if err = config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", configFile, err)
+	}
+	return &config, nil
+}
+
+// Validate checks target type and address of xPU nodes
+func (config *NodeServerConfig) Validate() error {
+	for i, xpu := range config.XpuList {
+		if xpu == nil || xpu.TargetAddr == "" {
+			return fmt.Errorf("xPU %d: targetAddr is required", i)
+		}
+		if _, err := parseSpdkXpuTargetType(xpu.TargetType); err != nil {
+			return fmt.Errorf("xPU %s: %w", xpu.Name, err)
+		}
+	}
+	return nil
+}
+
+// LvolOptions options to create a logical volume, see deploy/kubernetes/storageclass.yaml
+type LvolOptions struct {
+	ThinProvision bool
+	ClearMethod   string // none, unmap, write_zeroes
+}
+
+// NewLvolOptions parses lvol options from StorageClass parameters, unspecified options are set to default
+func NewLvolOptions(params map[string]string) (*LvolOptions, error) {
+	opts := LvolOptions{
+		ThinProvision: cfgLvolThinProvision,
+		ClearMethod:   cfgLvolClearMethod,
+	}
+	if value, ok := params["thinProvision"]; ok {
+		thinProvision, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid thinProvision: %s", value)
+		}
+		opts.ThinProvision = thinProvision
+	}
+	if value, ok := params["clearMethod"]; ok {
+		switch value {
+		case "none", "unmap", "write_zeroes":
+			opts.ClearMethod = value
+		default:
+			return nil, fmt.Errorf("invalid clearMethod: %s", value)
+		}
+	}
+	return &opts, nil
+}
+
+// PublishOptions options to export a logical volume, see deploy/kubernetes/storageclass.yaml
+type PublishOptions struct {
+	// NVMe/TCP connections are encrypted by TLS with pre-shared keys of hosts
+	SecureChannel bool
+}
+
+// NewPublishOptions parses publish options from StorageClass parameters or
+// volume context, unspecified options are set to default
+func NewPublishOptions(params map[string]string) (*PublishOptions, error) {
+	opts := PublishOptions{}
+	if value, ok := params["secureChannel"]; ok {
+		secureChannel, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid secureChannel: %s", value)
+		}
+		opts.SecureChannel = secureChannel
+	}
+	return &opts, nil
+}
+
 // SpdkSecrets spdk storage cluster connection secrets, see deploy/kubernetes/secrets.yaml
 //
 //nolint:tagliatelle // not using json:snake case
 type SpdkSecrets struct {
-	Tokens []struct {
-		Name     string `json:"name"`
-		UserName string `json:"username"`
-		Password string `json:"password"`
-	} `json:"rpcTokens"`
+	Tokens []RPCToken `json:"rpcTokens"`
+}
+
+// RPCToken credentials to access rpc server of a spdk node
+//
+//nolint:tagliatelle // not using json:snake case
+type RPCToken struct {
+	Name     string `json:"name"`
+	UserName string `json:"username"`
+	Password string `json:"password"`
+	// optional PEM encoded certificates of https rpcURL, override files in RPCTLSConfig
+	CACert     string `json:"caCert,omitempty"`
+	ClientCert string `json:"clientCert,omitempty"`
+	ClientKey  string `json:"clientKey,omitempty"`
 }
 
 func NewSpdkSecrets(jsonSecrets string) (*SpdkSecrets, error) {
@@ -86,3 +307,97 @@ func NewSpdkSecrets(jsonSecrets string) (*SpdkSecrets, error) {
 	}
 	return &secs, nil
 }
+
+// keys of iSCSI CHAP credentials in StorageClass secrets, same as the in-tree
+// iscsi volume plugin
+const (
+	chapUserKey         = "node.session.auth.username"
+	chapSecretKey       = "node.session.auth.password"
+	chapMutualUserKey   = "node.session.auth.username_in"
+	chapMutualSecretKey = "node.session.auth.password_in"
+)
+
+// ISCSICHAPSecret credentials of iSCSI CHAP authentication, the initiator is
+// authenticated by User and Secret, and the target is also authenticated by
+// MutualUser and MutualSecret if they're set (mutual CHAP)
+type ISCSICHAPSecret struct {
+	User         string
+	Secret       string
+	MutualUser   string
+	MutualSecret string
+}
+
+// NewISCSICHAPSecret parses CHAP credentials from request secrets, returns nil
+// if CHAP is not configured
+func NewISCSICHAPSecret(secrets map[string]string) (*ISCSICHAPSecret, error) {
+	chap := &ISCSICHAPSecret{
+		User:         secrets[chapUserKey],
+		Secret:       secrets[chapSecretKey],
+		MutualUser:   secrets[chapMutualUserKey],
+		MutualSecret: secrets[chapMutualSecretKey],
+	}
+	if chap.User == "" && chap.Secret == "" && chap.MutualUser == "" && chap.MutualSecret == "" {
+		return nil, nil
+	}
+	if chap.User == "" || chap.Secret == "" {
+		return nil, fmt.Errorf("both %s and %s are required for CHAP", chapUserKey, chapSecretKey)
+	}
+	if (chap.MutualUser == "") != (chap.MutualSecret == "") {
+		return nil, fmt.Errorf("both %s and %s are required for mutual CHAP", chapMutualUserKey, chapMutualSecretKey)
+	}
+	return chap, nil
+}
+
+// Mutual returns if the target is also authenticated
+func (chap *ISCSICHAPSecret) Mutual() bool {
+	return chap.MutualUser != ""
+}
+
+// keys of NVMe DH-HMAC-CHAP secrets in StorageClass secrets, named after nvme-cli options
+const (
+	dhchapSecretKey     = "dhchap-secret"
+	dhchapCtrlSecretKey = "dhchap-ctrl-secret"
+)
+
+// NVMeDHCHAPSecret DH-HMAC-CHAP secrets in "DHHC-1:..." format, e.g, generated
+// by "nvme gen-dhchap-key". The host is authenticated by Secret, and the
+// controller is also authenticated by CtrlSecret if it's set (bidirectional).
+type NVMeDHCHAPSecret struct {
+	Secret     string
+	CtrlSecret string
+}
+
+// NewNVMeDHCHAPSecret parses DH-HMAC-CHAP secrets from request secrets, returns
+// nil if DH-HMAC-CHAP is not configured. Secrets are not included in errors.
+func NewNVMeDHCHAPSecret(secrets map[string]string) (*NVMeDHCHAPSecret, error) {
+	dhchap := &NVMeDHCHAPSecret{
+		Secret:     secrets[dhchapSecretKey],
+		CtrlSecret: secrets[dhchapCtrlSecretKey],
+	}
+	if dhchap.Secret == "" && dhchap.CtrlSecret == "" {
+		return nil, nil
+	}
+	if dhchap.Secret == "" {
+		return nil, fmt.Errorf("%s is required by %s", dhchapSecretKey, dhchapCtrlSecretKey)
+	}
+	for key, value := range map[string]string{dhchapSecretKey: dhchap.Secret, dhchapCtrlSecretKey: dhchap.CtrlSecret} {
+		if value != "" && !strings.HasPrefix(value, "DHHC-1:") {
+			return nil, fmt.Errorf("%s is not in DHHC-1 format", key)
+		}
+	}
+	return dhchap, nil
+}
+
+// key of NVMe/TCP TLS pre-shared key in StorageClass secrets
+const tlsKeySecretKey = "tls-key"
+
+// NewNVMeTLSKey parses the NVMe/TCP TLS pre-shared key of the host in interchange
+// format "NVMeTLSkey-1:...", e.g, generated by "nvme gen-tls-key", from request
+// secrets. Returns an empty key if it's not configured, it's not included in errors.
+func NewNVMeTLSKey(secrets map[string]string) (string, error) {
+	key := secrets[tlsKeySecretKey]
+	if key != "" && !strings.HasPrefix(key, "NVMeTLSkey-1:") {
+		return "", fmt.Errorf("%s is not in NVMeTLSkey-1 format", tlsKeySecretKey)
+	}
+	return key, nil
+}
@@ -0,0 +1,82 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"k8s.io/klog"
+)
+
+// files are usually updated by several events in a row, e.g, truncate and write
+const fileWatchDelay = 500 * time.Millisecond
+
+// WatchFile calls onChange in background when the file is created, written,
+// replaced or removed, until the returned stop function is called.
+//
+// The parent directory is watched instead of the file, as kubernetes updates
+// files of ConfigMap and Secret volumes by swapping the "..data" symlink, and
+// editors often replace the file by renaming. The file may not exist yet.
+func WatchFile(fileName string, onChange func()) (stop func(), err error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(fileName)
+	if err = watcher.Add(dir); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("failed to watch %s: %w", dir, err)
+	}
+
+	done := make(chan struct{})
+	go handleFileEvents(watcher, fileName, onChange, done)
+	return func() {
+		close(done)
+		watcher.Close()
+	}, nil
+}
+
+// call onChange once events of the file stop for a while
+func handleFileEvents(watcher *fsnotify.Watcher, fileName string, onChange func(), done <-chan struct{}) {
+	base := filepath.Base(fileName)
+	// armed by events of the file
+	timer := time.AfterFunc(fileWatchDelay, onChange)
+	timer.Stop()
+	defer timer.Stop()
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if name := filepath.Base(event.Name); name != base && name != "..data" {
+				continue
+			}
+			timer.Reset(fileWatchDelay)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			klog.Errorf("error watching %s: %s", fileName, err.Error())
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,73 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchFile(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "config.json")
+	changed := make(chan struct{}, 10)
+	stop, err := WatchFile(fileName, func() { changed <- struct{}{} })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	expectChange := func(what string, expected bool) {
+		t.Helper()
+		select {
+		case <-changed:
+			if !expected {
+				t.Fatalf("%s: unexpected change", what)
+			}
+		case <-time.After(3 * fileWatchDelay):
+			if expected {
+				t.Fatalf("%s: change not detected", what)
+			}
+		}
+	}
+
+	// several writes in a row are reported once
+	for i := 0; i < 3; i++ {
+		if err := os.WriteFile(fileName, []byte("{}"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectChange("create", true)
+	expectChange("create", false)
+
+	// replaced by rename, like editors and kubernetes configmap volumes do
+	tmpName := filepath.Join(dir, "config.json.tmp")
+	if err := os.WriteFile(tmpName, []byte("{}"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmpName, fileName); err != nil {
+		t.Fatal(err)
+	}
+	expectChange("rename", true)
+
+	if err := os.WriteFile(filepath.Join(dir, "other.json"), []byte("{}"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	expectChange("other file", false)
+}
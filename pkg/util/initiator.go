@@ -18,13 +18,16 @@ package util
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
 	"k8s.io/klog"
 )
 
@@ -32,36 +35,117 @@ import (
 //   - Connect initiates target connection and returns local block device filename
 //     e.g., /dev/disk/by-id/nvme-SPDK_Controller1_SPDK00000000000001
 //   - Disconnect terminates target connection
+//   - Rescan refreshes the local block device after the target volume is resized
+//   - Health checks the connection to target is alive, returns error if not
+//   - Methods take the request context for tracing, commands are not cancelled
+//     with the request to avoid leaving half connected devices
 //   - Caller(node service) should serialize calls to same initiator
 //   - Implementation should be idempotent to duplicated requests
 type SpdkCsiInitiator interface {
-	Connect() (string, error)
-	Disconnect() error
+	Connect(ctx context.Context) (string, error)
+	Disconnect(ctx context.Context) error
+	Rescan(ctx context.Context) error
+	Health(ctx context.Context) error
 }
 
-func NewSpdkCsiInitiator(volumeContext map[string]string) (SpdkCsiInitiator, error) {
+// NewSpdkCsiInitiator creates the initiator of volumeContext, secrets are only
+// required by Connect, e.g, iSCSI CHAP credentials
+func NewSpdkCsiInitiator(volumeContext, secrets map[string]string) (SpdkCsiInitiator, error) {
 	targetType := strings.ToLower(volumeContext["targetType"])
 	switch targetType {
 	case "rdma", "tcp":
-		return &initiatorNVMf{
-			// see util/nvmf.go VolumeInfo()
-			targetType: volumeContext["targetType"],
-			targetAddr: volumeContext["targetAddr"],
-			targetPort: volumeContext["targetPort"],
-			nqn:        volumeContext["nqn"],
-			model:      volumeContext["model"],
-		}, nil
+		return newNVMfInitiator(volumeContext, secrets)
 	case "iscsi":
+		chap, err := NewISCSICHAPSecret(secrets)
+		if err != nil {
+			return nil, err
+		}
 		return &initiatorISCSI{
 			targetAddr: volumeContext["targetAddr"],
 			targetPort: volumeContext["targetPort"],
 			iqn:        volumeContext["iqn"],
+			chap:       chap,
 		}, nil
 	default:
 		return nil, fmt.Errorf("unknown initiator: %s", targetType)
 	}
 }
 
+func newNVMfInitiator(volumeContext, secrets map[string]string) (*initiatorNVMf, error) {
+	dhchap, err := NewNVMeDHCHAPSecret(secrets)
+	if err != nil {
+		return nil, err
+	}
+	// set by controller if the volume is published with secure channel
+	opts, err := NewPublishOptions(volumeContext)
+	if err != nil {
+		return nil, err
+	}
+	tlsKey, err := NewNVMeTLSKey(secrets)
+	if err != nil {
+		return nil, err
+	}
+	if !opts.SecureChannel {
+		tlsKey = ""
+	} else if tlsKey == "" {
+		return nil, fmt.Errorf("TLS pre-shared key is required by secure channel")
+	}
+	return &initiatorNVMf{
+		// see util/nvmf.go VolumeInfo()
+		targetType: volumeContext["targetType"],
+		targetAddr: volumeContext["targetAddr"],
+		targetPort: volumeContext["targetPort"],
+		nqn:        volumeContext["nqn"],
+		model:      volumeContext["model"],
+		dhchap:     dhchap,
+		tlsKey:     tlsKey,
+	}, nil
+}
+
+// NVMeHostNQN returns NQN of this host configured for nvme-cli, empty if not found
+func NVMeHostNQN() string {
+	content, err := os.ReadFile(cfgNVMeHostNQNFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			klog.Errorf("failed to read host nqn: %s", err.Error())
+		}
+		return ""
+	}
+	return strings.TrimSpace(string(content))
+}
+
+// nvmeHostID returns host id of this host configured for nvme-cli, empty if not found
+func nvmeHostID() string {
+	content, err := os.ReadFile(cfgNVMeHostIDFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			klog.Errorf("failed to read host id: %s", err.Error())
+		}
+		return ""
+	}
+	return strings.TrimSpace(string(content))
+}
+
+// ISCSIInitiatorName returns initiator name of this host configured for
+// open-iscsi, empty if not found
+func ISCSIInitiatorName() string {
+	content, err := os.ReadFile(cfgISCSIInitiatorNameFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			klog.Errorf("failed to read iscsi initiator name: %s", err.Error())
+		}
+		return ""
+	}
+	// InitiatorName=iqn.2016-04.com.open-iscsi:e5b6c1e3c0a
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "InitiatorName=") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "InitiatorName="))
+		}
+	}
+	return ""
+}
+
 // NVMf initiator implementation
 type initiatorNVMf struct {
 	targetType string
@@ -69,18 +153,32 @@ type initiatorNVMf struct {
 	targetPort string
 	nqn        string
 	model      string
+	dhchap     *NVMeDHCHAPSecret // DH-HMAC-CHAP is not used if nil
+	tlsKey     string            // TLS pre-shared key, TLS is not used if empty
 }
 
-func (nvmf *initiatorNVMf) Connect() (string, error) {
-	// nvme connect -t tcp -a 192.168.1.100 -s 4420 -n "nqn"
-	cmdLine := []string{
-		"nvme", "connect", "-t", strings.ToLower(nvmf.targetType),
-		"-a", nvmf.targetAddr, "-s", nvmf.targetPort, "-n", nvmf.nqn,
+func (nvmf *initiatorNVMf) Connect(ctx context.Context) (string, error) {
+	// the one reported to controller, which is allowed to access the volume
+	hostNQN := NVMeHostNQN()
+	if nvmf.tlsKey != "" && hostNQN == "" {
+		return "", fmt.Errorf("host nqn is required by TLS")
+	}
+	// keys must not be nvme-cli arguments, which are visible to all processes
+	// in /proc/<pid>/cmdline
+	var err error
+	switch {
+	case nvmf.tlsKey != "":
+		// nvme-cli derives the TLS PSK from the configured key and inserts
+		// it to the kernel keyring, where nvme-tcp looks it up on handshake
+		err = nvmf.connectConfig(ctx, hostNQN, nvmeHostID())
+	case nvmf.dhchap != nil:
+		err = connectFabrics(ctx, nvmf.fabricsOptions(hostNQN, nvmeHostID()))
+	default:
+		err = nvmf.connectCli(ctx, hostNQN)
 	}
-	err := execWithTimeout(cmdLine, 40)
 	if err != nil {
 		// go on checking device status in case caused by duplicated request
-		klog.Errorf("command %v failed: %s", cmdLine, err)
+		klog.Errorf("failed to connect %s: %s", nvmf.nqn, err)
 	}
 
 	deviceGlob := fmt.Sprintf("/dev/disk/by-id/*%s*", nvmf.model)
@@ -91,10 +189,148 @@ func (nvmf *initiatorNVMf) Connect() (string, error) {
 	return devicePath, nil
 }
 
-func (nvmf *initiatorNVMf) Disconnect() error {
+func (nvmf *initiatorNVMf) connectCli(ctx context.Context, hostNQN string) error {
+	// nvme connect -t tcp -a 192.168.1.100 -s 4420 -n "nqn"
+	cmdLine := []string{
+		"nvme", "connect", "-t", strings.ToLower(nvmf.targetType),
+		"-a", nvmf.targetAddr, "-s", nvmf.targetPort, "-n", nvmf.nqn,
+	}
+	if hostNQN != "" {
+		cmdLine = append(cmdLine, "--hostnqn", hostNQN)
+	}
+	return execWithTimeout(ctx, cmdLine, 40)
+}
+
+// libnvme json config of a host, see "nvme connect --config"
+type nvmeConfigHost struct {
+	HostNQN    string                `json:"hostnqn"`
+	HostID     string                `json:"hostid,omitempty"`
+	Subsystems []nvmeConfigSubsystem `json:"subsystems"`
+}
+
+type nvmeConfigSubsystem struct {
+	NQN   string           `json:"nqn"`
+	Ports []nvmeConfigPort `json:"ports"`
+}
+
+type nvmeConfigPort struct {
+	Transport     string `json:"transport"`
+	TrAddr        string `json:"traddr"`
+	TrSvcID       string `json:"trsvcid"`
+	TLS           bool   `json:"tls,omitempty"`
+	TLSKey        string `json:"tls_key,omitempty"`
+	DHCHAPKey     string `json:"dhchap_key,omitempty"`
+	DHCHAPCtrlKey string `json:"dhchap_ctrl_key,omitempty"`
+}
+
+// nvmeConfig returns the libnvme json config with keys of the volume, which
+// nvme-cli otherwise takes as arguments
+func (nvmf *initiatorNVMf) nvmeConfig(hostNQN, hostID string) []nvmeConfigHost {
+	port := nvmeConfigPort{
+		Transport: strings.ToLower(nvmf.targetType),
+		TrAddr:    nvmf.targetAddr,
+		TrSvcID:   nvmf.targetPort,
+		TLS:       nvmf.tlsKey != "",
+		TLSKey:    nvmf.tlsKey,
+	}
+	if nvmf.dhchap != nil {
+		port.DHCHAPKey = nvmf.dhchap.Secret
+		port.DHCHAPCtrlKey = nvmf.dhchap.CtrlSecret
+	}
+	return []nvmeConfigHost{{
+		HostNQN:    hostNQN,
+		HostID:     hostID,
+		Subsystems: []nvmeConfigSubsystem{{NQN: nvmf.nqn, Ports: []nvmeConfigPort{port}}},
+	}}
+}
+
+// connectConfig connects by nvme-cli with keys in a json config file, which is
+// only readable by the driver and removed once connected
+func (nvmf *initiatorNVMf) connectConfig(ctx context.Context, hostNQN, hostID string) error {
+	config, err := json.Marshal(nvmf.nvmeConfig(hostNQN, hostID))
+	if err != nil {
+		return err
+	}
+	// created with mode 0600
+	file, err := os.CreateTemp("", "spdkcsi-nvme-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(config)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	// nvme connect --config <file> -t tcp -a 192.168.1.100 -s 4421 -n "nqn" --hostnqn "host nqn" --tls
+	cmdLine := []string{
+		"nvme", "connect", "--config", file.Name(), "-t", strings.ToLower(nvmf.targetType),
+		"-a", nvmf.targetAddr, "-s", nvmf.targetPort, "-n", nvmf.nqn, "--hostnqn", hostNQN, "--tls",
+	}
+	return execWithTimeout(ctx, cmdLine, 40)
+}
+
+// fabricsOptions returns options to create a controller by nvme-fabrics device,
+// as nvme connect does, e.g,
+// "transport=tcp,traddr=192.168.1.100,trsvcid=4420,nqn=<nqn>,dhchap_secret=<secret>"
+func (nvmf *initiatorNVMf) fabricsOptions(hostNQN, hostID string) []string {
+	opts := []string{
+		"transport=" + strings.ToLower(nvmf.targetType),
+		"traddr=" + nvmf.targetAddr,
+		"trsvcid=" + nvmf.targetPort,
+		"nqn=" + nvmf.nqn,
+	}
+	if hostNQN != "" {
+		opts = append(opts, "hostnqn="+hostNQN)
+	}
+	if hostID != "" {
+		opts = append(opts, "hostid="+hostID)
+	}
+	if nvmf.dhchap != nil {
+		opts = append(opts, "dhchap_secret="+nvmf.dhchap.Secret)
+		if nvmf.dhchap.CtrlSecret != "" {
+			opts = append(opts, "dhchap_ctrl_secret="+nvmf.dhchap.CtrlSecret)
+		}
+	}
+	return opts
+}
+
+// connectFabrics writes the options to nvme-fabrics device to create a
+// controller, secrets in options are redacted in logs and spans
+func connectFabrics(ctx context.Context, opts []string) (err error) {
+	logOpts := redactFabricsOptions(opts)
+	_, span := StartSpan(ctx, "nvme-fabrics/connect", attribute.String("nvme.options", strings.Join(logOpts, ",")))
+	defer func() { EndSpan(span, err) }()
+
+	file, err := os.OpenFile(cfgNVMeFabricsDevice, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err = file.WriteString(strings.Join(opts, ",")); err != nil {
+		return fmt.Errorf("failed to connect with options %s: %w", strings.Join(logOpts, ","), err)
+	}
+	klog.V(5).Infof("connected with options %s", strings.Join(logOpts, ","))
+	return nil
+}
+
+func redactFabricsOptions(opts []string) []string {
+	redacted := make([]string, len(opts))
+	for i, opt := range opts {
+		redacted[i] = opt
+		if strings.HasPrefix(opt, "dhchap_secret=") || strings.HasPrefix(opt, "dhchap_ctrl_secret=") {
+			redacted[i] = opt[:strings.Index(opt, "=")+1] + "<redacted>"
+		}
+	}
+	return redacted
+}
+
+func (nvmf *initiatorNVMf) Disconnect(ctx context.Context) error {
 	// nvme disconnect -n "nqn"
 	cmdLine := []string{"nvme", "disconnect", "-n", nvmf.nqn}
-	err := execWithTimeout(cmdLine, 40)
+	err := execWithTimeout(ctx, cmdLine, 40)
 	if err != nil {
 		// go on checking device status in case caused by duplicate request
 		klog.Errorf("command %v failed: %s", cmdLine, err)
@@ -104,23 +340,47 @@ func (nvmf *initiatorNVMf) Disconnect() error {
 	return waitForDeviceGone(deviceGlob)
 }
 
+func (nvmf *initiatorNVMf) Rescan(ctx context.Context) error {
+	deviceGlob := fmt.Sprintf("/dev/disk/by-id/*%s*", nvmf.model)
+	devicePath, err := waitForDeviceReady(deviceGlob, 0)
+	if err != nil {
+		return err
+	}
+	return rescanNvmeDevice(ctx, devicePath)
+}
+
+func (nvmf *initiatorNVMf) Health(_ context.Context) error {
+	deviceGlob := fmt.Sprintf("/dev/disk/by-id/*%s*", nvmf.model)
+	devicePath, err := waitForDeviceReady(deviceGlob, 0)
+	if err != nil {
+		return err
+	}
+	return checkNvmeControllerState(devicePath)
+}
+
 type initiatorISCSI struct {
 	targetAddr string
 	targetPort string
 	iqn        string
+	chap       *ISCSICHAPSecret // CHAP is not used if nil
 }
 
-func (iscsi *initiatorISCSI) Connect() (string, error) {
+func (iscsi *initiatorISCSI) Connect(ctx context.Context) (string, error) {
 	// iscsiadm -m discovery -t sendtargets -p ip:port
 	target := iscsi.targetAddr + ":" + iscsi.targetPort
 	cmdLine := []string{"iscsiadm", "-m", "discovery", "-t", "sendtargets", "-p", target}
-	err := execWithTimeout(cmdLine, 40)
+	err := execWithTimeout(ctx, cmdLine, 40)
 	if err != nil {
 		klog.Errorf("command %v failed: %s", cmdLine, err)
 	}
+	if iscsi.chap != nil {
+		if err = iscsi.setChap(ctx, target); err != nil {
+			return "", err
+		}
+	}
 	// iscsiadm -m node -T "iqn" -p ip:port --login
 	cmdLine = []string{"iscsiadm", "-m", "node", "-T", iscsi.iqn, "-p", target, "--login"}
-	err = execWithTimeout(cmdLine, 40)
+	err = execWithTimeout(ctx, cmdLine, 40)
 	if err != nil {
 		klog.Errorf("command %v failed: %s", cmdLine, err)
 	}
@@ -133,11 +393,96 @@ func (iscsi *initiatorISCSI) Connect() (string, error) {
 	return devicePath, nil
 }
 
-func (iscsi *initiatorISCSI) Disconnect() error {
+// set CHAP credentials of the node record created by discovery, used by login.
+// the record files are updated directly instead of by "iscsiadm -o update" to
+// keep secrets off the command line.
+func (iscsi *initiatorISCSI) setChap(_ context.Context, target string) error {
+	// secret keys are named after the settings
+	settings := [][2]string{
+		{"node.session.auth.authmethod", "CHAP"},
+		{chapUserKey, iscsi.chap.User},
+		{chapSecretKey, iscsi.chap.Secret},
+	}
+	if iscsi.chap.Mutual() {
+		settings = append(settings, [2]string{chapMutualUserKey, iscsi.chap.MutualUser},
+			[2]string{chapMutualSecretKey, iscsi.chap.MutualSecret})
+	}
+	records, err := iscsiNodeRecords(cfgISCSINodesDir, iscsi.iqn, iscsi.targetAddr, iscsi.targetPort)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("node record not found: %s %s", target, iscsi.iqn)
+	}
+	for _, record := range records {
+		if err := updateISCSINodeRecord(record, settings); err != nil {
+			return fmt.Errorf("failed to set CHAP in node record %s: %w", record, err)
+		}
+	}
+	return nil
+}
+
+// node record files of the target portal, one per iface, laid out by
+// open-iscsi as nodes/<iqn>/<addr>,<port>,<tpgt>/<iface>, or as the
+// nodes/<iqn>/<addr>,<port>,<tpgt> file by old versions
+func iscsiNodeRecords(nodesDir, iqn, addr, port string) ([]string, error) {
+	portals, err := filepath.Glob(filepath.Join(nodesDir, iqn, strings.Trim(addr, "[]")+","+port+",*"))
+	if err != nil {
+		return nil, err
+	}
+	var records []string
+	for _, portal := range portals {
+		info, err := os.Stat(portal)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			records = append(records, portal)
+			continue
+		}
+		ifaces, err := filepath.Glob(filepath.Join(portal, "*"))
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, ifaces...)
+	}
+	return records, nil
+}
+
+// replace "name = value" settings of the node record file, settings not in
+// the record are added before the "# END RECORD" line
+func updateISCSINodeRecord(record string, settings [][2]string) error {
+	data, err := os.ReadFile(record)
+	if err != nil {
+		return err
+	}
+	names := make(map[string]bool, len(settings))
+	for _, setting := range settings {
+		names[setting[0]] = true
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	updated := make([]string, 0, len(lines)+len(settings))
+	for _, line := range lines {
+		name, _, _ := strings.Cut(line, "=")
+		if !names[strings.TrimSpace(name)] && line != "# END RECORD" {
+			updated = append(updated, line)
+		}
+	}
+	for _, setting := range settings {
+		updated = append(updated, setting[0]+" = "+setting[1])
+	}
+	if len(lines) > 0 && lines[len(lines)-1] == "# END RECORD" {
+		updated = append(updated, "# END RECORD")
+	}
+	// record files are private to root, as created by iscsiadm
+	return os.WriteFile(record, []byte(strings.Join(updated, "\n")+"\n"), 0o600)
+}
+
+func (iscsi *initiatorISCSI) Disconnect(ctx context.Context) error {
 	target := iscsi.targetAddr + ":" + iscsi.targetPort
 	// iscsiadm -m node -T "iqn" -p ip:port --logout
 	cmdLine := []string{"iscsiadm", "-m", "node", "-T", iscsi.iqn, "-p", target, "--logout"}
-	err := execWithTimeout(cmdLine, 40)
+	err := execWithTimeout(ctx, cmdLine, 40)
 	if err != nil {
 		klog.Errorf("command %v failed: %s", cmdLine, err)
 	}
@@ -146,6 +491,71 @@ func (iscsi *initiatorISCSI) Disconnect() error {
 	return waitForDeviceGone(deviceGlob)
 }
 
+func (iscsi *initiatorISCSI) Rescan(ctx context.Context) error {
+	target := iscsi.targetAddr + ":" + iscsi.targetPort
+	// iscsiadm -m node -T "iqn" -p ip:port --rescan
+	cmdLine := []string{"iscsiadm", "-m", "node", "-T", iscsi.iqn, "-p", target, "--rescan"}
+	return execWithTimeout(ctx, cmdLine, 40)
+}
+
+func (iscsi *initiatorISCSI) Health(ctx context.Context) error {
+	deviceGlob := fmt.Sprintf("/dev/disk/by-path/*%s*", iscsi.iqn)
+	if _, err := waitForDeviceReady(deviceGlob, 0); err != nil {
+		return err
+	}
+	// iscsiadm -m session
+	// tcp: [1] 127.0.0.1:3260,1 iqn.2016-06.io.spdk:xxx (non-flash)
+	cmdLine := []string{"iscsiadm", "-m", "session"}
+	output, err := execOutputWithTimeout(ctx, cmdLine, 40)
+	if err != nil {
+		return fmt.Errorf("failed to list iscsi sessions: %w", err)
+	}
+	target := iscsi.targetAddr + ":" + iscsi.targetPort
+	for _, line := range strings.Split(string(output), "\n") {
+		if strings.Contains(line, target) && strings.Contains(line, iscsi.iqn) {
+			return nil
+		}
+	}
+	return fmt.Errorf("iscsi session not found: %s %s", target, iscsi.iqn)
+}
+
+// check state of the nvme controller which the given block device belongs to,
+// the state is "live" if connected, or "connecting", "resetting", "dead" on failures
+func checkNvmeControllerState(devicePath string) error {
+	realPath, err := filepath.EvalSymlinks(devicePath)
+	if err != nil {
+		return err
+	}
+	matches := nvmeReNamespace.FindStringSubmatch(filepath.Base(realPath))
+	if matches == nil {
+		return fmt.Errorf("not a nvme namespace device: %s", realPath)
+	}
+	state, err := os.ReadFile(fmt.Sprintf("/sys/class/nvme/nvme%s/state", matches[1]))
+	if err != nil {
+		return err
+	}
+	if s := strings.TrimSpace(string(state)); s != "live" {
+		return fmt.Errorf("nvme controller nvme%s is %s", matches[1], s)
+	}
+	return nil
+}
+
+// rescan namespaces of the nvme controller which the given block device belongs to
+func rescanNvmeDevice(ctx context.Context, devicePath string) error {
+	realPath, err := filepath.EvalSymlinks(devicePath)
+	if err != nil {
+		return err
+	}
+	// nvme0n1 -> /dev/nvme0
+	matches := nvmeReNamespace.FindStringSubmatch(filepath.Base(realPath))
+	if matches == nil {
+		return fmt.Errorf("not a nvme namespace device: %s", realPath)
+	}
+	// nvme ns-rescan /dev/nvme0
+	cmdLine := []string{"nvme", "ns-rescan", "/dev/nvme" + matches[1]}
+	return execWithTimeout(ctx, cmdLine, 40)
+}
+
 // when timeout is set as 0, try to find the device file immediately
 // otherwise, wait for device file comes up or timeout
 func waitForDeviceReady(deviceGlob string, seconds int) (string, error) {
@@ -179,20 +589,35 @@ func waitForDeviceGone(deviceGlob string) error {
 }
 
 // exec shell command with timeout(in seconds)
-func execWithTimeout(cmdLine []string, timeout int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+func execWithTimeout(ctx context.Context, cmdLine []string, timeout int) error {
+	_, err := execOutputWithTimeout(ctx, cmdLine, timeout)
+	return err
+}
+
+// exec shell command with timeout(in seconds), returns combined stdout and stderr.
+// ctx is only used for tracing, the command is not killed if ctx is cancelled.
+func execOutputWithTimeout(ctx context.Context, cmdLine []string, timeout int) (output []byte, err error) {
+	return execOutput(ctx, cmdLine, cmdLine, timeout)
+}
+
+// logCmdLine is cmdLine to be logged and traced
+func execOutput(ctx context.Context, cmdLine, logCmdLine []string, timeout int) (output []byte, err error) {
+	_, span := StartSpan(ctx, "exec/"+cmdLine[0], attribute.String("exec.command", strings.Join(logCmdLine, " ")))
+	defer func() { EndSpan(span, err) }()
+
+	ctxTimeout, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
 	defer cancel()
 
-	klog.Infof("running command: %v", cmdLine)
-	//nolint:gosec // execWithTimeout assumes valid cmd arguments
-	cmd := exec.CommandContext(ctx, cmdLine[0], cmdLine[1:]...)
-	output, err := cmd.CombinedOutput()
+	klog.Infof("running command: %v", logCmdLine)
+	//nolint:gosec // execOutput assumes valid cmd arguments
+	cmd := exec.CommandContext(ctxTimeout, cmdLine[0], cmdLine[1:]...)
+	output, err = cmd.CombinedOutput()
 
-	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
-		return fmt.Errorf("timed out")
+	if errors.Is(ctxTimeout.Err(), context.DeadlineExceeded) {
+		return nil, fmt.Errorf("timed out")
 	}
 	if output != nil {
 		klog.Infof("command returned: %s", output)
 	}
-	return err
+	return output, err
 }
@@ -18,6 +18,11 @@ limitations under the License.
 package util
 
 import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -52,9 +57,94 @@ func TestExecWithTimeoutTimeout(t *testing.T) {
 	}
 }
 
+func TestISCSINodeRecord(t *testing.T) {
+	nodesDir := t.TempDir()
+	iqn := "iqn.2016-06.io.spdk:lvol"
+	portal := filepath.Join(nodesDir, iqn, "192.168.1.100,3260,1")
+	if err := os.MkdirAll(portal, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	record := filepath.Join(portal, "default")
+	content := "# BEGIN RECORD 2.1.8\nnode.name = " + iqn + "\nnode.session.auth.authmethod = None\n# END RECORD\n"
+	if err := os.WriteFile(record, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// other portal of the same target
+	if err := os.MkdirAll(filepath.Join(nodesDir, iqn, "192.168.1.101,3260,1"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := iscsiNodeRecords(nodesDir, iqn, "192.168.1.100", "3260")
+	if err != nil || len(records) != 1 || records[0] != record {
+		t.Fatalf("unexpected records: %v, %v", records, err)
+	}
+	settings := [][2]string{{"node.session.auth.authmethod", "CHAP"}, {chapSecretKey, "secret"}}
+	if err = updateISCSINodeRecord(record, settings); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "# BEGIN RECORD 2.1.8\nnode.name = " + iqn + "\nnode.session.auth.authmethod = CHAP\n" +
+		"node.session.auth.password = secret\n# END RECORD\n"
+	if string(data) != expected {
+		t.Fatalf("unexpected record:\n%s", data)
+	}
+}
+
+func TestNVMfFabricsOptions(t *testing.T) {
+	nvmf := &initiatorNVMf{
+		targetType: "TCP",
+		targetAddr: "192.168.1.100",
+		targetPort: "4420",
+		nqn:        "nqn.2020-04.io.spdk.csi:uuid:lvol",
+		dhchap:     &NVMeDHCHAPSecret{Secret: "host-secret", CtrlSecret: "ctrl-secret"},
+	}
+	expected := "transport=tcp,traddr=192.168.1.100,trsvcid=4420,nqn=nqn.2020-04.io.spdk.csi:uuid:lvol," +
+		"hostnqn=nqn.2014-08.org.nvmexpress:uuid:host,hostid=host," +
+		"dhchap_secret=host-secret,dhchap_ctrl_secret=ctrl-secret"
+	opts := nvmf.fabricsOptions("nqn.2014-08.org.nvmexpress:uuid:host", "host")
+	if strings.Join(opts, ",") != expected {
+		t.Fatalf("unexpected options: %v", opts)
+	}
+
+	redacted := strings.Join(redactFabricsOptions(opts), ",")
+	if strings.Contains(redacted, "secret=host-secret") || strings.Contains(redacted, "ctrl-secret") ||
+		!strings.Contains(redacted, "dhchap_secret=<redacted>") {
+		t.Fatalf("secrets not redacted: %s", redacted)
+	}
+
+	nvmf.dhchap.CtrlSecret = ""
+	opts = nvmf.fabricsOptions("", "")
+	if strings.Join(opts[4:], ",") != "dhchap_secret=host-secret" {
+		t.Fatalf("unexpected options: %v", opts)
+	}
+}
+
+func TestNVMfConfig(t *testing.T) {
+	nvmf := &initiatorNVMf{
+		targetType: "TCP",
+		targetAddr: "192.168.1.100",
+		targetPort: "4421",
+		nqn:        "nqn.2020-04.io.spdk.csi:uuid:lvol",
+		dhchap:     &NVMeDHCHAPSecret{Secret: "host-secret"},
+		tlsKey:     "tls-key",
+	}
+	config, err := json.Marshal(nvmf.nvmeConfig("nqn.2014-08.org.nvmexpress:uuid:host", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `[{"hostnqn":"nqn.2014-08.org.nvmexpress:uuid:host","subsystems":[{"nqn":"nqn.2020-04.io.spdk.csi:uuid:lvol",` +
+		`"ports":[{"transport":"tcp","traddr":"192.168.1.100","trsvcid":"4421","tls":true,"tls_key":"tls-key","dhchap_key":"host-secret"}]}]}]`
+	if string(config) != expected {
+		t.Fatalf("unexpected config: %s", config)
+	}
+}
+
 func runExecWithTimeout(cmdLine []string, timeout int) (int, error) {
 	start := time.Now()
-	err := execWithTimeout(cmdLine, timeout)
+	err := execWithTimeout(context.TODO(), cmdLine, timeout)
 	elapsed := int(time.Since(start) / time.Second)
 	return elapsed, err
 }
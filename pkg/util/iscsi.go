@@ -16,15 +16,21 @@ limitations under the License.
 package util
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"time"
 
 	"k8s.io/klog"
 )
 
 const (
-	numberPortalGroupTag    = 1
+	numberPortalGroupTag = 1
+	// initiator group allowing any initiator, per host groups have larger tags
 	numberInitiatorGroupTag = 1
 	targetQueueDepth        = 64
+	// max attempts to create an initiator or auth group with a free tag
+	groupCreateRetries = 3
 	// SPDK ISCSI Iqn fixed prefix
 	iqnPrefixName = "iqn.2016-06.io.spdk:"
 )
@@ -47,14 +53,14 @@ func (node *nodeISCSI) Info() string {
 	return node.client.info()
 }
 
-func (node *nodeISCSI) LvStores() ([]LvStore, error) {
-	return node.client.lvStores()
+func (node *nodeISCSI) LvStores(ctx context.Context) ([]LvStore, error) {
+	return node.client.lvStores(ctx)
 }
 
 // VolumeInfo returns a string:string map containing information necessary
 // for CSI node(initiator) to connect to this target and identify the disk.
-func (node *nodeISCSI) VolumeInfo(lvolID string) (map[string]string, error) {
-	exists, err := node.isVolumeCreated(lvolID)
+func (node *nodeISCSI) VolumeInfo(ctx context.Context, lvolID string) (map[string]string, error) {
+	exists, err := node.isVolumeCreated(ctx, lvolID)
 	if err != nil {
 		return nil, err
 	}
@@ -62,7 +68,7 @@ func (node *nodeISCSI) VolumeInfo(lvolID string) (map[string]string, error) {
 	if !exists {
 		return nil, fmt.Errorf("volume not exists: %s", lvolID)
 	}
-	lvStore, err := node.client.getLvstore(lvolID)
+	lvStore, err := node.client.getLvstore(ctx, lvolID)
 	if err != nil {
 		return nil, err
 	}
@@ -77,14 +83,14 @@ func (node *nodeISCSI) VolumeInfo(lvolID string) (map[string]string, error) {
 }
 
 // CreateVolume creates a logical volume and returns volume ID
-func (node *nodeISCSI) CreateVolume(lvolName, lvsName string, sizeMiB int64) (string, error) {
+func (node *nodeISCSI) CreateVolume(ctx context.Context, lvolName, lvsName string, sizeMiB int64, opts *LvolOptions) (string, error) {
 	// all volume have an alias ID named lvsName/lvolName
-	lvol, err := node.client.getVolume(fmt.Sprintf("%s/%s", lvsName, lvolName))
+	lvol, err := node.client.getVolume(ctx, fmt.Sprintf("%s/%s", lvsName, lvolName))
 	if err == nil {
 		klog.Warningf("volume already created: %s", lvol.UUID)
 		return lvol.UUID, nil
 	}
-	lvolID, err := node.client.createVolume(lvolName, lvsName, sizeMiB)
+	lvolID, err := node.client.createVolume(ctx, lvolName, lvsName, sizeMiB, opts)
 	if err != nil {
 		return "", err
 	}
@@ -93,16 +99,22 @@ func (node *nodeISCSI) CreateVolume(lvolName, lvsName string, sizeMiB int64) (st
 }
 
 // CloneVolume creates a logical volume based on the source volume and returns volume ID
-func (node *nodeISCSI) CloneVolume(lvolName, lvsName, sourceLvolID string) (string, error) {
+func (node *nodeISCSI) CloneVolume(ctx context.Context, lvolName, lvsName, sourceLvolID string) (string, error) {
 	// all volume have an alias ID named lvsName/lvolName
-	lvol, err := node.client.getVolume(fmt.Sprintf("%s/%s", lvsName, lvolName))
+	lvol, err := node.client.getVolume(ctx, fmt.Sprintf("%s/%s", lvsName, lvolName))
 	if err == nil {
 		klog.Warningf("volume already cloned: %s/%s %s", lvsName, lvolName, lvol.UUID)
 		return lvol.UUID, nil
 	}
-	var lvolID string
-	// clone sourceLvol
-	lvolID, err = node.client.cloneVolume(lvolName, sourceLvolID)
+	snapshotID, err := node.client.cloneSource(ctx, lvolName, lvsName, sourceLvolID)
+	if err != nil {
+		return "", err
+	}
+	lvolID, err := node.client.cloneVolume(ctx, lvolName, snapshotID)
+	if err != nil && snapshotID != sourceLvolID {
+		// don't leave an unused hidden snapshot behind
+		node.client.deleteHiddenSnapshot(ctx, fmt.Sprintf("%s/%s", lvsName, cloneSnapshotPrefix+lvolName))
+	}
 
 	if err != nil {
 		return "", err
@@ -112,29 +124,29 @@ func (node *nodeISCSI) CloneVolume(lvolName, lvsName, sourceLvolID string) (stri
 }
 
 // GetVolume returns the volume id of the given volume name and lvstore name. return error if not found.
-func (node *nodeISCSI) GetVolume(lvolName, lvsName string) (string, error) {
-	lvol, err := node.client.getVolume(fmt.Sprintf("%s/%s", lvsName, lvolName))
+func (node *nodeISCSI) GetVolume(ctx context.Context, lvolName, lvsName string) (string, error) {
+	lvol, err := node.client.getVolume(ctx, fmt.Sprintf("%s/%s", lvsName, lvolName))
 	if err != nil {
 		return "", err
 	}
 	return lvol.UUID, err
 }
 
-func (node *nodeISCSI) isVolumeCreated(lvolID string) (bool, error) {
-	return node.client.isVolumeCreated(lvolID)
+func (node *nodeISCSI) isVolumeCreated(ctx context.Context, lvolID string) (bool, error) {
+	return node.client.isVolumeCreated(ctx, lvolID)
 }
 
-func (node *nodeISCSI) CreateSnapshot(lvolName, snapshotName string) (string, error) {
-	lvsName, err := node.client.getLvstore(lvolName)
+func (node *nodeISCSI) CreateSnapshot(ctx context.Context, lvolName, snapshotName string) (string, error) {
+	lvsName, err := node.client.getLvstore(ctx, lvolName)
 	if err != nil {
 		return "", err
 	}
-	lvol, err := node.client.getVolume(fmt.Sprintf("%s/%s", lvsName, snapshotName))
+	snapshotID, err := node.client.getSnapshot(ctx, lvsName, snapshotName)
 	if err == nil {
-		klog.Warningf("snapshot already created: %s", lvol.UUID)
-		return lvol.UUID, nil
+		klog.Warningf("snapshot already created: %s", snapshotID)
+		return snapshotID, nil
 	}
-	snapshotID, err := node.client.snapshot(lvolName, snapshotName)
+	snapshotID, err = node.client.snapshot(ctx, lvolName, snapshotLvolName(snapshotName, time.Now()))
 	if err != nil {
 		return "", err
 	}
@@ -143,26 +155,61 @@ func (node *nodeISCSI) CreateSnapshot(lvolName, snapshotName string) (string, er
 	return snapshotID, nil
 }
 
-func (node *nodeISCSI) DeleteVolume(lvolID string) error {
-	err := node.client.deleteVolume(lvolID)
+func (node *nodeISCSI) DeleteVolume(ctx context.Context, lvolID string) error {
+	hiddenSnapshot := node.client.hiddenBaseSnapshot(ctx, lvolID)
+	err := node.client.deleteVolume(ctx, lvolID)
 	if err != nil {
 		return err
 	}
+	node.client.deleteHiddenSnapshot(ctx, hiddenSnapshot)
 
 	klog.V(5).Infof("volume deleted: %s", lvolID)
 	return nil
 }
 
-// PublishVolume exports a volume through ISCSI target
-func (node *nodeISCSI) PublishVolume(lvolID string) error {
-	exists, err := node.isVolumeCreated(lvolID)
+// InflateVolume allocates all clusters of a cloned volume and detaches it from the snapshot
+func (node *nodeISCSI) InflateVolume(ctx context.Context, lvolID string) error {
+	hiddenSnapshot := node.client.hiddenBaseSnapshot(ctx, lvolID)
+	err := node.client.inflateVolume(ctx, lvolID)
+	if err != nil {
+		return err
+	}
+	node.client.deleteHiddenSnapshot(ctx, hiddenSnapshot)
+	klog.V(5).Infof("volume inflated: %s", lvolID)
+	return nil
+}
+
+// ResizeVolume grows a logical volume, it's a no-op if the volume is already big enough
+func (node *nodeISCSI) ResizeVolume(ctx context.Context, lvolID string, newSizeMiB int64) error {
+	lvol, err := node.client.getVolume(ctx, lvolID)
+	if err != nil {
+		return err
+	}
+	if lvol.BlockSize*lvol.NumBlocks >= newSizeMiB*1024*1024 {
+		klog.Warningf("volume already resized: %s", lvolID)
+		return nil
+	}
+	err = node.client.resizeVolume(ctx, lvolID, newSizeMiB)
+	if err != nil {
+		return err
+	}
+	klog.V(5).Infof("volume resized: %s, size: %d MiB", lvolID, newSizeMiB)
+	return nil
+}
+
+// PublishVolume exports a volume through ISCSI target, secure channel is not supported
+func (node *nodeISCSI) PublishVolume(ctx context.Context, lvolID string, opts *PublishOptions) error {
+	if opts != nil && opts.SecureChannel {
+		return fmt.Errorf("secure channel is not supported by iSCSI target")
+	}
+	exists, err := node.isVolumeCreated(ctx, lvolID)
 	if err != nil {
 		return err
 	}
 	if !exists {
 		return ErrVolumeDeleted
 	}
-	published, err := node.isVolumePublished(lvolID)
+	published, err := node.isVolumePublished(ctx, lvolID)
 	if err != nil {
 		return err
 	}
@@ -170,18 +217,18 @@ func (node *nodeISCSI) PublishVolume(lvolID string) error {
 		return nil
 	}
 
-	err = node.createPortalGroup()
+	err = node.createPortalGroup(ctx)
 	if err != nil {
 		return err
 	}
 
-	err = node.createInitiatorGroup()
+	err = node.createInitiatorGroup(ctx)
 	if err != nil {
 		return err
 	}
 	// lvolID is unique and can be used as the target name
 	targetName := lvolID
-	err = node.iscsiCreateTargetNode(targetName, lvolID)
+	err = node.iscsiCreateTargetNode(ctx, targetName, lvolID)
 	if err != nil {
 		return err
 	}
@@ -189,14 +236,400 @@ func (node *nodeISCSI) PublishVolume(lvolID string) error {
 	return nil
 }
 
-func (node *nodeISCSI) isVolumePublished(lvolID string) (bool, error) {
+// ListVolumes returns all logical volumes and whether they are exported through iSCSI target
+func (node *nodeISCSI) ListVolumes(ctx context.Context) ([]Lvol, error) {
+	lvols, err := node.client.listVolumes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []struct {
+		AliasName string `json:"alias_name"`
+	}
+	err = node.client.call(ctx, "iscsi_get_target_nodes", nil, &result)
+	if err != nil {
+		return nil, err
+	}
+	targets := make(map[string]bool, len(result))
+	for i := range result {
+		targets[result[i].AliasName] = true
+	}
+	for i := range lvols {
+		lvols[i].Published = targets[lvols[i].UUID]
+	}
+	return lvols, nil
+}
+
+// RemoveUnusedKeys does nothing, keyring keys are only used by NVMf hosts
+func (node *nodeISCSI) RemoveUnusedKeys(_ context.Context, _ string) ([]KeyringKey, error) {
+	return nil, nil
+}
+
+// ListExports returns IDs of lvols in iSCSI target nodes created by the driver
+func (node *nodeISCSI) ListExports(ctx context.Context) ([]string, error) {
+	var result []struct {
+		Name      string `json:"name"`
+		AliasName string `json:"alias_name"`
+	}
+	err := node.client.call(ctx, "iscsi_get_target_nodes", nil, &result)
+	if err != nil {
+		return nil, err
+	}
+	var lvolIDs []string
+	for i := range result {
+		// target name is lvol ID with iqn prefix, see PublishVolume
+		if result[i].Name == iqnPrefixName+result[i].AliasName {
+			lvolIDs = append(lvolIDs, result[i].AliasName)
+		}
+	}
+	return lvolIDs, nil
+}
+
+// DeleteExport deletes the iSCSI target node of a lvol, spdk only reports
+// a false result if the target node does not exist
+func (node *nodeISCSI) DeleteExport(ctx context.Context, lvolID string) error {
+	_, err := node.getTargetNode(ctx, lvolID)
+	if errors.Is(err, ErrVolumeUnpublished) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = node.iscsiDeleteTargetNode(ctx, lvolID)
+	if err != nil {
+		return err
+	}
+	klog.V(5).Infof("export deleted: %s", iqnPrefixName+lvolID)
+	return nil
+}
+
+// AllowHost maps the initiator group of the host to the iSCSI target node of
+// the volume, and stops allowing any initiator, e.g, target nodes created by
+// old versions of the driver. CHAP is required if the host has credentials.
+// CHAP is set per target node, ErrCHAPConflict is returned if other hosts of
+// the volume use different credentials.
+func (node *nodeISCSI) AllowHost(ctx context.Context, lvolID string, host *HostAccess) error {
+	if host.iqn() == "" {
+		return ErrHostUnknown
+	}
+	target, err := node.getTargetNode(ctx, lvolID)
+	if err != nil {
+		return err
+	}
+	igTag, err := node.hostInitiatorGroup(ctx, host.iqn())
+	if err != nil {
+		return err
+	}
+	if err = node.checkChap(ctx, target, igTag, host.chap()); err != nil {
+		return err
+	}
+	err = node.allowInitiatorGroup(ctx, target, igTag)
+	if err != nil {
+		return err
+	}
+	if host.chap() != nil {
+		return node.requireChap(ctx, target, host.chap())
+	}
+	if target.RequireChap {
+		return node.resetChap(ctx, target)
+	}
+	return nil
+}
+
+// DisallowHost unmaps the initiator group of the host from the iSCSI target
+// node of the volume, it's not an error if the volume is not published
+func (node *nodeISCSI) DisallowHost(ctx context.Context, lvolID string, host *HostAccess) error {
+	target, err := node.getTargetNode(ctx, lvolID)
+	if errors.Is(err, ErrVolumeUnpublished) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	igTag := 0 // all groups
+	if iqn := host.iqn(); iqn != "" {
+		igTag, _, err = node.findInitiatorGroup(ctx, iqn)
+		if err != nil || igTag == 0 {
+			return err
+		}
+	}
+	maps := target.initiatorGroupMaps(igTag)
+	if len(maps) == 0 {
+		return nil
+	}
+	err = node.iscsiTargetNodePgIgMaps(ctx, "iscsi_target_node_remove_pg_ig_maps", target.Name, maps)
+	if err != nil {
+		return err
+	}
+	klog.V(5).Infof("initiator groups %v disallowed to access volume %s", maps, lvolID)
+	// credentials of the last host are not required by hosts allowed later
+	if len(maps) == len(target.PgIgMaps) && target.RequireChap {
+		return node.resetChap(ctx, target)
+	}
+	return nil
+}
+
+// map the initiator group to the target node, and unmap the group allowing
+// any initiator if it's a per host group
+func (node *nodeISCSI) allowInitiatorGroup(ctx context.Context, target *iscsiTargetNode, igTag int) error {
+	if !target.hasInitiatorGroup(igTag) {
+		maps := []iscsiPgIgMap{{PgTag: numberPortalGroupTag, IgTag: igTag}}
+		err := node.iscsiTargetNodePgIgMaps(ctx, "iscsi_target_node_add_pg_ig_maps", target.Name, maps)
+		if err != nil {
+			return err
+		}
+		klog.V(5).Infof("initiator group %d allowed to access volume %s", igTag, target.AliasName)
+	}
+	if igTag != numberInitiatorGroupTag && target.hasInitiatorGroup(numberInitiatorGroupTag) {
+		maps := []iscsiPgIgMap{{PgTag: numberPortalGroupTag, IgTag: numberInitiatorGroupTag}}
+		return node.iscsiTargetNodePgIgMaps(ctx, "iscsi_target_node_remove_pg_ig_maps", target.Name, maps)
+	}
+	return nil
+}
+
+// hostInitiatorGroup returns tag of the initiator group only allowing the
+// initiator, the group is created if not found and shared by all volumes
+func (node *nodeISCSI) hostInitiatorGroup(ctx context.Context, iqn string) (int, error) {
+	return findOrCreateGroup(
+		func() (int, int, error) { return node.findInitiatorGroup(ctx, iqn) },
+		func(tag int) error { return node.iscsiCreateInitiatorGroup(ctx, tag, []string{iqn}, []string{"ANY"}) },
+	)
+}
+
+// findInitiatorGroup returns tag of the initiator group only allowing the
+// initiator or 0 if not found, and the max tag of all groups
+func (node *nodeISCSI) findInitiatorGroup(ctx context.Context, iqn string) (tag, maxTag int, err error) {
+	var results []struct {
+		Tag        int      `json:"tag"`
+		Initiators []string `json:"initiators"`
+		Netmasks   []string `json:"netmasks"`
+	}
+	err = node.client.call(ctx, "iscsi_get_initiator_groups", nil, &results)
+	if err != nil {
+		return 0, 0, err
+	}
+	maxTag = numberInitiatorGroupTag
+	for i := range results {
+		group := &results[i]
+		if len(group.Initiators) == 1 && group.Initiators[0] == iqn &&
+			len(group.Netmasks) == 1 && group.Netmasks[0] == "ANY" {
+			tag = group.Tag
+		}
+		if group.Tag > maxTag {
+			maxTag = group.Tag
+		}
+	}
+	return tag, maxTag, nil
+}
+
+// requireChap sets CHAP authentication of the target node, the auth group of
+// the credentials is created if not found and shared by all volumes
+func (node *nodeISCSI) requireChap(ctx context.Context, target *iscsiTargetNode, chap *ISCSICHAPSecret) error {
+	chapGroup, err := findOrCreateGroup(
+		func() (int, int, error) { return node.findAuthGroup(ctx, chap) },
+		func(tag int) error { return node.iscsiCreateAuthGroup(ctx, tag, chap) },
+	)
+	if err != nil {
+		return err
+	}
+	if target.RequireChap && target.MutualChap == chap.Mutual() && target.ChapGroup == chapGroup {
+		return nil
+	}
+	params := struct {
+		Name        string `json:"name"`
+		ChapGroup   int    `json:"chap_group"`
+		DisableChap bool   `json:"disable_chap"`
+		RequireChap bool   `json:"require_chap"`
+		MutualChap  bool   `json:"mutual_chap"`
+	}{
+		Name:        target.Name,
+		ChapGroup:   chapGroup,
+		RequireChap: true,
+		MutualChap:  chap.Mutual(),
+	}
+	var result bool
+	err = node.client.call(ctx, "iscsi_target_node_set_auth", &params, &result)
+	if err != nil {
+		return err
+	}
+	if !result {
+		return fmt.Errorf("set iscsi target node auth failure")
+	}
+	klog.V(5).Infof("CHAP required by volume %s, mutual: %v", target.AliasName, chap.Mutual())
+	return nil
+}
+
+// checkChap returns ErrCHAPConflict if other hosts than the initiator group
+// are allowed to access the target node with different CHAP settings
+func (node *nodeISCSI) checkChap(ctx context.Context, target *iscsiTargetNode, igTag int, chap *ISCSICHAPSecret) error {
+	if !target.hasOtherInitiatorGroups(igTag) {
+		return nil
+	}
+	if chap == nil {
+		if target.RequireChap {
+			return ErrCHAPConflict
+		}
+		return nil
+	}
+	if !target.RequireChap || target.MutualChap != chap.Mutual() {
+		return ErrCHAPConflict
+	}
+	chapGroup, _, err := node.findAuthGroup(ctx, chap)
+	if err != nil {
+		return err
+	}
+	if chapGroup != target.ChapGroup {
+		return ErrCHAPConflict
+	}
+	return nil
+}
+
+// resetChap stops requiring CHAP authentication of the target node
+func (node *nodeISCSI) resetChap(ctx context.Context, target *iscsiTargetNode) error {
+	params := struct {
+		Name        string `json:"name"`
+		ChapGroup   int    `json:"chap_group"`
+		DisableChap bool   `json:"disable_chap"`
+		RequireChap bool   `json:"require_chap"`
+		MutualChap  bool   `json:"mutual_chap"`
+	}{
+		Name: target.Name,
+	}
+	var result bool
+	err := node.client.call(ctx, "iscsi_target_node_set_auth", &params, &result)
+	if err != nil {
+		return err
+	}
+	if !result {
+		return fmt.Errorf("set iscsi target node auth failure")
+	}
+	klog.V(5).Infof("CHAP not required by volume %s", target.AliasName)
+	return nil
+}
+
+type iscsiChapSecret struct {
+	User    string `json:"user"`
+	Secret  string `json:"secret"`
+	MUser   string `json:"muser,omitempty"`
+	MSecret string `json:"msecret,omitempty"`
+}
+
+// findAuthGroup returns tag of the auth group only containing the credentials
+// or 0 if not found, and the max tag of all groups
+func (node *nodeISCSI) findAuthGroup(ctx context.Context, chap *ISCSICHAPSecret) (tag, maxTag int, err error) {
+	var results []struct {
+		Tag     int               `json:"tag"`
+		Secrets []iscsiChapSecret `json:"secrets"`
+	}
+	err = node.client.call(ctx, "iscsi_get_auth_groups", nil, &results)
+	if err != nil {
+		return 0, 0, err
+	}
+	secret := newISCSIChapSecret(chap)
+	for i := range results {
+		group := &results[i]
+		if len(group.Secrets) == 1 && group.Secrets[0] == secret {
+			tag = group.Tag
+		}
+		if group.Tag > maxTag {
+			maxTag = group.Tag
+		}
+	}
+	return tag, maxTag, nil
+}
+
+func newISCSIChapSecret(chap *ISCSICHAPSecret) iscsiChapSecret {
+	return iscsiChapSecret{User: chap.User, Secret: chap.Secret, MUser: chap.MutualUser, MSecret: chap.MutualSecret}
+}
+
+// findOrCreateGroup returns tag of the group found by find, or creates it with
+// a free tag. Concurrent requests may take the same tag, creation is retried.
+func findOrCreateGroup(find func() (tag, maxTag int, err error), create func(tag int) error) (int, error) {
+	var err error
+	for i := 0; i < groupCreateRetries; i++ {
+		var tag, maxTag int
+		tag, maxTag, err = find()
+		if err != nil || tag != 0 {
+			return tag, err
+		}
+		err = create(maxTag + 1)
+		if err == nil {
+			return maxTag + 1, nil
+		}
+		klog.Warningf("failed to create group %d: %s", maxTag+1, err.Error())
+	}
+	return 0, err
+}
+
+type iscsiPgIgMap struct {
+	PgTag int `json:"pg_tag"`
+	IgTag int `json:"ig_tag"`
+}
+
+type iscsiTargetNode struct {
+	Name        string         `json:"name"`
+	AliasName   string         `json:"alias_name"`
+	PgIgMaps    []iscsiPgIgMap `json:"pg_ig_maps"`
+	RequireChap bool           `json:"require_chap"`
+	MutualChap  bool           `json:"mutual_chap"`
+	ChapGroup   int            `json:"chap_group"`
+}
+
+func (target *iscsiTargetNode) hasInitiatorGroup(igTag int) bool {
+	for _, m := range target.PgIgMaps {
+		if m.PgTag == numberPortalGroupTag && m.IgTag == igTag {
+			return true
+		}
+	}
+	return false
+}
+
+// hasOtherInitiatorGroups returns if initiator groups other than igTag are
+// mapped, the group allowing any initiator is not counted for a per host group
+// as it's unmapped by allowInitiatorGroup
+func (target *iscsiTargetNode) hasOtherInitiatorGroups(igTag int) bool {
+	for _, m := range target.PgIgMaps {
+		if m.IgTag != igTag && m.IgTag != numberInitiatorGroupTag {
+			return true
+		}
+	}
+	return false
+}
+
+// maps of the initiator group, or all maps if igTag is 0
+func (target *iscsiTargetNode) initiatorGroupMaps(igTag int) []iscsiPgIgMap {
+	var maps []iscsiPgIgMap
+	for _, m := range target.PgIgMaps {
+		if igTag == 0 || m.IgTag == igTag {
+			maps = append(maps, m)
+		}
+	}
+	return maps
+}
+
+// getTargetNode returns ErrVolumeUnpublished if the volume has no target node
+func (node *nodeISCSI) getTargetNode(ctx context.Context, lvolID string) (*iscsiTargetNode, error) {
+	var result []iscsiTargetNode
+	err := node.client.call(ctx, "iscsi_get_target_nodes", nil, &result)
+	if err != nil {
+		return nil, err
+	}
+	for i := range result {
+		if result[i].AliasName == lvolID {
+			return &result[i], nil
+		}
+	}
+	return nil, ErrVolumeUnpublished
+}
+
+func (node *nodeISCSI) isVolumePublished(ctx context.Context, lvolID string) (bool, error) {
 	var result []struct {
 		Name      string `json:"name"`
 		AliasName string `json:"alias_name"`
 	}
 	// TODO: newer version of SPDK supports passing an alias_name parameter for filtering.
 	//       better to add name parameter after the CI's SPDK is upgraded.
-	err := node.client.call("iscsi_get_target_nodes", nil, &result)
+	err := node.client.call(ctx, "iscsi_get_target_nodes", nil, &result)
 	if err != nil {
 		return false, err
 	}
@@ -208,43 +641,43 @@ func (node *nodeISCSI) isVolumePublished(lvolID string) (bool, error) {
 	return false, nil
 }
 
-func (node *nodeISCSI) createPortalGroup() error {
-	err := node.iscsiGetPortalGroups()
+func (node *nodeISCSI) createPortalGroup(ctx context.Context) error {
+	err := node.iscsiGetPortalGroups(ctx)
 	if err == nil {
 		return nil // port group already exists
 	}
 
-	err = node.iscsiCreatePortalGroup()
+	err = node.iscsiCreatePortalGroup(ctx)
 	if err == nil {
 		return nil // creation succeeds
 	}
 	// we may fail due to concurrent calls, check portal group availability again
-	return node.iscsiGetPortalGroups()
+	return node.iscsiGetPortalGroups(ctx)
 }
 
-func (node *nodeISCSI) createInitiatorGroup() error {
-	err := node.iscsiGetInitiatorGroups()
+func (node *nodeISCSI) createInitiatorGroup(ctx context.Context) error {
+	err := node.iscsiGetInitiatorGroups(ctx)
 	if err == nil {
 		return nil
 	}
 
-	err = node.iscsiCreateInitiatorGroup([]string{"ANY"}, []string{"ANY"})
+	err = node.iscsiCreateInitiatorGroup(ctx, numberInitiatorGroupTag, []string{"ANY"}, []string{"ANY"})
 	if err == nil {
 		return nil
 	}
 
-	return node.iscsiGetInitiatorGroups()
+	return node.iscsiGetInitiatorGroups(ctx)
 }
 
-func (node *nodeISCSI) UnpublishVolume(lvolID string) error {
-	exists, err := node.isVolumeCreated(lvolID)
+func (node *nodeISCSI) UnpublishVolume(ctx context.Context, lvolID string) error {
+	exists, err := node.isVolumeCreated(ctx, lvolID)
 	if err != nil {
 		return err
 	}
 	if !exists {
 		return ErrVolumeDeleted
 	}
-	published, err := node.isVolumePublished(lvolID)
+	published, err := node.isVolumePublished(ctx, lvolID)
 	if err != nil {
 		return err
 	}
@@ -253,7 +686,7 @@ func (node *nodeISCSI) UnpublishVolume(lvolID string) error {
 		return nil
 	}
 
-	err = node.iscsiDeleteTargetNode(lvolID)
+	err = node.iscsiDeleteTargetNode(ctx, lvolID)
 	if err != nil {
 		return err
 	}
@@ -263,7 +696,7 @@ func (node *nodeISCSI) UnpublishVolume(lvolID string) error {
 }
 
 // Add a portal group
-func (node *nodeISCSI) iscsiCreatePortalGroup() error {
+func (node *nodeISCSI) iscsiCreatePortalGroup(ctx context.Context) error {
 	type Portals struct {
 		Host string `json:"host"`
 		Port string `json:"port"`
@@ -276,7 +709,7 @@ func (node *nodeISCSI) iscsiCreatePortalGroup() error {
 		Tag:     numberPortalGroupTag,
 	}
 	var result bool
-	err := node.client.call("iscsi_create_portal_group", &params, &result)
+	err := node.client.call(ctx, "iscsi_create_portal_group", &params, &result)
 	if err != nil {
 		return err
 	}
@@ -287,18 +720,18 @@ func (node *nodeISCSI) iscsiCreatePortalGroup() error {
 }
 
 // Add an initiator group
-func (node *nodeISCSI) iscsiCreateInitiatorGroup(initiators, netmasks []string) error {
+func (node *nodeISCSI) iscsiCreateInitiatorGroup(ctx context.Context, tag int, initiators, netmasks []string) error {
 	params := struct {
 		Initiators []string `json:"initiators"`
 		Tag        int      `json:"tag"`
 		Netmasks   []string `json:"netmasks"`
 	}{
 		Initiators: initiators,
-		Tag:        numberInitiatorGroupTag,
+		Tag:        tag,
 		Netmasks:   netmasks,
 	}
 	var result bool
-	err := node.client.call("iscsi_create_initiator_group", &params, &result)
+	err := node.client.call(ctx, "iscsi_create_initiator_group", &params, &result)
 	if err != nil {
 		return err
 	}
@@ -308,36 +741,72 @@ func (node *nodeISCSI) iscsiCreateInitiatorGroup(initiators, netmasks []string)
 	return nil
 }
 
-// Add an iSCSI target node
-func (node *nodeISCSI) iscsiCreateTargetNode(targetName, bdevName string) error {
+// Add an auth group of CHAP credentials
+func (node *nodeISCSI) iscsiCreateAuthGroup(ctx context.Context, tag int, chap *ISCSICHAPSecret) error {
+	params := struct {
+		Tag     int               `json:"tag"`
+		Secrets []iscsiChapSecret `json:"secrets"`
+	}{
+		Tag:     tag,
+		Secrets: []iscsiChapSecret{newISCSIChapSecret(chap)},
+	}
+	var result bool
+	err := node.client.call(ctx, "iscsi_create_auth_group", &params, &result)
+	if err != nil {
+		return err
+	}
+	if !result {
+		return fmt.Errorf("create iscsi auth group failure")
+	}
+	return nil
+}
+
+// Add or remove portal group to initiator group mappings of an iSCSI target node
+func (node *nodeISCSI) iscsiTargetNodePgIgMaps(ctx context.Context, method, targetName string, maps []iscsiPgIgMap) error {
+	params := struct {
+		Name     string         `json:"name"`
+		PgIgMaps []iscsiPgIgMap `json:"pg_ig_maps"`
+	}{
+		Name:     targetName,
+		PgIgMaps: maps,
+	}
+	var result bool
+	err := node.client.call(ctx, method, &params, &result)
+	if err != nil {
+		return err
+	}
+	if !result {
+		return fmt.Errorf("%s failure", method)
+	}
+	return nil
+}
+
+// Add an iSCSI target node not mapped to any initiator group
+func (node *nodeISCSI) iscsiCreateTargetNode(ctx context.Context, targetName, bdevName string) error {
 	type Luns struct {
 		LunID    int    `json:"lun_id"`
 		BdevName string `json:"bdev_name"`
 	}
-	type PgIgMaps struct {
-		IgTag int `json:"ig_tag"`
-		PgTag int `json:"pg_tag"`
-	}
 	params := struct {
-		Luns        []Luns     `json:"luns"`
-		Name        string     `json:"name"`
-		AliasName   string     `json:"alias_name"`
-		PgIgMaps    []PgIgMaps `json:"pg_ig_maps"`
-		DisableChap bool       `json:"disable_chap"`
-		QueueDepth  int        `json:"queue_depth"`
+		Luns       []Luns         `json:"luns"`
+		Name       string         `json:"name"`
+		AliasName  string         `json:"alias_name"`
+		PgIgMaps   []iscsiPgIgMap `json:"pg_ig_maps"`
+		QueueDepth int            `json:"queue_depth"`
 	}{
 		Luns: []Luns{{0, bdevName}},
 		Name: targetName,
 		// Set aliasName equal to targetName (which is lvolID) for convenience
 		// so that the function "isVolumePublished" can check if the volume is
 		// already published using aliasName(lvolID) easily.
-		AliasName:   targetName,
-		PgIgMaps:    []PgIgMaps{{numberPortalGroupTag, numberInitiatorGroupTag}},
-		DisableChap: true,
-		QueueDepth:  targetQueueDepth,
+		AliasName: targetName,
+		// no initiator is allowed until AllowHost maps its initiator group,
+		// which also sets CHAP authentication
+		PgIgMaps:   []iscsiPgIgMap{},
+		QueueDepth: targetQueueDepth,
 	}
 	var result bool
-	err := node.client.call("iscsi_create_target_node", &params, &result)
+	err := node.client.call(ctx, "iscsi_create_target_node", &params, &result)
 	if err != nil {
 		return err
 	}
@@ -348,14 +817,14 @@ func (node *nodeISCSI) iscsiCreateTargetNode(targetName, bdevName string) error
 }
 
 // Delete an iSCSI target node
-func (node *nodeISCSI) iscsiDeleteTargetNode(targetName string) error {
+func (node *nodeISCSI) iscsiDeleteTargetNode(ctx context.Context, targetName string) error {
 	params := struct {
 		Name string `json:"name"`
 	}{
 		Name: iqnPrefixName + targetName,
 	}
 	var result bool
-	err := node.client.call("iscsi_delete_target_node", &params, &result)
+	err := node.client.call(ctx, "iscsi_delete_target_node", &params, &result)
 	if err != nil {
 		return err
 	}
@@ -366,11 +835,11 @@ func (node *nodeISCSI) iscsiDeleteTargetNode(targetName string) error {
 }
 
 // Check if portal group is available
-func (node *nodeISCSI) iscsiGetPortalGroups() error {
+func (node *nodeISCSI) iscsiGetPortalGroups(ctx context.Context) error {
 	var results []struct {
 		Tag int `json:"tag"`
 	}
-	err := node.client.call("iscsi_get_portal_groups", nil, &results)
+	err := node.client.call(ctx, "iscsi_get_portal_groups", nil, &results)
 	if err != nil {
 		return err
 	}
@@ -382,11 +851,11 @@ func (node *nodeISCSI) iscsiGetPortalGroups() error {
 	return fmt.Errorf("port group not available")
 }
 
-func (node *nodeISCSI) iscsiGetInitiatorGroups() error {
+func (node *nodeISCSI) iscsiGetInitiatorGroups(ctx context.Context) error {
 	var results []struct {
 		Tag int `json:"tag"`
 	}
-	err := node.client.call("iscsi_get_initiator_groups", nil, &results)
+	err := node.client.call(ctx, "iscsi_get_initiator_groups", nil, &results)
 	if err != nil {
 		return err
 	}
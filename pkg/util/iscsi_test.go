@@ -17,7 +17,13 @@ limitations under the License.
 package util
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
 )
 
@@ -30,7 +36,7 @@ const (
 
 //nolint:cyclop // TestISCSI exceeds cyclomatic complexity of 10
 func TestISCSI(t *testing.T) {
-	nodeIx, err := NewSpdkNode(rpcURLISCSI, rpcUserISCSI, rpcPassISCSI, "ISCSI", trAddrISCSI)
+	nodeIx, err := NewSpdkNode(rpcURLISCSI, rpcUserISCSI, rpcPassISCSI, "ISCSI", trAddrISCSI, nil)
 	if err != nil {
 		t.Fatalf("NewSpdkNode: %s", err)
 	}
@@ -39,7 +45,7 @@ func TestISCSI(t *testing.T) {
 		t.Fatal("cannot cast to nodeISCSI")
 	}
 
-	lvs, err := node.LvStores()
+	lvs, err := node.LvStores(context.TODO())
 	if err != nil {
 		t.Fatalf("LvStores: %s", err)
 	}
@@ -50,7 +56,7 @@ func TestISCSI(t *testing.T) {
 		t.Fatalf("No free space: %s", lvs[0].Name)
 	}
 
-	lvolID, err := node.CreateVolume("lvol0", lvs[0].Name, lvs[0].FreeSizeMiB)
+	lvolID, err := node.CreateVolume(context.TODO(), "lvol0", lvs[0].Name, lvs[0].FreeSizeMiB, &LvolOptions{ThinProvision: true, ClearMethod: "unmap"})
 	if err != nil {
 		t.Fatalf("CreateVolume: %s", err)
 	}
@@ -59,7 +65,7 @@ func TestISCSI(t *testing.T) {
 		t.Fatalf("validateVolumeCreated: %s", err)
 	}
 
-	err = node.PublishVolume(lvolID)
+	err = node.PublishVolume(context.TODO(), lvolID, &PublishOptions{})
 	if err != nil {
 		t.Fatalf("PublishVolume: %s", err)
 	}
@@ -70,9 +76,30 @@ func TestISCSI(t *testing.T) {
 		t.Fatalf("iscsiValidateVolumePublished: %s", err)
 	}
 
+	host := &HostAccess{
+		IQN:  "iqn.2016-04.com.open-iscsi:worker1",
+		CHAP: &ISCSICHAPSecret{User: "user", Secret: "secret-0123456789"},
+	}
+	err = node.AllowHost(context.TODO(), lvolID, host)
+	if err != nil {
+		t.Fatalf("AllowHost: %s", err)
+	}
+	err = iscsiValidateHostAllowed(node, lvolID, host.IQN, true)
+	if err != nil {
+		t.Fatalf("iscsiValidateHostAllowed: %s", err)
+	}
+	err = node.DisallowHost(context.TODO(), lvolID, host)
+	if err != nil {
+		t.Fatalf("DisallowHost: %s", err)
+	}
+	err = iscsiValidateHostAllowed(node, lvolID, host.IQN, false)
+	if err != nil {
+		t.Fatalf("iscsiValidateHostDisallowed: %s", err)
+	}
+
 	snapshotName := "snapshot-pvc"
 	var snapshotID string
-	snapshotID, err = node.CreateSnapshot(lvolID, snapshotName)
+	snapshotID, err = node.CreateSnapshot(context.TODO(), lvolID, snapshotName)
 	if err != nil {
 		t.Fatalf("CreateSnapshot: %s", err)
 	}
@@ -81,7 +108,7 @@ func TestISCSI(t *testing.T) {
 		t.Fatalf("validateCreateSnapshot: %s", err)
 	}
 
-	err = node.DeleteVolume(snapshotID)
+	err = node.DeleteVolume(context.TODO(), snapshotID)
 	if err != nil {
 		t.Fatalf("DeleteSnapshot: %s", err)
 	}
@@ -90,12 +117,12 @@ func TestISCSI(t *testing.T) {
 		t.Fatalf("validateSnapshotDeleted: %s", err)
 	}
 
-	err = node.UnpublishVolume(lvolID)
+	err = node.UnpublishVolume(context.TODO(), lvolID)
 	if err != nil {
 		t.Fatalf("UnpublishVolume: %s", err)
 	}
 
-	err = node.DeleteVolume(lvolID)
+	err = node.DeleteVolume(context.TODO(), lvolID)
 	if err != nil {
 		t.Fatalf("DeleteVolume: %s", err)
 	}
@@ -114,7 +141,7 @@ func iscsiValidateVolumeDeleted(node *nodeISCSI, lvolID string) error {
 }
 
 func iscsiValidateVolumeCreated(node *nodeISCSI, lvolID string) error {
-	created, err := node.isVolumeCreated(lvolID)
+	created, err := node.isVolumeCreated(context.TODO(), lvolID)
 	if err != nil {
 		return err
 	}
@@ -125,7 +152,7 @@ func iscsiValidateVolumeCreated(node *nodeISCSI, lvolID string) error {
 }
 
 func iscsiValidateVolumePublished(node *nodeISCSI, lvolID string) error {
-	published, err := node.isVolumePublished(lvolID)
+	published, err := node.isVolumePublished(context.TODO(), lvolID)
 	if err != nil {
 		return err
 	}
@@ -134,3 +161,164 @@ func iscsiValidateVolumePublished(node *nodeISCSI, lvolID string) error {
 	}
 	return nil
 }
+
+func iscsiValidateHostAllowed(node *nodeISCSI, lvolID, iqn string, allowed bool) error {
+	target, err := node.getTargetNode(context.TODO(), lvolID)
+	if err != nil {
+		return err
+	}
+	if target.hasInitiatorGroup(numberInitiatorGroupTag) {
+		return fmt.Errorf("any initiator allowed: %s", lvolID)
+	}
+	igTag, _, err := node.findInitiatorGroup(context.TODO(), iqn)
+	if err != nil {
+		return err
+	}
+	if (igTag != 0 && target.hasInitiatorGroup(igTag)) != allowed {
+		return fmt.Errorf("initiator %s allowed: %v, expected: %v", iqn, !allowed, allowed)
+	}
+	if !target.RequireChap {
+		return fmt.Errorf("CHAP not required: %s", lvolID)
+	}
+	return nil
+}
+
+type fakeISCSIGroup struct {
+	Tag        int               `json:"tag"`
+	Initiators []string          `json:"initiators,omitempty"`
+	Netmasks   []string          `json:"netmasks,omitempty"`
+	Secrets    []iscsiChapSecret `json:"secrets,omitempty"`
+}
+
+// fakeISCSITarget serves iSCSI rpcs of a spdk target with one target node
+type fakeISCSITarget struct {
+	mtx        sync.Mutex
+	target     iscsiTargetNode
+	initiators []fakeISCSIGroup
+	auths      []fakeISCSIGroup
+}
+
+func (f *fakeISCSITarget) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		ID     int32           `json:"id"`
+		Method string          `json:"method"`
+		Params json.RawMessage `json:"params"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	f.mtx.Lock()
+	result, err := f.call(request.Method, request.Params)
+	f.mtx.Unlock()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": request.ID, "result": result}) //nolint:errcheck // test server
+}
+
+func (f *fakeISCSITarget) call(method string, params json.RawMessage) (interface{}, error) {
+	var group fakeISCSIGroup
+	var target iscsiTargetNode
+	var err error
+	switch method {
+	case "iscsi_get_target_nodes":
+		return []iscsiTargetNode{f.target}, nil
+	case "iscsi_get_initiator_groups":
+		return f.initiators, nil
+	case "iscsi_get_auth_groups":
+		return f.auths, nil
+	case "iscsi_create_initiator_group":
+		err = json.Unmarshal(params, &group)
+		f.initiators = append(f.initiators, group)
+	case "iscsi_create_auth_group":
+		err = json.Unmarshal(params, &group)
+		f.auths = append(f.auths, group)
+	case "iscsi_target_node_add_pg_ig_maps":
+		err = json.Unmarshal(params, &target)
+		f.target.PgIgMaps = append(f.target.PgIgMaps, target.PgIgMaps...)
+	case "iscsi_target_node_remove_pg_ig_maps":
+		err = json.Unmarshal(params, &target)
+		for _, m := range target.PgIgMaps {
+			maps := f.target.PgIgMaps[:0]
+			for _, mapped := range f.target.PgIgMaps {
+				if mapped != m {
+					maps = append(maps, mapped)
+				}
+			}
+			f.target.PgIgMaps = maps
+		}
+	case "iscsi_target_node_set_auth":
+		err = json.Unmarshal(params, &target)
+		f.target.ChapGroup, f.target.RequireChap, f.target.MutualChap = target.ChapGroup, target.RequireChap, target.MutualChap
+	default:
+		err = fmt.Errorf("unexpected method %s", method)
+	}
+	return true, err
+}
+
+// CHAP is set per target node, shared by all hosts of the volume
+func TestISCSIAllowHostCHAP(t *testing.T) {
+	fake := &fakeISCSITarget{
+		// no initiator is allowed by a new target node
+		target:     iscsiTargetNode{Name: iqnPrefixName + "lvol1", AliasName: "lvol1"},
+		initiators: []fakeISCSIGroup{{Tag: numberInitiatorGroupTag, Initiators: []string{"ANY"}, Netmasks: []string{"ANY"}}},
+	}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	node, err := NewSpdkNode(server.URL, rpcUserISCSI, rpcPassISCSI, "ISCSI", trAddrISCSI, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chapA := &ISCSICHAPSecret{User: "a", Secret: "secret-a"}
+	chapB := &ISCSICHAPSecret{User: "b", Secret: "secret-b"}
+	host1 := &HostAccess{IQN: "iqn.2016-04.com.open-iscsi:host1", CHAP: chapA}
+	host2 := &HostAccess{IQN: "iqn.2016-04.com.open-iscsi:host2"}
+	requireChap := func(required bool) {
+		t.Helper()
+		if fake.target.RequireChap != required {
+			t.Fatalf("CHAP required should be %v: %+v", required, fake.target)
+		}
+	}
+
+	if err = node.AllowHost(context.TODO(), "lvol1", host1); err != nil {
+		t.Fatal(err)
+	}
+	requireChap(true)
+	// other hosts must use the same credentials
+	for _, chap := range []*ISCSICHAPSecret{chapB, nil} {
+		host2.CHAP = chap
+		if err = node.AllowHost(context.TODO(), "lvol1", host2); !errors.Is(err, ErrCHAPConflict) {
+			t.Fatalf("CHAP %v should conflict, got %v", chap, err)
+		}
+	}
+	if len(fake.target.PgIgMaps) != 1 {
+		t.Fatalf("conflicting host should not be allowed: %v", fake.target.PgIgMaps)
+	}
+	host2.CHAP = &ISCSICHAPSecret{User: "a", Secret: "secret-a"}
+	if err = node.AllowHost(context.TODO(), "lvol1", host2); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.target.PgIgMaps) != 2 {
+		t.Fatalf("both hosts should be allowed: %v", fake.target.PgIgMaps)
+	}
+
+	// CHAP is kept until the last host is disallowed
+	if err = node.DisallowHost(context.TODO(), "lvol1", host1); err != nil {
+		t.Fatal(err)
+	}
+	requireChap(true)
+	if err = node.DisallowHost(context.TODO(), "lvol1", host2); err != nil {
+		t.Fatal(err)
+	}
+	requireChap(false)
+	if len(fake.target.PgIgMaps) != 0 {
+		t.Fatalf("no host should be allowed: %v", fake.target.PgIgMaps)
+	}
+	host2.CHAP = nil
+	if err = node.AllowHost(context.TODO(), "lvol1", host2); err != nil {
+		t.Fatal(err)
+	}
+	requireChap(false)
+}
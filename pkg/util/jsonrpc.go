@@ -17,14 +17,24 @@ limitations under the License.
 package util
 
 import (
-	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"math/rand"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync/atomic"
+	"syscall"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/klog"
 )
 
 // SpdkNode defines interface for SPDK storage node
@@ -34,6 +44,13 @@ import (
 //   - VolumeInfo returns a string map to be passed to client node. Client node
 //     needs these info to mount the target. E.g, target IP, service port, nqn.
 //   - Create/Delete/Publish/UnpublishVolume per CSI controller service spec.
+//   - CloneVolume creates a volume from a snapshot, or from a volume by taking
+//     a hidden snapshot first, which is deleted once no longer shared.
+//   - InflateVolume makes a cloned volume independent of its snapshot.
+//   - ResizeVolume grows a volume to the requested size, shrinking is not supported.
+//   - ListVolumes returns all logical volumes(including snapshots) on that node.
+//   - Methods except Info take the request context, rpc calls are aborted once
+//     the context is cancelled or its deadline is exceeded.
 //
 // NOTE: concurrency, idempotency, message ordering
 //
@@ -75,15 +92,89 @@ import (
 // report errors if possible.
 type SpdkNode interface {
 	Info() string
-	LvStores() ([]LvStore, error)
-	VolumeInfo(lvolID string) (map[string]string, error)
-	CreateVolume(lvolName, lvsName string, sizeMiB int64) (string, error)
-	CloneVolume(lvolName, lvsName string, sourceLvolID string) (string, error)
-	GetVolume(lvolName, lvsName string) (string, error)
-	DeleteVolume(lvolID string) error
-	PublishVolume(lvolID string) error
-	UnpublishVolume(lvolID string) error
-	CreateSnapshot(lvolName, snapshotName string) (string, error)
+	LvStores(ctx context.Context) ([]LvStore, error)
+	VolumeInfo(ctx context.Context, lvolID string) (map[string]string, error)
+	CreateVolume(ctx context.Context, lvolName, lvsName string, sizeMiB int64, opts *LvolOptions) (string, error)
+	CloneVolume(ctx context.Context, lvolName, lvsName string, sourceLvolID string) (string, error)
+	GetVolume(ctx context.Context, lvolName, lvsName string) (string, error)
+	DeleteVolume(ctx context.Context, lvolID string) error
+	InflateVolume(ctx context.Context, lvolID string) error
+	ResizeVolume(ctx context.Context, lvolID string, newSizeMiB int64) error
+	ListVolumes(ctx context.Context) ([]Lvol, error)
+	// PublishVolume exports a volume, opts only take effect when the export is
+	// created, a published volume is not changed
+	PublishVolume(ctx context.Context, lvolID string, opts *PublishOptions) error
+	UnpublishVolume(ctx context.Context, lvolID string) error
+	CreateSnapshot(ctx context.Context, lvolName, snapshotName string) (string, error)
+	// ListExports returns IDs of the lvols exported by the driver, including
+	// exports left behind after the lvol is deleted
+	ListExports(ctx context.Context) ([]string, error)
+	// DeleteExport removes the export of a lvol, no matter the lvol exists or not,
+	// it's not an error if the export is already removed
+	DeleteExport(ctx context.Context, lvolID string) error
+	// AllowHost grants a host access to a published volume, only allowed hosts
+	// can connect it. ErrHostUnknown is returned if the host has no identity of
+	// the target type, i.e, NQN for NVMf and IQN for iSCSI.
+	AllowHost(ctx context.Context, lvolID string, host *HostAccess) error
+	// DisallowHost revokes access granted by AllowHost, all hosts including
+	// "any host" are disallowed if the host has no identity of the target type
+	DisallowHost(ctx context.Context, lvolID string, host *HostAccess) error
+	// RemoveUnusedKeys removes keys named with prefix from spdk keyring once no
+	// host uses them, and returns the removed keys whose files can be deleted
+	RemoveUnusedKeys(ctx context.Context, prefix string) ([]KeyringKey, error)
+}
+
+// HostAccess identifies an initiator host and its credentials to access volumes
+type HostAccess struct {
+	NQN string // NVMe host NQN, for NVMf targets
+	IQN string // iSCSI initiator name, for iSCSI targets
+	// iSCSI CHAP credentials, CHAP is not required if nil
+	CHAP *ISCSICHAPSecret
+	// NVMe DH-HMAC-CHAP keys of the host and controller, authentication is not
+	// required if DHCHAPKey is nil, and the controller is not authenticated if
+	// DHCHAPCtrlKey is nil
+	DHCHAPKey     *KeyringKey
+	DHCHAPCtrlKey *KeyringKey
+	// NVMe/TCP TLS pre-shared key of the host, required by volumes published
+	// with secure channel
+	PSK *KeyringKey
+}
+
+// KeyringKey is a key file added to the spdk file keyring, the file must be
+// readable by the spdk target at Path
+type KeyringKey struct {
+	Name string
+	Path string
+}
+
+// name of nil key is empty
+func (key *KeyringKey) name() string {
+	if key == nil {
+		return ""
+	}
+	return key.Name
+}
+
+// nil host has no identity
+func (host *HostAccess) nqn() string {
+	if host == nil {
+		return ""
+	}
+	return host.NQN
+}
+
+func (host *HostAccess) iqn() string {
+	if host == nil {
+		return ""
+	}
+	return host.IQN
+}
+
+func (host *HostAccess) chap() *ISCSICHAPSecret {
+	if host == nil {
+		return nil
+	}
+	return host.CHAP
 }
 
 // logical volume store
@@ -94,48 +185,124 @@ type LvStore struct {
 	FreeSizeMiB  int64
 }
 
+// logical volume
+type Lvol struct {
+	UUID       string
+	Name       string // lvol name without the lvstore prefix
+	LvsName    string
+	SizeBytes  int64
+	IsSnapshot bool
+	Published  bool
+
+	// below fields are only valid for snapshots
+	IsHidden     bool      // hidden snapshot taken for cloning a volume
+	SnapshotName string    // snapshot name without the creation time suffix
+	CreationTime time.Time // zero if unknown
+	SourceLvolID string    // empty if the source volume is deleted
+}
+
 // BDev SPDK block device
 type BDev struct {
-	Name           string `json:"name"`
-	UUID           string `json:"uuid"`
-	BlockSize      int64  `json:"block_size"`
-	NumBlocks      int64  `json:"num_blocks"`
+	Name           string   `json:"name"`
+	Aliases        []string `json:"aliases"`
+	UUID           string   `json:"uuid"`
+	BlockSize      int64    `json:"block_size"`
+	NumBlocks      int64    `json:"num_blocks"`
 	DriverSpecific *struct {
-		Lvol struct {
-			LvolStoreUUID string `json:"lvol_store_uuid"`
-		} `json:"lvol"`
+		Lvol *struct {
+			LvolStoreUUID string   `json:"lvol_store_uuid"`
+			Snapshot      bool     `json:"snapshot"`
+			Clones        []string `json:"clones"`
+			BaseSnapshot  string   `json:"base_snapshot"`
+		} `json:"lvol,omitempty"`
 	} `json:"driver_specific,omitempty"`
 }
 
 // errors deserve special care
 var (
-	// json response errors: errors.New("json: tag-string")
-	// matches if "tag-string" founded in json error string
+	// json response errors, RPCError matches them by error code with errors.Is,
+	// or by "tag-string" in errors.New("json: tag-string") if the code is -EINVAL
 	ErrJSONNoSpaceLeft   = errors.New("json: No space left")
 	ErrJSONNoSuchDevice  = errors.New("json: No such device")
+	ErrJSONAlreadyExists = errors.New("json: Already exists")
 	ErrInvalidParameters = errors.New("json: Invalid parameters")
 
 	// internal errors
 	ErrVolumeDeleted     = errors.New("volume deleted")
 	ErrVolumePublished   = errors.New("volume already published")
 	ErrVolumeUnpublished = errors.New("volume not published")
+	ErrCHAPConflict      = errors.New("CHAP credentials conflict with other hosts of the volume")
+	ErrHostUnknown       = errors.New("host has no nqn or iqn to be allowed")
 )
 
-// jsonrpc http proxy
+// jsonrpc 2.0 reserved error code, spdk returns it on invalid or unknown params,
+// e.g, querying a subsystem that does not exist
+const jsonRPCInvalidParams = -32602
+
+// RPCError is the error object of a json rpc response. Spdk returns negated
+// errno as error code on most failures, e.g, -ENODEV if the bdev is not found.
+type RPCError struct {
+	Method  string
+	Code    int
+	Message string
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("%s: json response error(%d): %s", e.Method, e.Code, e.Message)
+}
+
+// error codes of json response error sentinels except ErrInvalidParameters
+var rpcErrorCodes = map[error]syscall.Errno{
+	ErrJSONNoSpaceLeft:   syscall.ENOSPC,
+	ErrJSONNoSuchDevice:  syscall.ENODEV,
+	ErrJSONAlreadyExists: syscall.EEXIST,
+}
+
+// Is matches the json response error sentinels by error code. Spdk reports
+// some failures with generic -EINVAL or invalid params, e.g, async
+// bdev_lvol_create failure with message "No space left on device", whose
+// message is matched instead.
+func (e *RPCError) Is(target error) bool {
+	if target == ErrInvalidParameters {
+		// unless it's a more specific error reported as -EINVAL or invalid params
+		return (e.Code == jsonRPCInvalidParams || e.Code == -int(syscall.EINVAL)) && e.messageError() == nil
+	}
+	errno, ok := rpcErrorCodes[target]
+	return ok && (e.Code == -int(errno) || e.messageError() == target)
+}
+
+// messageError returns the sentinel whose "tag-string" of errors.New("json: tag-string")
+// is found in message of an -EINVAL or invalid params error, nil if not found
+func (e *RPCError) messageError() error {
+	if e.Code != -int(syscall.EINVAL) && e.Code != jsonRPCInvalidParams {
+		return nil
+	}
+	message := strings.ToLower(e.Message)
+	for sentinel := range rpcErrorCodes {
+		tag := strings.TrimSpace(strings.TrimPrefix(sentinel.Error(), "json:"))
+		if strings.Contains(message, strings.ToLower(tag)) {
+			return sentinel
+		}
+	}
+	return nil
+}
+
+// jsonrpc client, see rpcTransport for supported rpc urls
 type rpcClient struct {
-	rpcURL     string
-	rpcUser    string
-	rpcPass    string
-	httpClient *http.Client
-	rpcID      int32 // json request message ID, auto incremented
+	rpcURL    string
+	transport rpcTransport
+	rpcID     int32 // json request message ID, auto incremented
 }
 
-func NewSpdkNode(rpcURL, rpcUser, rpcPass, targetType, targetAddr string) (SpdkNode, error) {
+// NewSpdkNode creates SpdkNode by rpcURL, tlsConfig is only used by https rpcURL
+func NewSpdkNode(rpcURL, rpcUser, rpcPass, targetType, targetAddr string, tlsConfig *tls.Config) (SpdkNode, error) {
+	transport, err := newRPCTransport(rpcURL, rpcUser, rpcPass, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
 	client := rpcClient{
-		rpcURL:     rpcURL,
-		rpcUser:    rpcUser,
-		rpcPass:    rpcPass,
-		httpClient: &http.Client{Timeout: cfgRPCTimeoutSeconds * time.Second},
+		rpcURL:    rpcURL,
+		transport: transport,
 	}
 
 	switch strings.ToLower(targetType) {
@@ -150,11 +317,58 @@ func NewSpdkNode(rpcURL, rpcUser, rpcPass, targetType, targetAddr string) (SpdkN
 	}
 }
 
+// addKeyringKey adds the key file to spdk file keyring, it's not an error if
+// the key is nil or already added
+func (client *rpcClient) addKeyringKey(ctx context.Context, key *KeyringKey) error {
+	if key == nil {
+		return nil
+	}
+	params := struct {
+		Name string `json:"name"`
+		Path string `json:"path"`
+	}{
+		Name: key.Name,
+		Path: key.Path,
+	}
+	err := client.call(ctx, "keyring_file_add_key", &params, nil)
+	if errors.Is(err, ErrJSONAlreadyExists) {
+		return nil
+	}
+	return err
+}
+
+// keyring key reported by spdk, RefCnt counts the keyring itself and users of
+// the key, e.g, hosts of NVMf subsystems
+type keyringKeyInfo struct {
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+	RefCnt *int   `json:"refcnt"`
+}
+
+func (client *rpcClient) keyringKeys(ctx context.Context) ([]keyringKeyInfo, error) {
+	var keys []keyringKeyInfo
+	err := client.call(ctx, "keyring_get_keys", nil, &keys)
+	return keys, err
+}
+
+func (client *rpcClient) removeKeyringKey(ctx context.Context, name string) error {
+	params := struct {
+		Name string `json:"name"`
+	}{
+		Name: name,
+	}
+	err := client.call(ctx, "keyring_file_remove_key", &params, nil)
+	if errors.Is(err, ErrJSONNoSuchDevice) {
+		return nil
+	}
+	return err
+}
+
 func (client *rpcClient) info() string {
 	return client.rpcURL
 }
 
-func (client *rpcClient) lvStores() ([]LvStore, error) {
+func (client *rpcClient) lvStores(ctx context.Context) ([]LvStore, error) {
 	var result []struct {
 		FreeClusters  int64  `json:"free_clusters"`
 		ClusterSize   int64  `json:"cluster_size"`
@@ -163,7 +377,7 @@ func (client *rpcClient) lvStores() ([]LvStore, error) {
 		UUID          string `json:"uuid"`
 	}
 
-	err := client.call("bdev_lvol_get_lvstores", nil, &result)
+	err := client.call(ctx, "bdev_lvol_get_lvstores", nil, &result)
 	if err != nil {
 		return nil, err
 	}
@@ -180,7 +394,7 @@ func (client *rpcClient) lvStores() ([]LvStore, error) {
 	return lvs, nil
 }
 
-func (client *rpcClient) createVolume(lvolName, lvsName string, sizeMiB int64) (string, error) {
+func (client *rpcClient) createVolume(ctx context.Context, lvolName, lvsName string, sizeMiB int64, opts *LvolOptions) (string, error) {
 	params := struct {
 		LvolName      string `json:"lvol_name"`
 		Size          int64  `json:"size"`
@@ -191,21 +405,19 @@ func (client *rpcClient) createVolume(lvolName, lvsName string, sizeMiB int64) (
 		LvolName:      lvolName,
 		Size:          sizeMiB * 1024 * 1024,
 		LvsName:       lvsName,
-		ClearMethod:   cfgLvolClearMethod,
-		ThinProvision: cfgLvolThinProvision,
+		ClearMethod:   opts.ClearMethod,
+		ThinProvision: opts.ThinProvision,
 	}
 
 	var lvolID string
 
-	err := client.call("bdev_lvol_create", &params, &lvolID)
-	if errorMatches(err, ErrJSONNoSpaceLeft) {
-		err = ErrJSONNoSpaceLeft // may happen in concurrency
-	}
+	// ErrJSONNoSpaceLeft may happen in concurrency
+	err := client.call(ctx, "bdev_lvol_create", &params, &lvolID)
 
 	return lvolID, err
 }
 
-func (client *rpcClient) cloneVolume(lvolName, snapshotName string) (string, error) {
+func (client *rpcClient) cloneVolume(ctx context.Context, lvolName, snapshotName string) (string, error) {
 	params := struct {
 		CloneName    string `json:"clone_name"`
 		SnapshotName string `json:"snapshot_name"`
@@ -215,13 +427,13 @@ func (client *rpcClient) cloneVolume(lvolName, snapshotName string) (string, err
 	}
 
 	var lvolID string
-	err := client.call("bdev_lvol_clone", &params, &lvolID)
+	err := client.call(ctx, "bdev_lvol_clone", &params, &lvolID)
 
 	return lvolID, err
 }
 
 // get a volume and return a BDev
-func (client *rpcClient) getVolume(lvolID string) (*BDev, error) {
+func (client *rpcClient) getVolume(ctx context.Context, lvolID string) (*BDev, error) {
 	var result []BDev
 
 	params := struct {
@@ -229,15 +441,157 @@ func (client *rpcClient) getVolume(lvolID string) (*BDev, error) {
 	}{
 		Name: lvolID,
 	}
-	err := client.call("bdev_get_bdevs", &params, &result)
-	if errorMatches(err, ErrJSONNoSuchDevice) {
+	err := client.call(ctx, "bdev_get_bdevs", &params, &result)
+	if err != nil {
+		return nil, err
+	}
+	if len(result) == 0 {
 		return nil, ErrJSONNoSuchDevice
 	}
 	return &result[0], nil
 }
 
-func (client *rpcClient) isVolumeCreated(lvolID string) (bool, error) {
-	_, err := client.getVolume(lvolID)
+// list all logical volumes, published status is filled by the caller
+func (client *rpcClient) listVolumes(ctx context.Context) ([]Lvol, error) {
+	lvstores, err := client.lvStores(ctx)
+	if err != nil {
+		return nil, err
+	}
+	lvsNames := make(map[string]string, len(lvstores))
+	for i := range lvstores {
+		lvsNames[lvstores[i].UUID] = lvstores[i].Name
+	}
+
+	var result []BDev
+	err = client.call(ctx, "bdev_get_bdevs", nil, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	var lvols []Lvol
+	clones := make(map[string][]string) // lvsName/lvolName: clone names
+	for i := range result {
+		bdev := &result[i]
+		if bdev.DriverSpecific == nil || bdev.DriverSpecific.Lvol == nil {
+			continue // not a logical volume
+		}
+		lvsName, ok := lvsNames[bdev.DriverSpecific.Lvol.LvolStoreUUID]
+		if !ok {
+			continue
+		}
+		lvol := newLvol(bdev, lvsName)
+		if lvol.IsSnapshot {
+			clones[lvsName+"/"+lvol.Name] = bdev.DriverSpecific.Lvol.Clones
+		}
+		lvols = append(lvols, lvol)
+	}
+	fillSnapshotSources(lvols, clones)
+	return lvols, nil
+}
+
+func newLvol(bdev *BDev, lvsName string) Lvol {
+	// lvol alias is in the form of lvsName/lvolName
+	lvolName := ""
+	if len(bdev.Aliases) > 0 {
+		lvolName = strings.TrimPrefix(bdev.Aliases[0], lvsName+"/")
+	}
+	lvol := Lvol{
+		UUID:       bdev.UUID,
+		Name:       lvolName,
+		LvsName:    lvsName,
+		SizeBytes:  bdev.BlockSize * bdev.NumBlocks,
+		IsSnapshot: bdev.DriverSpecific.Lvol.Snapshot,
+	}
+	if lvol.IsSnapshot {
+		lvol.SnapshotName, lvol.CreationTime = parseSnapshotLvolName(lvolName)
+		lvol.IsHidden = strings.HasPrefix(lvol.SnapshotName, cloneSnapshotPrefix)
+	}
+	return lvol
+}
+
+func fillSnapshotSources(lvols []Lvol, clones map[string][]string) {
+	lvolNames := make(map[string]*Lvol, len(lvols))
+	for i := range lvols {
+		lvolNames[lvols[i].LvsName+"/"+lvols[i].Name] = &lvols[i]
+	}
+	for i := range lvols {
+		if lvols[i].IsSnapshot {
+			lvols[i].SourceLvolID = snapshotSource(lvols[i].LvsName, lvols[i].Name, clones, lvolNames)
+		}
+	}
+}
+
+// snapshotSource finds the volume a snapshot is taken from by walking down the clone tree.
+// Snapshotting a volume turns it into a clone of the new snapshot, and a later snapshot of
+// the same volume is inserted between them. So a snapshot clone is preferred over a volume
+// clone, which may be restored from the snapshot. It's best effort, SPDK doesn't record it.
+func snapshotSource(lvsName, snapshotName string, clones map[string][]string, lvols map[string]*Lvol) string {
+	name := snapshotName
+	for depth := 0; depth < len(lvols); depth++ {
+		var next *Lvol
+		for _, cloneName := range clones[lvsName+"/"+name] {
+			clone, ok := lvols[lvsName+"/"+cloneName]
+			if !ok {
+				continue
+			}
+			if clone.IsSnapshot {
+				next = clone
+			} else if next == nil {
+				next = clone
+			}
+		}
+		if next == nil {
+			return ""
+		}
+		if !next.IsSnapshot {
+			return next.UUID
+		}
+		name = next.Name
+	}
+	return ""
+}
+
+// prefix of hidden snapshots taken for cloning volumes
+const cloneSnapshotPrefix = "clonesrc-"
+
+// snapshot lvol name is in the form of snapshotName_unixTime, as SPDK doesn't record
+// creation time of lvols. The suffix is omitted if the name doesn't fit in lvol name.
+func snapshotLvolName(snapshotName string, creationTime time.Time) string {
+	lvolName := fmt.Sprintf("%s_%d", snapshotName, creationTime.Unix())
+	if len(lvolName) > cfgLvolNameMaxLen {
+		return snapshotName
+	}
+	return lvolName
+}
+
+func parseSnapshotLvolName(lvolName string) (snapshotName string, creationTime time.Time) {
+	idx := strings.LastIndex(lvolName, "_")
+	if idx < 0 {
+		return lvolName, time.Time{}
+	}
+	seconds, err := strconv.ParseInt(lvolName[idx+1:], 10, 64)
+	if err != nil || seconds <= 0 {
+		return lvolName, time.Time{}
+	}
+	return lvolName[:idx], time.Unix(seconds, 0)
+}
+
+// get snapshot ID by snapshot name(without creation time suffix)
+func (client *rpcClient) getSnapshot(ctx context.Context, lvsName, snapshotName string) (string, error) {
+	lvols, err := client.listVolumes(ctx)
+	if err != nil {
+		return "", err
+	}
+	for i := range lvols {
+		if lvols[i].IsSnapshot && lvols[i].LvsName == lvsName && lvols[i].SnapshotName == snapshotName {
+			return lvols[i].UUID, nil
+		}
+	}
+	return "", ErrJSONNoSuchDevice
+}
+
+func (client *rpcClient) isVolumeCreated(ctx context.Context, lvolID string) (bool, error) {
+	_, err := client.getVolume(ctx, lvolID)
 	if err != nil {
 		if errors.Is(err, ErrJSONNoSuchDevice) {
 			return false, nil
@@ -247,22 +601,121 @@ func (client *rpcClient) isVolumeCreated(lvolID string) (bool, error) {
 	return true, nil
 }
 
-func (client *rpcClient) deleteVolume(lvolID string) error {
+func (client *rpcClient) deleteVolume(ctx context.Context, lvolID string) error {
 	params := struct {
 		Name string `json:"name"`
 	}{
 		Name: lvolID,
 	}
 
-	err := client.call("bdev_lvol_delete", &params, nil)
-	if errorMatches(err, ErrJSONNoSuchDevice) {
-		err = ErrJSONNoSuchDevice // may happen in concurrency
+	// ErrJSONNoSuchDevice may happen in concurrency
+	return client.call(ctx, "bdev_lvol_delete", &params, nil)
+}
+
+func (client *rpcClient) inflateVolume(ctx context.Context, lvolID string) error {
+	params := struct {
+		Name string `json:"name"`
+	}{
+		Name: lvolID,
 	}
 
-	return err
+	var result bool
+	err := client.call(ctx, "bdev_lvol_inflate", &params, &result)
+	if err != nil {
+		return err
+	}
+	if !result {
+		return fmt.Errorf("inflate lvol %s failure", lvolID)
+	}
+	return nil
 }
 
-func (client *rpcClient) snapshot(lvolName, snapShotName string) (string, error) {
+// cloneSource returns the snapshot to clone lvolName from. If the source is a volume,
+// a hidden snapshot named after the clone is taken, which is reused on retries.
+func (client *rpcClient) cloneSource(ctx context.Context, lvolName, lvsName, sourceLvolID string) (string, error) {
+	source, err := client.getVolume(ctx, sourceLvolID)
+	if err != nil {
+		return "", err
+	}
+	if source.DriverSpecific != nil && source.DriverSpecific.Lvol != nil && source.DriverSpecific.Lvol.Snapshot {
+		return sourceLvolID, nil
+	}
+
+	snapshotName := cloneSnapshotPrefix + lvolName
+	snapshotID, err := client.getSnapshot(ctx, lvsName, snapshotName)
+	if err == nil {
+		return snapshotID, nil
+	}
+	snapshotID, err = client.snapshot(ctx, sourceLvolID, snapshotLvolName(snapshotName, time.Now()))
+	if err != nil {
+		return "", err
+	}
+	klog.V(5).Infof("hidden snapshot created: %s, source: %s", snapshotID, sourceLvolID)
+	return snapshotID, nil
+}
+
+// hiddenBaseSnapshot returns alias(lvsName/lvolName) of the hidden snapshot a volume is cloned from,
+// or empty string if the volume is not cloned from a hidden snapshot
+func (client *rpcClient) hiddenBaseSnapshot(ctx context.Context, lvolID string) string {
+	lvol, err := client.getVolume(ctx, lvolID)
+	if err != nil || lvol.DriverSpecific == nil || lvol.DriverSpecific.Lvol == nil {
+		return ""
+	}
+	baseSnapshot := lvol.DriverSpecific.Lvol.BaseSnapshot
+	if !strings.HasPrefix(baseSnapshot, cloneSnapshotPrefix) {
+		return ""
+	}
+	lvsName, err := client.getLvstore(ctx, lvolID)
+	if err != nil {
+		return ""
+	}
+	return lvsName + "/" + baseSnapshot
+}
+
+// deleteHiddenSnapshot deletes a hidden snapshot if it's shared by no more than one volume,
+// SPDK merges the snapshot into its only clone on deletion
+func (client *rpcClient) deleteHiddenSnapshot(ctx context.Context, snapshotAlias string) {
+	if snapshotAlias == "" {
+		return
+	}
+	snapshot, err := client.getVolume(ctx, snapshotAlias)
+	if err != nil {
+		klog.Warningf("failed to get hidden snapshot %s: %v", snapshotAlias, err)
+		return
+	}
+	if snapshot.DriverSpecific == nil || snapshot.DriverSpecific.Lvol == nil ||
+		len(snapshot.DriverSpecific.Lvol.Clones) > 1 {
+		return
+	}
+	err = client.deleteVolume(ctx, snapshot.UUID)
+	if err != nil {
+		klog.Warningf("failed to delete hidden snapshot %s: %v", snapshotAlias, err)
+		return
+	}
+	klog.V(5).Infof("hidden snapshot deleted: %s", snapshotAlias)
+}
+
+func (client *rpcClient) resizeVolume(ctx context.Context, lvolID string, newSizeMiB int64) error {
+	params := struct {
+		Name string `json:"name"`
+		Size int64  `json:"size"`
+	}{
+		Name: lvolID,
+		Size: newSizeMiB * 1024 * 1024,
+	}
+
+	var result bool
+	err := client.call(ctx, "bdev_lvol_resize", &params, &result)
+	if err != nil {
+		return err
+	}
+	if !result {
+		return fmt.Errorf("resize lvol %s failure", lvolID)
+	}
+	return nil
+}
+
+func (client *rpcClient) snapshot(ctx context.Context, lvolName, snapShotName string) (string, error) {
 	params := struct {
 		LvolName     string `json:"lvol_name"`
 		SnapShotName string `json:"snapshot_name"`
@@ -272,22 +725,22 @@ func (client *rpcClient) snapshot(lvolName, snapShotName string) (string, error)
 	}
 
 	var snapshotID string
-	err := client.call("bdev_lvol_snapshot", &params, &snapshotID)
+	err := client.call(ctx, "bdev_lvol_snapshot", &params, &snapshotID)
 
 	return snapshotID, err
 }
 
 // getLvstore get lvstore name for specific lvol
-func (client *rpcClient) getLvstore(lvolID string) (string, error) {
-	lvol, err := client.getVolume(lvolID)
+func (client *rpcClient) getLvstore(ctx context.Context, lvolID string) (string, error) {
+	lvol, err := client.getVolume(ctx, lvolID)
 	if err != nil {
 		return "", err
 	}
-	if lvol.DriverSpecific == nil {
+	if lvol.DriverSpecific == nil || lvol.DriverSpecific.Lvol == nil {
 		return "", fmt.Errorf("no driver_specific for %s", lvolID)
 	}
 	lvstoreUUID := lvol.DriverSpecific.Lvol.LvolStoreUUID
-	lvstores, err := client.lvStores()
+	lvstores, err := client.lvStores(ctx)
 	if err != nil {
 		return "", err
 	}
@@ -300,7 +753,72 @@ func (client *rpcClient) getLvstore(lvolID string) (string, error) {
 }
 
 // low level rpc request/response handling
-func (client *rpcClient) call(method string, args, result interface{}) error {
+// idempotent read methods, safe to retry on transient errors
+var rpcRetryableMethods = map[string]bool{
+	"bdev_get_bdevs":               true,
+	"bdev_lvol_get_lvstores":       true,
+	"nvmf_get_subsystems":          true,
+	"nvmf_subsystem_get_listeners": true,
+	"nvmf_get_transports":          true,
+	"iscsi_get_target_nodes":       true,
+	"iscsi_get_portal_groups":      true,
+	"iscsi_get_initiator_groups":   true,
+}
+
+// call sends json rpc request to spdk. Idempotent read methods are retried on
+// transient errors(e.g, spdk is restarting) with jittered exponential backoff.
+func (client *rpcClient) call(ctx context.Context, method string, args, result interface{}) (err error) {
+	ctx, span := StartSpan(ctx, "spdk/"+method,
+		attribute.String("rpc.system", "jsonrpc"), attribute.String("rpc.method", method))
+	defer func(start time.Time) {
+		observeRPC(method, start, err)
+		EndSpan(span, err)
+	}(time.Now())
+
+	backoff := cfgRPCBackoffMs * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err = client.callOnce(ctx, method, args, result)
+		if err == nil || !rpcRetryableMethods[method] || attempt >= cfgRPCRetries ||
+			ctx.Err() != nil || !isTransientError(err) {
+			return err
+		}
+
+		// random delay in [backoff/2, backoff) avoids retrying in lockstep
+		//nolint:gosec // no need of crypto random for jitter
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)))
+		klog.Warningf("%s: attempt %d failed, retry in %v: %s", method, attempt, delay, err)
+		span.AddEvent("retry", trace.WithAttributes(attribute.Int("attempt", attempt), attribute.String("error", err.Error())))
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%s: %w", method, ctx.Err())
+		case <-timer.C:
+		}
+		backoff *= 2
+		if backoff > cfgRPCMaxBackoffMs*time.Millisecond {
+			backoff = cfgRPCMaxBackoffMs * time.Millisecond
+		}
+	}
+}
+
+// transient errors may succeed on retry, json rpc errors returned by spdk are permanent
+func isTransientError(err error) bool {
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.code >= http.StatusInternalServerError
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	// ENOENT: unix domain socket is gone when spdk restarts
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ENOENT) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func (client *rpcClient) callOnce(ctx context.Context, method string, args, result interface{}) error {
 	type rpcRequest struct {
 		Ver    string `json:"jsonrpc"`
 		ID     int32  `json:"id"`
@@ -333,24 +851,6 @@ func (client *rpcClient) call(method string, args, result interface{}) error {
 		return fmt.Errorf("%s: %w", method, err)
 	}
 
-	req, err := http.NewRequest(http.MethodPost, client.rpcURL, bytes.NewReader(data))
-	if err != nil {
-		return fmt.Errorf("%s: %w", method, err)
-	}
-
-	req.SetBasicAuth(client.rpcUser, client.rpcPass)
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := client.httpClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("%s: %w", method, err)
-	}
-
-	defer resp.Body.Close()
-	if resp.StatusCode >= http.StatusBadRequest {
-		return fmt.Errorf("%s: HTTP error code: %d", method, resp.StatusCode)
-	}
-
 	response := struct {
 		ID    int32 `json:"id"`
 		Error struct {
@@ -362,7 +862,9 @@ func (client *rpcClient) call(method string, args, result interface{}) error {
 		Result: result,
 	}
 
-	err = json.NewDecoder(resp.Body).Decode(&response)
+	err = client.transport.send(ctx, data, func(r io.Reader) error {
+		return json.NewDecoder(r).Decode(&response)
+	})
 	if err != nil {
 		return fmt.Errorf("%s: %w", method, err)
 	}
@@ -370,19 +872,8 @@ func (client *rpcClient) call(method string, args, result interface{}) error {
 		return fmt.Errorf("%s: json response ID mismatch", method)
 	}
 	if response.Error.Code != 0 {
-		return fmt.Errorf("%s: json response error: %s", method, response.Error.Message)
+		return &RPCError{Method: method, Code: response.Error.Code, Message: response.Error.Message}
 	}
 
 	return nil
 }
-
-func errorMatches(errFull, errJSON error) bool {
-	if errFull == nil {
-		return false
-	}
-	strFull := strings.ToLower(errFull.Error())
-	strJSON := strings.ToLower(errJSON.Error())
-	strJSON = strings.TrimPrefix(strJSON, "json:")
-	strJSON = strings.TrimSpace(strJSON)
-	return strings.Contains(strFull, strJSON)
-}
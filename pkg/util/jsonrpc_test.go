@@ -0,0 +1,112 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSnapshotLvolName(t *testing.T) {
+	creationTime := time.Unix(1690000000, 0)
+	snapshotName := "snapshot-7d5b0e1a-3e2f-4d8c-9f0a-1b2c3d4e5f60"
+
+	lvolName := snapshotLvolName(snapshotName, creationTime)
+	name, parsedTime := parseSnapshotLvolName(lvolName)
+	if name != snapshotName || !parsedTime.Equal(creationTime) {
+		t.Fatalf("parse %s: got %s %v", lvolName, name, parsedTime)
+	}
+
+	// snapshots created by old versions have no creation time suffix
+	name, parsedTime = parseSnapshotLvolName(snapshotName)
+	if name != snapshotName || !parsedTime.IsZero() {
+		t.Fatalf("parse %s: got %s %v", snapshotName, name, parsedTime)
+	}
+
+	// suffix is omitted if name is too long
+	longName := strings.Repeat("s", cfgLvolNameMaxLen-1)
+	if lvolName = snapshotLvolName(longName, creationTime); lvolName != longName {
+		t.Fatalf("long name should not be suffixed: %s", lvolName)
+	}
+}
+
+func TestSnapshotSource(t *testing.T) {
+	// vol0 -> snap1 -> snap2 -> vol0, vol1 restored from snap1
+	lvols := map[string]*Lvol{
+		"lvs/vol0":  {UUID: "uuid-vol0", Name: "vol0"},
+		"lvs/vol1":  {UUID: "uuid-vol1", Name: "vol1"},
+		"lvs/snap1": {UUID: "uuid-snap1", Name: "snap1", IsSnapshot: true},
+		"lvs/snap2": {UUID: "uuid-snap2", Name: "snap2", IsSnapshot: true},
+		"lvs/snap3": {UUID: "uuid-snap3", Name: "snap3", IsSnapshot: true},
+	}
+	clones := map[string][]string{
+		"lvs/snap1": {"vol1", "snap2"},
+		"lvs/snap2": {"vol0"},
+		"lvs/snap3": {},
+	}
+
+	cases := map[string]string{
+		"snap1": "uuid-vol0",
+		"snap2": "uuid-vol0",
+		"snap3": "", // source volume deleted
+	}
+	for snapshotName, expected := range cases {
+		if source := snapshotSource("lvs", snapshotName, clones, lvols); source != expected {
+			t.Fatalf("source of %s: expected %q, got %q", snapshotName, expected, source)
+		}
+	}
+}
+
+func TestRPCError(t *testing.T) {
+	cases := []struct {
+		code     int
+		message  string
+		expected error
+	}{
+		{-int(syscall.ENODEV), "No such device", ErrJSONNoSuchDevice},
+		{-int(syscall.ENOSPC), "No space left on device", ErrJSONNoSpaceLeft},
+		// async bdev_lvol_create failure on a full lvstore
+		{-int(syscall.EINVAL), "No space left on device", ErrJSONNoSpaceLeft},
+		{-int(syscall.EINVAL), "No such device", ErrJSONNoSuchDevice},
+		{-int(syscall.EEXIST), "File exists", ErrJSONAlreadyExists},
+		{-int(syscall.EINVAL), "Invalid argument", ErrInvalidParameters},
+		{jsonRPCInvalidParams, "Invalid parameters", ErrInvalidParameters},
+		// async bdev_lvol_create failure reported as invalid params
+		{jsonRPCInvalidParams, "No space left on device", ErrJSONNoSpaceLeft},
+		// matched by code, message is only matched for -EINVAL and invalid params
+		{-int(syscall.ENODEV), "bdev not found", ErrJSONNoSuchDevice},
+		{-int(syscall.EIO), "No such device", nil},
+		{-int(syscall.EIO), "No space left on device", nil},
+	}
+	sentinels := []error{ErrJSONNoSuchDevice, ErrJSONNoSpaceLeft, ErrJSONAlreadyExists, ErrInvalidParameters}
+	for _, c := range cases {
+		err := fmt.Errorf("wrapped: %w", &RPCError{Method: "test", Code: c.code, Message: c.message})
+		for _, sentinel := range sentinels {
+			if matched := errors.Is(err, sentinel); matched != (sentinel == c.expected) {
+				t.Errorf("code %d %q: errors.Is(%v) = %v", c.code, c.message, sentinel, matched)
+			}
+		}
+		var rpcErr *RPCError
+		if !errors.As(err, &rpcErr) || rpcErr.Code != c.code {
+			t.Errorf("code %d: failed to get RPCError from %v", c.code, err)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// MetricsNamespace prefixes all metrics exported by the driver
+const MetricsNamespace = "spdkcsi"
+
+var (
+	rpcDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "spdk_rpc",
+		Name:      "duration_seconds",
+		Help:      "Latency of spdk json rpc calls including retries, by rpc method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+
+	rpcErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "spdk_rpc",
+		Name:      "errors_total",
+		Help:      "Number of failed spdk json rpc calls, by rpc method.",
+	}, []string{"method"})
+
+	initiatorDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Subsystem: "initiator",
+		Name:      "duration_seconds",
+		Help:      "Latency of connecting and disconnecting volumes on the node, by operation, target type and result.",
+		// nvme connect and iscsiadm login may take tens of seconds
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 10),
+	}, []string{"operation", "target_type", "result"})
+)
+
+func observeRPC(method string, start time.Time, err error) {
+	rpcDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		rpcErrors.WithLabelValues(method).Inc()
+	}
+}
+
+// ObserveInitiator records duration of an initiator operation(connect, disconnect) started at start
+func ObserveInitiator(operation, targetType string, start time.Time, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	initiatorDuration.WithLabelValues(operation, strings.ToLower(targetType), result).Observe(time.Since(start).Seconds())
+}
@@ -17,20 +17,27 @@ limitations under the License.
 package util
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
 	"sync/atomic"
+	"time"
 
 	"k8s.io/klog"
 )
 
+// nqn of subsystems created by the driver, followed by lvol ID
+const nvmfNqnPrefix = "nqn.2020-04.io.spdk.csi:uuid:"
+
 type nodeNVMf struct {
 	client *rpcClient
 
 	targetType   string // RDMA, TCP
 	targetAddr   string
 	targetPort   string
+	securePort   string // port of TLS listeners
 	transCreated int32
 }
 
@@ -40,6 +47,7 @@ func newNVMf(client *rpcClient, targetType, targetAddr string) *nodeNVMf {
 		targetType: targetType,
 		targetAddr: targetAddr,
 		targetPort: cfgNVMfSvcPort,
+		securePort: cfgNVMfSecureSvcPort,
 	}
 }
 
@@ -47,23 +55,27 @@ func (node *nodeNVMf) Info() string {
 	return node.client.info()
 }
 
-func (node *nodeNVMf) LvStores() ([]LvStore, error) {
-	return node.client.lvStores()
+func (node *nodeNVMf) LvStores(ctx context.Context) ([]LvStore, error) {
+	return node.client.lvStores(ctx)
 }
 
 // VolumeInfo returns a string:string map containing information necessary
 // for CSI node(initiator) to connect to this target and identify the disk.
-func (node *nodeNVMf) VolumeInfo(lvolID string) (map[string]string, error) {
-	lvol, err := node.client.getVolume(lvolID)
+func (node *nodeNVMf) VolumeInfo(ctx context.Context, lvolID string) (map[string]string, error) {
+	lvol, err := node.client.getVolume(ctx, lvolID)
+	if err != nil {
+		return nil, err
+	}
+	lvStore, err := node.client.getLvstore(ctx, lvolID)
 	if err != nil {
 		return nil, err
 	}
-	lvStore, err := node.client.getLvstore(lvolID)
+	listener, err := node.getListener(ctx, lvolID)
 	if err != nil {
 		return nil, err
 	}
 
-	return map[string]string{
+	volumeInfo := map[string]string{
 		"targetType": node.targetType,
 		"targetAddr": node.targetAddr,
 		"targetPort": node.targetPort,
@@ -71,19 +83,25 @@ func (node *nodeNVMf) VolumeInfo(lvolID string) (map[string]string, error) {
 		"model":      node.getVolumeModel(lvolID),
 		"lvolSize":   strconv.FormatInt(lvol.BlockSize*lvol.NumBlocks, 10),
 		"lvstore":    lvStore,
-	}, nil
+	}
+	// initiator connects with TLS, and the controller registers PSK of the host
+	if listener != nil && listener.TrSvcID == node.securePort {
+		volumeInfo["targetPort"] = node.securePort
+		volumeInfo["secureChannel"] = "true"
+	}
+	return volumeInfo, nil
 }
 
 // CreateVolume creates a logical volume and returns volume ID
-func (node *nodeNVMf) CreateVolume(lvolName, lvsName string, sizeMiB int64) (string, error) {
+func (node *nodeNVMf) CreateVolume(ctx context.Context, lvolName, lvsName string, sizeMiB int64, opts *LvolOptions) (string, error) {
 	// all volume have an alias ID named lvsName/lvolName
-	lvol, err := node.client.getVolume(fmt.Sprintf("%s/%s", lvsName, lvolName))
+	lvol, err := node.client.getVolume(ctx, fmt.Sprintf("%s/%s", lvsName, lvolName))
 	if err == nil {
 		klog.Warningf("volume already created: %s/%s %s", lvsName, lvolName, lvol.UUID)
 		return lvol.UUID, nil
 	}
 
-	lvolID, err := node.client.createVolume(lvolName, lvsName, sizeMiB)
+	lvolID, err := node.client.createVolume(ctx, lvolName, lvsName, sizeMiB, opts)
 	if err != nil {
 		return "", err
 	}
@@ -92,16 +110,22 @@ func (node *nodeNVMf) CreateVolume(lvolName, lvsName string, sizeMiB int64) (str
 }
 
 // CloneVolume creates a logical volume based on the source volume and returns volume ID
-func (node *nodeNVMf) CloneVolume(lvolName, lvsName, sourceLvolID string) (string, error) {
+func (node *nodeNVMf) CloneVolume(ctx context.Context, lvolName, lvsName, sourceLvolID string) (string, error) {
 	// all volume have an alias ID named lvsName/lvolName
-	lvol, err := node.client.getVolume(fmt.Sprintf("%s/%s", lvsName, lvolName))
+	lvol, err := node.client.getVolume(ctx, fmt.Sprintf("%s/%s", lvsName, lvolName))
 	if err == nil {
 		klog.Warningf("volume already cloned: %s/%s %s", lvsName, lvolName, lvol.UUID)
 		return lvol.UUID, nil
 	}
-	var lvolID string
-	// clone sourceLvol
-	lvolID, err = node.client.cloneVolume(lvolName, sourceLvolID)
+	snapshotID, err := node.client.cloneSource(ctx, lvolName, lvsName, sourceLvolID)
+	if err != nil {
+		return "", err
+	}
+	lvolID, err := node.client.cloneVolume(ctx, lvolName, snapshotID)
+	if err != nil && snapshotID != sourceLvolID {
+		// don't leave an unused hidden snapshot behind
+		node.client.deleteHiddenSnapshot(ctx, fmt.Sprintf("%s/%s", lvsName, cloneSnapshotPrefix+lvolName))
+	}
 
 	if err != nil {
 		return "", err
@@ -111,29 +135,29 @@ func (node *nodeNVMf) CloneVolume(lvolName, lvsName, sourceLvolID string) (strin
 }
 
 // GetVolume returns the volume id of the given volume name and lvstore name. return error if not found.
-func (node *nodeNVMf) GetVolume(lvolName, lvsName string) (string, error) {
-	lvol, err := node.client.getVolume(fmt.Sprintf("%s/%s", lvsName, lvolName))
+func (node *nodeNVMf) GetVolume(ctx context.Context, lvolName, lvsName string) (string, error) {
+	lvol, err := node.client.getVolume(ctx, fmt.Sprintf("%s/%s", lvsName, lvolName))
 	if err != nil {
 		return "", err
 	}
 	return lvol.UUID, err
 }
 
-func (node *nodeNVMf) isVolumeCreated(lvolID string) (bool, error) {
-	return node.client.isVolumeCreated(lvolID)
+func (node *nodeNVMf) isVolumeCreated(ctx context.Context, lvolID string) (bool, error) {
+	return node.client.isVolumeCreated(ctx, lvolID)
 }
 
-func (node *nodeNVMf) CreateSnapshot(lvolName, snapshotName string) (string, error) {
-	lvsName, err := node.client.getLvstore(lvolName)
+func (node *nodeNVMf) CreateSnapshot(ctx context.Context, lvolName, snapshotName string) (string, error) {
+	lvsName, err := node.client.getLvstore(ctx, lvolName)
 	if err != nil {
 		return "", err
 	}
-	lvol, err := node.client.getVolume(fmt.Sprintf("%s/%s", lvsName, snapshotName))
+	snapshotID, err := node.client.getSnapshot(ctx, lvsName, snapshotName)
 	if err == nil {
-		klog.Warningf("snapshot already created: %s", lvol.UUID)
-		return lvol.UUID, nil
+		klog.Warningf("snapshot already created: %s", snapshotID)
+		return snapshotID, nil
 	}
-	snapshotID, err := node.client.snapshot(lvolName, snapshotName)
+	snapshotID, err = node.client.snapshot(ctx, lvolName, snapshotLvolName(snapshotName, time.Now()))
 	if err != nil {
 		return "", err
 	}
@@ -142,25 +166,290 @@ func (node *nodeNVMf) CreateSnapshot(lvolName, snapshotName string) (string, err
 	return snapshotID, nil
 }
 
-func (node *nodeNVMf) DeleteVolume(lvolID string) error {
-	err := node.client.deleteVolume(lvolID)
+func (node *nodeNVMf) DeleteVolume(ctx context.Context, lvolID string) error {
+	hiddenSnapshot := node.client.hiddenBaseSnapshot(ctx, lvolID)
+	err := node.client.deleteVolume(ctx, lvolID)
 	if err != nil {
 		return err
 	}
+	node.client.deleteHiddenSnapshot(ctx, hiddenSnapshot)
 	klog.V(5).Infof("volume deleted: %s", lvolID)
 	return nil
 }
 
-// PublishVolume exports a volume through NVMf target
-func (node *nodeNVMf) PublishVolume(lvolID string) error {
-	exists, err := node.isVolumeCreated(lvolID)
+// InflateVolume allocates all clusters of a cloned volume and detaches it from the snapshot
+func (node *nodeNVMf) InflateVolume(ctx context.Context, lvolID string) error {
+	hiddenSnapshot := node.client.hiddenBaseSnapshot(ctx, lvolID)
+	err := node.client.inflateVolume(ctx, lvolID)
+	if err != nil {
+		return err
+	}
+	node.client.deleteHiddenSnapshot(ctx, hiddenSnapshot)
+	klog.V(5).Infof("volume inflated: %s", lvolID)
+	return nil
+}
+
+// ResizeVolume grows a logical volume, it's a no-op if the volume is already big enough
+func (node *nodeNVMf) ResizeVolume(ctx context.Context, lvolID string, newSizeMiB int64) error {
+	lvol, err := node.client.getVolume(ctx, lvolID)
+	if err != nil {
+		return err
+	}
+	if lvol.BlockSize*lvol.NumBlocks >= newSizeMiB*1024*1024 {
+		klog.Warningf("volume already resized: %s", lvolID)
+		return nil
+	}
+	err = node.client.resizeVolume(ctx, lvolID, newSizeMiB)
+	if err != nil {
+		return err
+	}
+	klog.V(5).Infof("volume resized: %s, size: %d MiB", lvolID, newSizeMiB)
+	return nil
+}
+
+// ListVolumes returns all logical volumes and whether they are exported through NVMf target
+func (node *nodeNVMf) ListVolumes(ctx context.Context) ([]Lvol, error) {
+	lvols, err := node.client.listVolumes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []struct {
+		Nqn string `json:"nqn"`
+	}
+	err = node.client.call(ctx, "nvmf_get_subsystems", nil, &results)
+	if err != nil {
+		return nil, err
+	}
+	nqns := make(map[string]bool, len(results))
+	for i := range results {
+		nqns[results[i].Nqn] = true
+	}
+	for i := range lvols {
+		lvols[i].Published = nqns[node.getVolumeNqn(lvols[i].UUID)]
+	}
+	return lvols, nil
+}
+
+// ListExports returns IDs of lvols in NVMf subsystems created by the driver
+func (node *nodeNVMf) ListExports(ctx context.Context) ([]string, error) {
+	var results []struct {
+		Nqn string `json:"nqn"`
+	}
+	err := node.client.call(ctx, "nvmf_get_subsystems", nil, &results)
+	if err != nil {
+		return nil, err
+	}
+	var lvolIDs []string
+	for i := range results {
+		if strings.HasPrefix(results[i].Nqn, nvmfNqnPrefix) {
+			lvolIDs = append(lvolIDs, strings.TrimPrefix(results[i].Nqn, nvmfNqnPrefix))
+		}
+	}
+	return lvolIDs, nil
+}
+
+// DeleteExport deletes the NVMf subsystem of a lvol, namespaces are removed with it
+func (node *nodeNVMf) DeleteExport(ctx context.Context, lvolID string) error {
+	err := node.deleteSubsystem(ctx, lvolID)
+	// deleting nqn that does not exist, an invalid parameters error will be thrown
+	if errors.Is(err, ErrInvalidParameters) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	klog.V(5).Infof("export deleted: %s", node.getVolumeNqn(lvolID))
+	return nil
+}
+
+type nvmfSubsystem struct {
+	Nqn          string     `json:"nqn"`
+	AllowAnyHost bool       `json:"allow_any_host"`
+	Hosts        []nvmfHost `json:"hosts"`
+}
+
+type nvmfHost struct {
+	Nqn string `json:"nqn"`
+	// names of DH-HMAC-CHAP keys and TLS PSK in spdk keyring, only reported by recent spdk
+	DHCHAPKey      string `json:"dhchap_key,omitempty"`
+	DHCHAPCtrlrKey string `json:"dhchap_ctrlr_key,omitempty"`
+	PSK            string `json:"psk,omitempty"`
+}
+
+type nvmfListener struct {
+	TrType  string `json:"trtype"`
+	AdrFam  string `json:"adrfam"`
+	TrAddr  string `json:"traddr"`
+	TrSvcID string `json:"trsvcid"`
+}
+
+func (s *nvmfSubsystem) getHost(hostNQN string) *nvmfHost {
+	for i := range s.Hosts {
+		if s.Hosts[i].Nqn == hostNQN {
+			return &s.Hosts[i]
+		}
+	}
+	return nil
+}
+
+func (s *nvmfSubsystem) hasHost(hostNQN string) bool {
+	return s.getHost(hostNQN) != nil
+}
+
+// keysChanged returns if keys of the added host differ from host, keys are
+// taken as unchanged if spdk doesn't report them
+func (h *nvmfHost) keysChanged(host *HostAccess) bool {
+	if h.DHCHAPKey == "" && h.DHCHAPCtrlrKey == "" && h.PSK == "" {
+		return false
+	}
+	return h.DHCHAPKey != host.DHCHAPKey.name() || h.DHCHAPCtrlrKey != host.DHCHAPCtrlKey.name() ||
+		h.PSK != host.PSK.name()
+}
+
+// AllowHost adds the host to NVMf subsystem of the volume, and stops allowing
+// any host, e.g, subsystems created by old versions of the driver
+func (node *nodeNVMf) AllowHost(ctx context.Context, lvolID string, host *HostAccess) error {
+	if host.nqn() == "" {
+		return ErrHostUnknown
+	}
+	subsystem, err := node.getSubsystem(ctx, lvolID)
+	if err != nil {
+		return err
+	}
+	err = node.addHost(ctx, subsystem, host)
+	if err != nil {
+		return err
+	}
+	if subsystem.AllowAnyHost {
+		return node.subsystemAllowAnyHost(ctx, lvolID, false)
+	}
+	return nil
+}
+
+// addHost adds the host with its keys to the subsystem, the host is added again
+// if its keys are changed
+func (node *nodeNVMf) addHost(ctx context.Context, subsystem *nvmfSubsystem, host *HostAccess) error {
+	added := subsystem.getHost(host.NQN)
+	if added != nil && !added.keysChanged(host) {
+		return nil
+	}
+	for _, key := range []*KeyringKey{host.DHCHAPKey, host.DHCHAPCtrlKey, host.PSK} {
+		if err := node.client.addKeyringKey(ctx, key); err != nil {
+			return err
+		}
+	}
+	if added != nil {
+		if err := node.subsystemRemoveHost(ctx, subsystem.Nqn, host.NQN); err != nil {
+			return err
+		}
+	}
+	params := struct {
+		Nqn            string `json:"nqn"`
+		Host           string `json:"host"`
+		DHCHAPKey      string `json:"dhchap_key,omitempty"`
+		DHCHAPCtrlrKey string `json:"dhchap_ctrlr_key,omitempty"`
+		PSK            string `json:"psk,omitempty"`
+	}{
+		Nqn:            subsystem.Nqn,
+		Host:           host.NQN,
+		DHCHAPKey:      host.DHCHAPKey.name(),
+		DHCHAPCtrlrKey: host.DHCHAPCtrlKey.name(),
+		PSK:            host.PSK.name(),
+	}
+	err := node.client.call(ctx, "nvmf_subsystem_add_host", &params, nil)
+	if err != nil {
+		return err
+	}
+	klog.V(5).Infof("host %s allowed to access %s, DH-HMAC-CHAP: %v, TLS: %v",
+		host.NQN, subsystem.Nqn, host.DHCHAPKey != nil, host.PSK != nil)
+	return nil
+}
+
+// DisallowHost removes the host from NVMf subsystem of the volume, it's not an
+// error if the volume is not published
+func (node *nodeNVMf) DisallowHost(ctx context.Context, lvolID string, host *HostAccess) error {
+	subsystem, err := node.getSubsystem(ctx, lvolID)
+	if errors.Is(err, ErrVolumeUnpublished) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	hostNQN := host.nqn()
+	for i := range subsystem.Hosts {
+		if hostNQN == "" || subsystem.Hosts[i].Nqn == hostNQN {
+			err = node.subsystemRemoveHost(ctx, subsystem.Nqn, subsystem.Hosts[i].Nqn)
+			if err != nil {
+				return err
+			}
+			klog.V(5).Infof("host %s disallowed to access volume %s", subsystem.Hosts[i].Nqn, lvolID)
+		}
+	}
+	if hostNQN == "" && subsystem.AllowAnyHost {
+		return node.subsystemAllowAnyHost(ctx, lvolID, false)
+	}
+	return nil
+}
+
+// RemoveUnusedKeys removes keys named with prefix from spdk keyring if neither
+// a host of NVMf subsystems nor anything else holds them. Keys are kept if spdk
+// doesn't report their reference count.
+func (node *nodeNVMf) RemoveUnusedKeys(ctx context.Context, prefix string) ([]KeyringKey, error) {
+	keys, err := node.client.keyringKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var subsystems []nvmfSubsystem
+	err = node.client.call(ctx, "nvmf_get_subsystems", nil, &subsystems)
+	if err != nil {
+		return nil, err
+	}
+	used := usedKeyringKeys(subsystems)
+
+	var removed []KeyringKey
+	for i := range keys {
+		key := &keys[i]
+		// the keyring holds one reference itself
+		if !strings.HasPrefix(key.Name, prefix) || used[key.Name] || key.RefCnt == nil || *key.RefCnt > 1 {
+			continue
+		}
+		if err = node.client.removeKeyringKey(ctx, key.Name); err != nil {
+			return removed, err
+		}
+		klog.V(5).Infof("unused key %s removed from keyring", key.Name)
+		removed = append(removed, KeyringKey{Name: key.Name, Path: key.Path})
+	}
+	return removed, nil
+}
+
+func usedKeyringKeys(subsystems []nvmfSubsystem) map[string]bool {
+	used := make(map[string]bool)
+	for i := range subsystems {
+		for _, host := range subsystems[i].Hosts {
+			used[host.DHCHAPKey] = true
+			used[host.DHCHAPCtrlrKey] = true
+			used[host.PSK] = true
+		}
+	}
+	return used
+}
+
+// PublishVolume exports a volume through NVMf target, the listener requires TLS
+// if secure channel is enabled in opts
+func (node *nodeNVMf) PublishVolume(ctx context.Context, lvolID string, opts *PublishOptions) error {
+	secure, err := node.checkPublishOptions(ctx, opts)
+	if err != nil {
+		return err
+	}
+	exists, err := node.isVolumeCreated(ctx, lvolID)
 	if err != nil {
 		return err
 	}
 	if !exists {
 		return ErrVolumeDeleted
 	}
-	published, err := node.isVolumePublished(lvolID)
+	published, err := node.isVolumePublished(ctx, lvolID)
 	if err != nil {
 		return err
 	}
@@ -168,75 +457,103 @@ func (node *nodeNVMf) PublishVolume(lvolID string) error {
 		return nil
 	}
 
-	err = node.createTransport()
+	err = node.createTransport(ctx)
 	if err != nil {
 		return err
 	}
 
-	err = node.createSubsystem(lvolID)
+	err = node.createSubsystem(ctx, lvolID)
 	if err != nil {
 		return err
 	}
 
-	_, err = node.subsystemAddNs(lvolID)
+	_, err = node.subsystemAddNs(ctx, lvolID)
 	if err != nil {
-		node.deleteSubsystem(lvolID) //nolint:errcheck // we can do few
+		node.deleteSubsystem(ctx, lvolID) //nolint:errcheck // we can do few
 		return err
 	}
 
-	err = node.subsystemAddListener(lvolID)
+	err = node.subsystemAddListener(ctx, lvolID, secure)
 	if err != nil {
-		node.subsystemRemoveNs(lvolID) //nolint:errcheck // ditto
-		node.deleteSubsystem(lvolID)   //nolint:errcheck // ditto
+		node.subsystemRemoveNs(ctx, lvolID) //nolint:errcheck // ditto
+		node.deleteSubsystem(ctx, lvolID)   //nolint:errcheck // ditto
 		return err
 	}
 
-	klog.V(5).Infof("volume published: %s", lvolID)
+	klog.V(5).Infof("volume published: %s, secure channel: %v", lvolID, secure)
 	return nil
 }
 
-func (node *nodeNVMf) isVolumePublished(lvolID string) (bool, error) {
+// checkPublishOptions returns if secure channel is enabled, and checks it's
+// supported by the target
+func (node *nodeNVMf) checkPublishOptions(ctx context.Context, opts *PublishOptions) (bool, error) {
+	if opts == nil || !opts.SecureChannel {
+		return false, nil
+	}
+	// spdk only supports TLS on TCP transport, with the ssl sock implementation
+	if node.targetType != "TCP" {
+		return false, fmt.Errorf("secure channel is not supported by %s transport", node.targetType)
+	}
+	params := struct {
+		ImplName string `json:"impl_name"`
+	}{
+		ImplName: "ssl",
+	}
+	err := node.client.call(ctx, "sock_impl_get_options", &params, nil)
+	if errors.Is(err, ErrInvalidParameters) {
+		return false, fmt.Errorf("secure channel is not supported by spdk target: no ssl sock implementation")
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (node *nodeNVMf) isVolumePublished(ctx context.Context, lvolID string) (bool, error) {
+	listener, err := node.getListener(ctx, lvolID)
+	return listener != nil, err
+}
+
+// getListener returns the plain or TLS listener of the volume created by
+// PublishVolume, nil if the volume is not published
+func (node *nodeNVMf) getListener(ctx context.Context, lvolID string) (*nvmfListener, error) {
 	var result []struct {
-		Address struct {
-			TrType  string `json:"trtype"`
-			AdrFam  string `json:"adrfam"`
-			TrAddr  string `json:"traddr"`
-			TrSvcID string `json:"trsvcid"`
-		} `json:"address"`
+		Address nvmfListener `json:"address"`
 	}
 	params := struct {
 		Nqn string `json:"nqn"`
 	}{
 		Nqn: node.getVolumeNqn(lvolID),
 	}
-	err := node.client.call("nvmf_subsystem_get_listeners", &params, &result)
+	err := node.client.call(ctx, "nvmf_subsystem_get_listeners", &params, &result)
 	if err != nil {
 		// querying nqn that does not exist, an invalid parameters error will be thrown
-		if errorMatches(err, ErrInvalidParameters) {
-			return false, nil
+		if errors.Is(err, ErrInvalidParameters) {
+			return nil, nil
 		}
-		return false, err
+		return nil, err
 	}
 	for i := range result {
-		if result[i].Address.TrType == node.targetType &&
-			result[i].Address.TrAddr == node.targetAddr &&
-			result[i].Address.TrSvcID == node.targetPort &&
-			result[i].Address.AdrFam == cfgAddrFamily {
-			return true, nil
+		address := &result[i].Address
+		if address.TrType == node.targetType &&
+			address.TrAddr == node.targetAddr &&
+			(address.TrSvcID == node.targetPort || address.TrSvcID == node.securePort) &&
+			address.AdrFam == cfgAddrFamily {
+			return address, nil
 		}
 	}
-	return false, nil
+	return nil, nil
 }
 
-func (node *nodeNVMf) UnpublishVolume(lvolID string) error {
-	exists, err := node.isVolumeCreated(lvolID)
+func (node *nodeNVMf) UnpublishVolume(ctx context.Context, lvolID string) error {
+	exists, err := node.isVolumeCreated(ctx, lvolID)
 	if err != nil {
 		return err
 	}
 	if !exists {
 		return ErrVolumeDeleted
 	}
-	published, err := node.isVolumePublished(lvolID)
+	published, err := node.isVolumePublished(ctx, lvolID)
 	if err != nil {
 		return err
 	}
@@ -244,12 +561,12 @@ func (node *nodeNVMf) UnpublishVolume(lvolID string) error {
 		// already unpublished
 		return nil
 	}
-	err = node.subsystemRemoveNs(lvolID)
+	err = node.subsystemRemoveNs(ctx, lvolID)
 	if err != nil {
 		// we should try deleting subsystem even if we fail here
 		klog.Errorf("failed to remove namespace(nqn=%s): %s", node.getVolumeNqn(lvolID), err)
 	}
-	err = node.deleteSubsystem(lvolID)
+	err = node.deleteSubsystem(ctx, lvolID)
 	if err != nil {
 		return err
 	}
@@ -262,10 +579,10 @@ func (node *nodeNVMf) getVolumeModel(lvolID string) string {
 }
 
 func (node *nodeNVMf) getVolumeNqn(lvolID string) string {
-	return "nqn.2020-04.io.spdk.csi:uuid:" + node.getVolumeModel(lvolID)
+	return nvmfNqnPrefix + node.getVolumeModel(lvolID)
 }
 
-func (node *nodeNVMf) createSubsystem(lvolID string) error {
+func (node *nodeNVMf) createSubsystem(ctx context.Context, lvolID string) error {
 	params := struct {
 		Nqn          string `json:"nqn"`
 		AllowAnyHost bool   `json:"allow_any_host"`
@@ -278,10 +595,48 @@ func (node *nodeNVMf) createSubsystem(lvolID string) error {
 		ModelNumber:  node.getVolumeModel(lvolID), // client matches imported disk with model string
 	}
 
-	return node.client.call("nvmf_create_subsystem", &params, nil)
+	return node.client.call(ctx, "nvmf_create_subsystem", &params, nil)
+}
+
+// getSubsystem returns ErrVolumeUnpublished if the volume is not published
+func (node *nodeNVMf) getSubsystem(ctx context.Context, lvolID string) (*nvmfSubsystem, error) {
+	var results []nvmfSubsystem
+	err := node.client.call(ctx, "nvmf_get_subsystems", nil, &results)
+	if err != nil {
+		return nil, err
+	}
+	nqn := node.getVolumeNqn(lvolID)
+	for i := range results {
+		if results[i].Nqn == nqn {
+			return &results[i], nil
+		}
+	}
+	return nil, ErrVolumeUnpublished
 }
 
-func (node *nodeNVMf) subsystemAddNs(lvolID string) (int, error) {
+func (node *nodeNVMf) subsystemAllowAnyHost(ctx context.Context, lvolID string, allowAnyHost bool) error {
+	params := struct {
+		Nqn          string `json:"nqn"`
+		AllowAnyHost bool   `json:"allow_any_host"`
+	}{
+		Nqn:          node.getVolumeNqn(lvolID),
+		AllowAnyHost: allowAnyHost,
+	}
+	return node.client.call(ctx, "nvmf_subsystem_allow_any_host", &params, nil)
+}
+
+func (node *nodeNVMf) subsystemRemoveHost(ctx context.Context, nqn, hostNQN string) error {
+	params := struct {
+		Nqn  string `json:"nqn"`
+		Host string `json:"host"`
+	}{
+		Nqn:  nqn,
+		Host: hostNQN,
+	}
+	return node.client.call(ctx, "nvmf_subsystem_remove_host", &params, nil)
+}
+
+func (node *nodeNVMf) subsystemAddNs(ctx context.Context, lvolID string) (int, error) {
 	type namespace struct {
 		BdevName string `json:"bdev_name"`
 	}
@@ -296,11 +651,11 @@ func (node *nodeNVMf) subsystemAddNs(lvolID string) (int, error) {
 		},
 	}
 	var nsID int
-	err := node.client.call("nvmf_subsystem_add_ns", &params, &nsID)
+	err := node.client.call(ctx, "nvmf_subsystem_add_ns", &params, &nsID)
 	return nsID, err
 }
 
-func (node *nodeNVMf) subsystemGetNsID(lvolID string) (int, error) {
+func (node *nodeNVMf) subsystemGetNsID(ctx context.Context, lvolID string) (int, error) {
 	var results []struct {
 		Nqn       string `json:"nqn"`
 		Namespace []struct {
@@ -308,7 +663,7 @@ func (node *nodeNVMf) subsystemGetNsID(lvolID string) (int, error) {
 			BdevName string `json:"bdev_name"`
 		} `json:"namespaces"`
 	}
-	err := node.client.call("nvmf_get_subsystems", nil, &results)
+	err := node.client.call(ctx, "nvmf_get_subsystems", nil, &results)
 	if err != nil {
 		return 0, err
 	}
@@ -326,32 +681,32 @@ func (node *nodeNVMf) subsystemGetNsID(lvolID string) (int, error) {
 	return 0, fmt.Errorf("no such namespace")
 }
 
-func (node *nodeNVMf) subsystemAddListener(lvolID string) error {
-	type listenAddress struct {
-		TrType  string `json:"trtype"`
-		AdrFam  string `json:"adrfam"`
-		TrAddr  string `json:"traddr"`
-		TrSvcID string `json:"trsvcid"`
-	}
-
+// subsystemAddListener adds a plain listener, or a TLS listener on securePort
+// if secure is true
+func (node *nodeNVMf) subsystemAddListener(ctx context.Context, lvolID string, secure bool) error {
 	params := struct {
-		Nqn           string        `json:"nqn"`
-		ListenAddress listenAddress `json:"listen_address"`
+		Nqn           string       `json:"nqn"`
+		ListenAddress nvmfListener `json:"listen_address"`
+		SecureChannel bool         `json:"secure_channel,omitempty"`
 	}{
 		Nqn: node.getVolumeNqn(lvolID),
-		ListenAddress: listenAddress{
+		ListenAddress: nvmfListener{
 			TrType:  node.targetType,
 			TrAddr:  node.targetAddr,
 			TrSvcID: node.targetPort,
 			AdrFam:  cfgAddrFamily,
 		},
+		SecureChannel: secure,
+	}
+	if secure {
+		params.ListenAddress.TrSvcID = node.securePort
 	}
 
-	return node.client.call("nvmf_subsystem_add_listener", &params, nil)
+	return node.client.call(ctx, "nvmf_subsystem_add_listener", &params, nil)
 }
 
-func (node *nodeNVMf) subsystemRemoveNs(lvolID string) error {
-	nsID, err := node.subsystemGetNsID(lvolID)
+func (node *nodeNVMf) subsystemRemoveNs(ctx context.Context, lvolID string) error {
+	nsID, err := node.subsystemGetNsID(ctx, lvolID)
 	if err != nil {
 		return err
 	}
@@ -363,20 +718,20 @@ func (node *nodeNVMf) subsystemRemoveNs(lvolID string) error {
 		Nqn:  node.getVolumeNqn(lvolID),
 		NsID: nsID,
 	}
-	return node.client.call("nvmf_subsystem_remove_ns", &params, nil)
+	return node.client.call(ctx, "nvmf_subsystem_remove_ns", &params, nil)
 }
 
-func (node *nodeNVMf) deleteSubsystem(lvolID string) error {
+func (node *nodeNVMf) deleteSubsystem(ctx context.Context, lvolID string) error {
 	params := struct {
 		Nqn string `json:"nqn"`
 	}{
 		Nqn: node.getVolumeNqn(lvolID),
 	}
 
-	return node.client.call("nvmf_delete_subsystem", &params, nil)
+	return node.client.call(ctx, "nvmf_delete_subsystem", &params, nil)
 }
 
-func (node *nodeNVMf) createTransport() error {
+func (node *nodeNVMf) createTransport(ctx context.Context) error {
 	// concurrent requests can happen despite this fast path check
 	if atomic.LoadInt32(&node.transCreated) != 0 {
 		return nil
@@ -389,15 +744,37 @@ func (node *nodeNVMf) createTransport() error {
 		TrType: node.targetType,
 	}
 
-	err := node.client.call("nvmf_create_transport", &params, nil)
-
+	err := node.client.call(ctx, "nvmf_create_transport", &params, nil)
 	if err == nil {
 		klog.V(5).Infof("Transport created: %s,%s", node.targetAddr, node.targetType)
 		atomic.StoreInt32(&node.transCreated, 1)
-	} else if strings.Contains(err.Error(), "already exists") {
-		err = nil // ignore transport already exists error
-		atomic.StoreInt32(&node.transCreated, 1)
+		return nil
+	}
+
+	// spdk fails with invalid parameters error if the transport already exists,
+	// e.g, created by concurrent calls or before the driver starts, check it again
+	if errors.Is(err, ErrInvalidParameters) || errors.Is(err, ErrJSONAlreadyExists) {
+		if exists, err2 := node.transportExists(ctx); err2 == nil && exists {
+			atomic.StoreInt32(&node.transCreated, 1)
+			return nil
+		}
 	}
 
 	return err
 }
+
+func (node *nodeNVMf) transportExists(ctx context.Context) (bool, error) {
+	var results []struct {
+		TrType string `json:"trtype"`
+	}
+	err := node.client.call(ctx, "nvmf_get_transports", nil, &results)
+	if err != nil {
+		return false, err
+	}
+	for i := range results {
+		if strings.EqualFold(results[i].TrType, node.targetType) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -26,7 +26,11 @@ limitations under the License.
 package util
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 )
 
@@ -35,6 +39,7 @@ const (
 	rpcUser = "spdkcsiuser"
 	rpcPass = "spdkcsipass"
 	trAddr  = "127.0.0.1"
+	hostNQN = "nqn.2014-08.org.nvmexpress:uuid:5d2f2a3c-0d4b-4a8e-9a41-6f3c7e1b2a10"
 )
 
 func TestNVMeTCP(t *testing.T) {
@@ -43,7 +48,7 @@ func TestNVMeTCP(t *testing.T) {
 
 //nolint:cyclop // testNVMeoF exceeds cyclomatic complexity of 10
 func testNVMeoF(trType string, t *testing.T) {
-	nodeIx, err := NewSpdkNode(rpcURL, rpcUser, rpcPass, trType, trAddr)
+	nodeIx, err := NewSpdkNode(rpcURL, rpcUser, rpcPass, trType, trAddr, nil)
 	if err != nil {
 		t.Fatalf("NewSpdkNode: %s", err)
 	}
@@ -53,7 +58,7 @@ func testNVMeoF(trType string, t *testing.T) {
 		t.Fatal("cannot cast to nodeNVMf")
 	}
 
-	lvs, err := node.LvStores()
+	lvs, err := node.LvStores(context.TODO())
 	if err != nil {
 		t.Fatalf("LvStores: %s", err)
 	}
@@ -64,7 +69,7 @@ func testNVMeoF(trType string, t *testing.T) {
 		t.Fatalf("No free space: %s", lvs[0].Name)
 	}
 
-	lvolID, err := node.CreateVolume("lvol0", lvs[0].Name, lvs[0].FreeSizeMiB)
+	lvolID, err := node.CreateVolume(context.TODO(), "lvol0", lvs[0].Name, lvs[0].FreeSizeMiB/2, &LvolOptions{ThinProvision: true, ClearMethod: "unmap"})
 	if err != nil {
 		t.Fatalf("CreateVolume: %s", err)
 	}
@@ -73,7 +78,16 @@ func testNVMeoF(trType string, t *testing.T) {
 		t.Fatalf("validateVolumeCreated: %s", err)
 	}
 
-	err = node.PublishVolume(lvolID)
+	err = node.ResizeVolume(context.TODO(), lvolID, lvs[0].FreeSizeMiB)
+	if err != nil {
+		t.Fatalf("ResizeVolume: %s", err)
+	}
+	err = validateVolumeResized(node, lvolID, lvs[0].FreeSizeMiB)
+	if err != nil {
+		t.Fatalf("validateVolumeResized: %s", err)
+	}
+
+	err = node.PublishVolume(context.TODO(), lvolID, &PublishOptions{})
 	if err != nil {
 		t.Fatalf("PublishVolume: %s", err)
 	}
@@ -82,10 +96,31 @@ func testNVMeoF(trType string, t *testing.T) {
 	if err != nil {
 		t.Fatalf("validateVolumePublished: %s", err)
 	}
+	err = validateVolumeListed(node, lvolID)
+	if err != nil {
+		t.Fatalf("validateVolumeListed: %s", err)
+	}
+
+	err = node.AllowHost(context.TODO(), lvolID, &HostAccess{NQN: hostNQN})
+	if err != nil {
+		t.Fatalf("AllowHost: %s", err)
+	}
+	err = validateHostAllowed(node, lvolID, hostNQN, true)
+	if err != nil {
+		t.Fatalf("validateHostAllowed: %s", err)
+	}
+	err = node.DisallowHost(context.TODO(), lvolID, &HostAccess{NQN: hostNQN})
+	if err != nil {
+		t.Fatalf("DisallowHost: %s", err)
+	}
+	err = validateHostAllowed(node, lvolID, hostNQN, false)
+	if err != nil {
+		t.Fatalf("validateHostDisallowed: %s", err)
+	}
 
 	snapshotName := "snapshot-pvc"
 	var snapshotID string
-	snapshotID, err = node.CreateSnapshot(lvolID, snapshotName)
+	snapshotID, err = node.CreateSnapshot(context.TODO(), lvolID, snapshotName)
 	if err != nil {
 		t.Fatalf("CreateSnapshot: %s", err)
 	}
@@ -94,7 +129,7 @@ func testNVMeoF(trType string, t *testing.T) {
 		t.Fatalf("validateCreateSnapshot: %s", err)
 	}
 
-	err = node.DeleteVolume(snapshotID)
+	err = node.DeleteVolume(context.TODO(), snapshotID)
 	if err != nil {
 		t.Fatalf("DeleteSnapshot: %s", err)
 	}
@@ -103,7 +138,7 @@ func testNVMeoF(trType string, t *testing.T) {
 		t.Fatalf("validateSnapshotDeleted: %s", err)
 	}
 
-	err = node.UnpublishVolume(lvolID)
+	err = node.UnpublishVolume(context.TODO(), lvolID)
 	if err != nil {
 		t.Fatalf("UnpublishVolume: %s", err)
 	}
@@ -112,7 +147,7 @@ func testNVMeoF(trType string, t *testing.T) {
 		t.Fatalf("validateVolumeUnpublished: %s", err)
 	}
 
-	err = node.DeleteVolume(lvolID)
+	err = node.DeleteVolume(context.TODO(), lvolID)
 	if err != nil {
 		t.Fatalf("DeleteVolume: %s", err)
 	}
@@ -123,7 +158,7 @@ func testNVMeoF(trType string, t *testing.T) {
 }
 
 func validateVolumeCreated(node *nodeNVMf, lvolID string) error {
-	created, err := node.isVolumeCreated(lvolID)
+	created, err := node.isVolumeCreated(context.TODO(), lvolID)
 	if err != nil {
 		return err
 	}
@@ -133,8 +168,49 @@ func validateVolumeCreated(node *nodeNVMf, lvolID string) error {
 	return nil
 }
 
+func validateVolumeListed(node *nodeNVMf, lvolID string) error {
+	lvols, err := node.ListVolumes(context.TODO())
+	if err != nil {
+		return err
+	}
+	for i := range lvols {
+		if lvols[i].UUID == lvolID {
+			if !lvols[i].Published {
+				return fmt.Errorf("volume listed but not published: %s", lvolID)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("volume not listed: %s", lvolID)
+}
+
+func validateHostAllowed(node *nodeNVMf, lvolID, hostNQN string, allowed bool) error {
+	subsystem, err := node.getSubsystem(context.TODO(), lvolID)
+	if err != nil {
+		return err
+	}
+	if subsystem.AllowAnyHost {
+		return fmt.Errorf("any host allowed: %s", lvolID)
+	}
+	if subsystem.hasHost(hostNQN) != allowed {
+		return fmt.Errorf("host %s allowed: %v, expected: %v", hostNQN, !allowed, allowed)
+	}
+	return nil
+}
+
+func validateVolumeResized(node *nodeNVMf, lvolID string, sizeMiB int64) error {
+	lvol, err := node.client.getVolume(context.TODO(), lvolID)
+	if err != nil {
+		return err
+	}
+	if lvol.BlockSize*lvol.NumBlocks < sizeMiB*1024*1024 {
+		return fmt.Errorf("volume not resized: %s", lvolID)
+	}
+	return nil
+}
+
 func validateVolumePublished(node *nodeNVMf, lvolID string) error {
-	published, err := node.isVolumePublished(lvolID)
+	published, err := node.isVolumePublished(context.TODO(), lvolID)
 	if err != nil {
 		return err
 	}
@@ -157,3 +233,79 @@ func validateVolumeUnpublished(node *nodeNVMf, lvolID string) error {
 	}
 	return nil
 }
+
+// keys are removed by a fake spdk reporting keys like keyring_get_keys
+func TestNVMfRemoveUnusedKeys(t *testing.T) {
+	var removed []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			ID     int32             `json:"id"`
+			Method string            `json:"method"`
+			Params map[string]string `json:"params"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var result interface{}
+		switch request.Method {
+		case "keyring_get_keys":
+			result = []map[string]interface{}{
+				{"name": "spdkcsi-used", "path": "/keys/spdkcsi-used", "refcnt": 2},
+				{"name": "spdkcsi-listed", "path": "/keys/spdkcsi-listed", "refcnt": 1},
+				{"name": "spdkcsi-unused", "path": "/keys/spdkcsi-unused", "refcnt": 1},
+				{"name": "spdkcsi-unknown", "path": "/keys/spdkcsi-unknown"},
+				{"name": "other", "path": "/keys/other", "refcnt": 1},
+			}
+		case "nvmf_get_subsystems":
+			result = []map[string]interface{}{{
+				"nqn":   "nqn.2020-04.io.spdk.csi:uuid:lvol",
+				"hosts": []map[string]string{{"nqn": hostNQN, "dhchap_key": "spdkcsi-listed"}},
+			}}
+		case "keyring_file_remove_key":
+			removed = append(removed, request.Params["name"])
+			result = true
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": request.ID, "result": result}) //nolint:errcheck // test server
+	}))
+	defer server.Close()
+
+	node, err := NewSpdkNode(server.URL, rpcUser, rpcPass, "nvme-tcp", trAddr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := node.RemoveUnusedKeys(context.TODO(), "spdkcsi-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Name != "spdkcsi-unused" || keys[0].Path != "/keys/spdkcsi-unused" ||
+		len(removed) != 1 || removed[0] != "spdkcsi-unused" {
+		t.Fatalf("unexpected removed keys: %v %v", keys, removed)
+	}
+}
+
+// deleting a subsystem that does not exist fails like spdk with invalid parameters
+func TestNVMfDeleteExport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			ID int32 `json:"id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{ //nolint:errcheck // test server
+			"id":    request.ID,
+			"error": map[string]interface{}{"code": -32602, "message": "Invalid parameters"},
+		})
+	}))
+	defer server.Close()
+
+	node, err := NewSpdkNode(server.URL, rpcUser, rpcPass, "nvme-tcp", trAddr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = node.DeleteExport(context.TODO(), "deleted"); err != nil {
+		t.Fatalf("deleted export should not fail: %s", err)
+	}
+}
@@ -0,0 +1,117 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// RPCTLSConfig TLS settings of https rpcURL, see deploy/kubernetes/config-map.yaml
+//
+//nolint:tagliatelle // not using json:snake case
+type RPCTLSConfig struct {
+	CAFile             string `json:"caFile,omitempty"`     // CA bundle to verify spdk server, system CAs if not set
+	CertFile           string `json:"certFile,omitempty"`   // client certificate for mutual TLS
+	KeyFile            string `json:"keyFile,omitempty"`    // client private key for mutual TLS
+	ServerName         string `json:"serverName,omitempty"` // overrides host name in rpcURL to verify server certificate
+	InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty"`
+}
+
+// NewRPCTLSConfig builds TLS config of the json rpc client, nil if nothing is configured.
+// PEM encoded certificates from secrets take precedence over files in config.
+// Files and secrets are loaded on each call, rotated certificates are used once
+// the spdk node is created again, which happens per CSI request.
+func NewRPCTLSConfig(cfg *RPCTLSConfig, caPEM, certPEM, keyPEM string) (*tls.Config, error) {
+	if cfg == nil {
+		cfg = &RPCTLSConfig{}
+	}
+	if *cfg == (RPCTLSConfig{}) && caPEM == "" && certPEM == "" && keyPEM == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify, //nolint:gosec // explicitly configured by user
+	}
+
+	rootCAs, err := loadRootCAs(caPEM, cfg.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.RootCAs = rootCAs
+	certificates, err := loadClientCertificates(certPEM, keyPEM, cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.Certificates = certificates
+
+	return tlsConfig, nil
+}
+
+// nil to use system CAs
+func loadRootCAs(caPEM, caFile string) (*x509.CertPool, error) {
+	ca, err := pemOrFile(caPEM, caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load CA: %w", err)
+	}
+	if ca == nil {
+		return nil, nil
+	}
+	rootCAs := x509.NewCertPool()
+	if !rootCAs.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no valid CA certificate found")
+	}
+	return rootCAs, nil
+}
+
+// nil if mutual TLS is not configured
+func loadClientCertificates(certPEM, keyPEM, certFile, keyFile string) ([]tls.Certificate, error) {
+	cert, err := pemOrFile(certPEM, certFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load client certificate: %w", err)
+	}
+	key, err := pemOrFile(keyPEM, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load client key: %w", err)
+	}
+	if (cert == nil) != (key == nil) {
+		return nil, fmt.Errorf("client certificate and key must be set together")
+	}
+	if cert == nil {
+		return nil, nil
+	}
+	keyPair, err := tls.X509KeyPair(cert, key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client certificate: %w", err)
+	}
+	return []tls.Certificate{keyPair}, nil
+}
+
+// return PEM if not empty, or read from file, nil if neither is set
+func pemOrFile(pem, file string) ([]byte, error) {
+	if pem != "" {
+		return []byte(pem), nil
+	}
+	if file == "" {
+		return nil, nil
+	}
+	return os.ReadFile(file)
+}
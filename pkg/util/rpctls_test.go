@@ -0,0 +1,174 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM string
+	keyPEM  string
+}
+
+// issue a certificate signed by parent, self signed CA if parent is nil
+func newTestCert(t *testing.T, name string, parent *testCert, usage x509.ExtKeyUsage) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	signerCert, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signerCert, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signerCert, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		keyPEM:  string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+	}
+}
+
+func TestRPCMutualTLS(t *testing.T) {
+	ca := newTestCert(t, "spdk-ca", nil, x509.ExtKeyUsageAny)
+	serverCert := newTestCert(t, "spdk.example.com", ca, x509.ExtKeyUsageServerAuth)
+	clientCert := newTestCert(t, "spdkcsi", ca, x509.ExtKeyUsageClientAuth)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			ID int32 `json:"id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": request.ID, "result": true}) //nolint:errcheck // test server
+	}))
+	keyPair, err := tls.X509KeyPair([]byte(serverCert.certPEM), []byte(serverCert.keyPEM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	server.TLS = &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{keyPair},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	// client certificate from files, CA from secret
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	if err := os.WriteFile(certFile, []byte(clientCert.certPEM), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, []byte(clientCert.keyPEM), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &RPCTLSConfig{CertFile: certFile, KeyFile: keyFile, ServerName: "spdk.example.com"}
+
+	cases := []struct {
+		name    string
+		cfg     *RPCTLSConfig
+		caPEM   string
+		success bool
+	}{
+		{"mutual tls", cfg, ca.certPEM, true},
+		{"untrusted server", cfg, "", false},
+		{"no client certificate", &RPCTLSConfig{ServerName: "spdk.example.com"}, ca.certPEM, false},
+		{"server name mismatch", &RPCTLSConfig{CertFile: certFile, KeyFile: keyFile}, ca.certPEM, false},
+	}
+	for _, c := range cases {
+		tlsConfig, err := NewRPCTLSConfig(c.cfg, c.caPEM, "", "")
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		transport, err := newRPCTransport(server.URL, "user", "pass", tlsConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := &rpcClient{rpcURL: server.URL, transport: transport}
+		var result bool
+		err = client.call(context.TODO(), "spdk_get_version", nil, &result)
+		if (err == nil) != c.success {
+			t.Fatalf("%s: success should be %v, err: %v", c.name, c.success, err)
+		}
+	}
+}
+
+func TestRPCTLSConfig(t *testing.T) {
+	tlsConfig, err := NewRPCTLSConfig(nil, "", "", "")
+	if err != nil || tlsConfig != nil {
+		t.Fatal("tls config should be nil if not configured")
+	}
+	if _, err = NewRPCTLSConfig(nil, "invalid", "", ""); err == nil {
+		t.Fatal("invalid CA should fail")
+	}
+	cert := newTestCert(t, "spdkcsi", nil, x509.ExtKeyUsageClientAuth)
+	if _, err = NewRPCTLSConfig(nil, "", cert.certPEM, ""); err == nil {
+		t.Fatal("client certificate without key should fail")
+	}
+	if _, err = NewRPCTLSConfig(&RPCTLSConfig{CAFile: "/nonexistent/ca.crt"}, "", "", ""); err == nil {
+		t.Fatal("missing CA file should fail")
+	}
+}
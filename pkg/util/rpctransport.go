@@ -0,0 +1,167 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// rpcTransport sends a json rpc request to spdk and hands the response stream
+// to decode, which reads exactly one json response from it
+//   - http(s)://: json rpc http proxy(scripts/rpc_http_proxy.py) with basic auth,
+//     https verifies server and presents client certificate per tlsConfig
+//   - unix://: spdk rpc server listening on unix domain socket, e.g, unix:///var/tmp/spdk.sock
+//   - tcp://: spdk rpc server listening on tcp socket, e.g, tcp://127.0.0.1:5260
+type rpcTransport interface {
+	send(ctx context.Context, request []byte, decode func(io.Reader) error) error
+}
+
+func newRPCTransport(rpcURL, rpcUser, rpcPass string, tlsConfig *tls.Config) (rpcTransport, error) {
+	u, err := url.Parse(rpcURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rpc url %s: %w", rpcURL, err)
+	}
+	timeout := cfgRPCTimeoutSeconds * time.Second
+
+	switch u.Scheme {
+	case "http":
+		return &httpTransport{
+			rpcURL:     rpcURL,
+			rpcUser:    rpcUser,
+			rpcPass:    rpcPass,
+			httpClient: &http.Client{Timeout: timeout},
+		}, nil
+	case "https":
+		httpClient := &http.Client{Timeout: timeout}
+		if tlsConfig != nil {
+			// transport is created per spdk node, don't keep idle connections around
+			httpClient.Transport = &http.Transport{
+				Proxy:             http.ProxyFromEnvironment,
+				TLSClientConfig:   tlsConfig,
+				DisableKeepAlives: true,
+			}
+		}
+		return &httpTransport{
+			rpcURL:     rpcURL,
+			rpcUser:    rpcUser,
+			rpcPass:    rpcPass,
+			httpClient: httpClient,
+		}, nil
+	case "unix":
+		// unix:///var/tmp/spdk.sock, host is empty
+		// unix://var/tmp/spdk.sock, relative path is parsed as host "var" and path "/tmp/spdk.sock"
+		return &socketTransport{network: "unix", address: u.Host + u.Path, timeout: timeout}, nil
+	case "tcp":
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid rpc url %s: missing host", rpcURL)
+		}
+		return &socketTransport{network: "tcp", address: u.Host, timeout: timeout}, nil
+	default:
+		return nil, fmt.Errorf("invalid rpc url %s: unsupported scheme %q", rpcURL, u.Scheme)
+	}
+}
+
+type httpTransport struct {
+	rpcURL     string
+	rpcUser    string
+	rpcPass    string
+	httpClient *http.Client
+}
+
+// httpStatusError is returned if http proxy responds with error status code
+type httpStatusError struct {
+	code int
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("HTTP error code: %d", e.code)
+}
+
+func (t *httpTransport) send(ctx context.Context, request []byte, decode func(io.Reader) error) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.rpcURL, bytes.NewReader(request))
+	if err != nil {
+		return err
+	}
+
+	req.SetBasicAuth(t.rpcUser, t.rpcPass)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := t.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return &httpStatusError{code: resp.StatusCode}
+	}
+	return decode(resp.Body)
+}
+
+// socketTransport speaks json rpc directly to spdk rpc server. Responses are not
+// delimited in the stream, one connection is used per request, so responses of
+// concurrent requests are never interleaved.
+type socketTransport struct {
+	network string
+	address string
+	timeout time.Duration
+}
+
+func (t *socketTransport) send(ctx context.Context, request []byte, decode func(io.Reader) error) error {
+	dialer := net.Dialer{Timeout: t.timeout}
+	conn, err := dialer.DialContext(ctx, t.network, t.address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(t.timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	err = conn.SetDeadline(deadline)
+	if err != nil {
+		return err
+	}
+	// unblock pending read/write if request is cancelled
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now()) //nolint:errcheck // conn is being closed
+		case <-done:
+		}
+	}()
+
+	_, err = conn.Write(request)
+	if err == nil {
+		err = decode(conn)
+	}
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,205 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fake spdk rpc server, replies method name of each request as result
+func serveFakeRPC(t *testing.T, listener net.Listener) {
+	t.Helper()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			var request struct {
+				ID     int32  `json:"id"`
+				Method string `json:"method"`
+			}
+			if err := json.NewDecoder(conn).Decode(&request); err != nil {
+				t.Errorf("failed to decode request: %s", err)
+				return
+			}
+			response := map[string]interface{}{"jsonrpc": "2.0", "id": request.ID}
+			if request.Method == "fail" {
+				response["error"] = map[string]interface{}{"code": -19, "message": "No such device"}
+			} else {
+				response["result"] = request.Method
+			}
+			// response is written in pieces, decoder must not stop at the first read
+			data, _ := json.Marshal(response) //nolint:errcheck // marshal of map never fails
+			for len(data) > 0 {
+				n := 7
+				if n > len(data) {
+					n = len(data)
+				}
+				if _, err := conn.Write(data[:n]); err != nil {
+					return
+				}
+				data = data[n:]
+			}
+		}(conn)
+	}
+}
+
+func TestSocketTransport(t *testing.T) {
+	sockPath := filepath.Join(t.TempDir(), "spdk.sock")
+	unixListener, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixListener.Close()
+	go serveFakeRPC(t, unixListener)
+
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpListener.Close()
+	go serveFakeRPC(t, tcpListener)
+
+	for _, rpcURL := range []string{"unix://" + sockPath, "tcp://" + tcpListener.Addr().String()} {
+		transport, err := newRPCTransport(rpcURL, "", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := &rpcClient{rpcURL: rpcURL, transport: transport}
+
+		var wg sync.WaitGroup
+		for _, method := range []string{"bdev_get_bdevs", "bdev_lvol_get_lvstores", "nvmf_get_subsystems"} {
+			wg.Add(1)
+			go func(method string) {
+				defer wg.Done()
+				var result string
+				if err := client.call(context.TODO(), method, nil, &result); err != nil {
+					t.Errorf("%s: %s", rpcURL, err)
+				} else if result != method {
+					t.Errorf("%s: expected result %s, got %s", rpcURL, method, result)
+				}
+			}(method)
+		}
+		wg.Wait()
+
+		err = client.call(context.TODO(), "fail", nil, nil)
+		if !errors.Is(err, ErrJSONNoSuchDevice) {
+			t.Fatalf("%s: expected no such device error, got %v", rpcURL, err)
+		}
+	}
+}
+
+func TestRPCTransportURL(t *testing.T) {
+	cases := []struct {
+		rpcURL  string
+		address string
+		valid   bool
+	}{
+		{"http://127.0.0.1:9009", "", true},
+		{"https://spdk.example.com", "", true},
+		{"unix:///var/tmp/spdk.sock", "/var/tmp/spdk.sock", true},
+		{"tcp://127.0.0.1:5260", "127.0.0.1:5260", true},
+		{"tcp:///var/tmp/spdk.sock", "", false},
+		{"127.0.0.1:9009", "", false},
+		{"ftp://127.0.0.1", "", false},
+	}
+	for _, c := range cases {
+		transport, err := newRPCTransport(c.rpcURL, "user", "pass", nil)
+		if (err == nil) != c.valid {
+			t.Fatalf("%s: valid should be %v, err: %v", c.rpcURL, c.valid, err)
+		}
+		if socket, ok := transport.(*socketTransport); ok && socket.address != c.address {
+			t.Fatalf("%s: expected address %s, got %s", c.rpcURL, c.address, socket.address)
+		}
+	}
+}
+
+// fails with the given errors in turn before responding
+type flakyTransport struct {
+	errs  []error
+	calls int
+}
+
+func (t *flakyTransport) send(_ context.Context, request []byte, decode func(io.Reader) error) error {
+	t.calls++
+	if t.calls <= len(t.errs) {
+		return t.errs[t.calls-1]
+	}
+	var req struct {
+		ID int32 `json:"id"`
+	}
+	if err := json.Unmarshal(request, &req); err != nil {
+		return err
+	}
+	return decode(strings.NewReader(fmt.Sprintf(`{"id": %d, "result": true}`, req.ID)))
+}
+
+func TestRPCRetry(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "unix", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	cases := []struct {
+		method  string
+		errs    []error
+		calls   int
+		success bool
+	}{
+		{"bdev_get_bdevs", []error{refused, &httpStatusError{code: 502}}, 3, true},
+		{"bdev_get_bdevs", []error{&httpStatusError{code: 401}}, 1, false},
+		{"bdev_get_bdevs", []error{refused, refused, refused, refused, refused}, cfgRPCRetries, false},
+		{"bdev_lvol_create", []error{refused}, 1, false},
+	}
+	for _, c := range cases {
+		transport := &flakyTransport{errs: c.errs}
+		client := &rpcClient{transport: transport}
+		errCount := testutil.ToFloat64(rpcErrors.WithLabelValues(c.method))
+		var result bool
+		err := client.call(context.TODO(), c.method, nil, &result)
+		if (err == nil) != c.success || transport.calls != c.calls {
+			t.Fatalf("%s %v: expected success %v with %d calls, got err %v with %d calls",
+				c.method, c.errs, c.success, c.calls, err, transport.calls)
+		}
+		// retried attempts are counted as one call
+		if delta := testutil.ToFloat64(rpcErrors.WithLabelValues(c.method)) - errCount; (delta == 0) != c.success {
+			t.Fatalf("%s %v: unexpected error count %v", c.method, c.errs, delta)
+		}
+	}
+
+	// stop retrying once request is cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	transport := &flakyTransport{errs: []error{refused, refused, refused, refused, refused}}
+	client := &rpcClient{transport: transport}
+	err := client.call(ctx, "bdev_get_bdevs", nil, nil)
+	if !errors.Is(err, context.DeadlineExceeded) || transport.calls != 1 {
+		t.Fatalf("expected deadline exceeded after 1 call, got err %v with %d calls", err, transport.calls)
+	}
+}
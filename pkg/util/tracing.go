@@ -0,0 +1,91 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpgrpc"
+	"go.opentelemetry.io/otel/exporters/stdout"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/semconv"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName = "github.com/spdk/spdk-csi"
+
+	// TracingStdout as tracing endpoint prints spans to stdout instead of sending to a collector
+	TracingStdout = "stdout"
+
+	// AttrVolumeID is the span attribute of CSI volume id
+	AttrVolumeID = attribute.Key("csi.volume.id")
+)
+
+// InitTracing sends spans to an OTLP gRPC collector at endpoint(host:port), or
+// prints spans to stdout if endpoint is TracingStdout. Trace context is
+// propagated in W3C tracecontext format. Spans are not recorded if InitTracing
+// is not called. The returned function flushes pending spans on exit.
+func InitTracing(endpoint, serviceName string) (func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+	if endpoint == TracingStdout {
+		exporter, err = stdout.NewExporter(stdout.WithPrettyPrint(), stdout.WithoutMetricExport())
+	} else {
+		// collector is expected to run locally, e.g, as a sidecar or daemonset
+		driver := otlpgrpc.NewDriver(otlpgrpc.WithInsecure(), otlpgrpc.WithEndpoint(endpoint))
+		exporter, err = otlp.NewExporter(context.Background(), driver)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace exporter: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.ServiceNameKey.String(serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider.Shutdown, nil
+}
+
+// StartSpan starts a span as child of the span in ctx, EndSpan must be called to end it
+func StartSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// EndSpan records the error if not nil and ends the span
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// detachedContext carries the span of ctx but not its deadline and cancellation,
+// for operations which must not be interrupted by the request
+func detachedContext(ctx context.Context) context.Context {
+	return trace.ContextWithSpan(context.Background(), trace.SpanFromContext(ctx))
+}
@@ -0,0 +1,81 @@
+/*
+Copyright (c) Arm Limited and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"context"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(previous)
+
+	ctx, parent := StartSpan(context.Background(), "parent")
+	refused := &net.OpError{Op: "dial", Net: "unix", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	client := &rpcClient{transport: &flakyTransport{errs: []error{refused}}}
+	if err := client.call(ctx, "bdev_get_bdevs", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	client = &rpcClient{transport: &flakyTransport{errs: []error{&httpStatusError{code: 401}}}}
+	if err := client.call(ctx, "bdev_lvol_create", nil, nil); err == nil {
+		t.Fatal("expected rpc error")
+	}
+	if err := execWithTimeout(ctx, []string{"false"}, 10); err == nil {
+		t.Fatal("expected exec error")
+	}
+	parent.End()
+
+	cases := []struct {
+		name   string
+		events int
+		status codes.Code
+	}{
+		{"spdk/bdev_get_bdevs", 1, codes.Unset}, // one retry event
+		{"spdk/bdev_lvol_create", 1, codes.Error},
+		{"exec/false", 1, codes.Error},
+	}
+	spans := exporter.GetSpans()
+	if len(spans) != len(cases)+1 {
+		t.Fatalf("expected %d spans, got %d", len(cases)+1, len(spans))
+	}
+	for i, c := range cases {
+		span := spans[i]
+		if span.Name != c.name {
+			t.Fatalf("expected span %s, got %s", c.name, span.Name)
+		}
+		if span.Parent.SpanID() != parent.SpanContext().SpanID() {
+			t.Fatalf("%s: not a child of the parent span", c.name)
+		}
+		// errors are recorded as events
+		if len(span.MessageEvents) != c.events || span.StatusCode != c.status {
+			t.Fatalf("%s: expected %d events and status %v, got %d events and status %v",
+				c.name, c.events, c.status, len(span.MessageEvents), span.StatusCode)
+		}
+	}
+}
@@ -105,6 +105,7 @@ func (lock *TryLock) Unlock() {
 var (
 	nvmeReDeviceSysFileName = regexp.MustCompile(`nvme(\d+)n(\d+)|nvme(\d+)c(\d+)n(\d+)`)
 	nvmeReDeviceName        = regexp.MustCompile(`c(\d+)`)
+	nvmeReNamespace         = regexp.MustCompile(`^nvme(\d+)n(\d+)$`)
 )
 
 // getNvmeDeviceName checks the contents of given uuidFilePath for matching with
@@ -19,6 +19,7 @@ package util_test
 
 import (
 	"os"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -105,3 +106,165 @@ func TestVolumeContext(t *testing.T) {
 		t.Fatalf("CleanUpVolumeContext failed to cleanup volume context stash")
 	}
 }
+
+func TestLvolOptions(t *testing.T) {
+	opts, err := util.NewLvolOptions(map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !opts.ThinProvision || opts.ClearMethod != "unmap" {
+		t.Fatalf("unexpected default options: %+v", opts)
+	}
+
+	opts, err = util.NewLvolOptions(map[string]string{"thinProvision": "false", "clearMethod": "write_zeroes"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.ThinProvision || opts.ClearMethod != "write_zeroes" {
+		t.Fatalf("unexpected options: %+v", opts)
+	}
+
+	for _, params := range []map[string]string{
+		{"thinProvision": "thick"},
+		{"clearMethod": "zero"},
+	} {
+		if _, err = util.NewLvolOptions(params); err == nil {
+			t.Fatalf("invalid parameters should fail: %v", params)
+		}
+	}
+}
+
+func TestPublishOptions(t *testing.T) {
+	opts, err := util.NewPublishOptions(map[string]string{"thinProvision": "false"})
+	if err != nil || opts.SecureChannel {
+		t.Fatalf("unexpected default options: %+v %v", opts, err)
+	}
+	opts, err = util.NewPublishOptions(map[string]string{"secureChannel": "true"})
+	if err != nil || !opts.SecureChannel {
+		t.Fatalf("unexpected options: %+v %v", opts, err)
+	}
+	if _, err = util.NewPublishOptions(map[string]string{"secureChannel": "tls"}); err == nil {
+		t.Fatal("invalid secureChannel should fail")
+	}
+}
+
+func TestISCSICHAPSecret(t *testing.T) {
+	chap, err := util.NewISCSICHAPSecret(map[string]string{"secret.json": "{}"})
+	if err != nil || chap != nil {
+		t.Fatalf("CHAP should be disabled: %v %v", chap, err)
+	}
+
+	secrets := map[string]string{
+		"node.session.auth.username":    "user",
+		"node.session.auth.password":    "secret",
+		"node.session.auth.username_in": "target",
+		"node.session.auth.password_in": "target-secret",
+	}
+	chap, err = util.NewISCSICHAPSecret(secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chap.User != "user" || chap.Secret != "secret" || !chap.Mutual() || chap.MutualSecret != "target-secret" {
+		t.Fatalf("unexpected CHAP credentials: %+v", chap)
+	}
+
+	for _, key := range []string{"node.session.auth.password", "node.session.auth.password_in"} {
+		incomplete := make(map[string]string, len(secrets))
+		for k, v := range secrets {
+			if k != key {
+				incomplete[k] = v
+			}
+		}
+		if _, err = util.NewISCSICHAPSecret(incomplete); err == nil {
+			t.Fatalf("CHAP credentials without %s should fail", key)
+		}
+	}
+}
+
+func TestNVMeDHCHAPSecret(t *testing.T) {
+	dhchap, err := util.NewNVMeDHCHAPSecret(map[string]string{"node.session.auth.username": "user"})
+	if err != nil || dhchap != nil {
+		t.Fatalf("DH-HMAC-CHAP should be disabled: %v %v", dhchap, err)
+	}
+
+	const secret = "DHHC-1:00:ia6zGodOr5SEG3sp7F/Fuz/UhNg6bVyLgLFeJR5GqhRJT1S9:"
+	dhchap, err = util.NewNVMeDHCHAPSecret(map[string]string{"dhchap-secret": secret})
+	if err != nil || dhchap.Secret != secret || dhchap.CtrlSecret != "" {
+		t.Fatalf("unexpected DH-HMAC-CHAP secret: %v %v", dhchap, err)
+	}
+
+	for _, secrets := range []map[string]string{
+		{"dhchap-ctrl-secret": secret},
+		{"dhchap-secret": secret, "dhchap-ctrl-secret": "plain"},
+	} {
+		_, err = util.NewNVMeDHCHAPSecret(secrets)
+		if err == nil {
+			t.Fatalf("invalid secrets should fail: %v", secrets)
+		}
+		if strings.Contains(err.Error(), "plain") || strings.Contains(err.Error(), secret) {
+			t.Fatalf("secret leaked in error: %s", err)
+		}
+	}
+}
+
+func TestNVMeTLSKey(t *testing.T) {
+	key, err := util.NewNVMeTLSKey(map[string]string{"dhchap-secret": "DHHC-1:00:secret:"})
+	if err != nil || key != "" {
+		t.Fatalf("TLS key should be empty: %q %v", key, err)
+	}
+
+	const psk = "NVMeTLSkey-1:01:VRLbtnN9AQb2WXW3c9+wEf/DRLz0QuLdbYvEhwtdWwNf9LrZ:"
+	key, err = util.NewNVMeTLSKey(map[string]string{"tls-key": psk})
+	if err != nil || key != psk {
+		t.Fatalf("unexpected TLS key: %q %v", key, err)
+	}
+
+	_, err = util.NewNVMeTLSKey(map[string]string{"tls-key": "plain"})
+	if err == nil || strings.Contains(err.Error(), "plain") {
+		t.Fatalf("invalid TLS key should fail without leaking it: %v", err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	node := util.SpdkNodeConfig{Name: "node1", URL: "http://127.0.0.1:9009", TargetType: "nvme-tcp", TargetAddr: "127.0.0.1"}
+	config := util.CSIControllerConfig{Nodes: []util.SpdkNodeConfig{node}}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	config.Nodes = append(config.Nodes, node)
+	if err := config.Validate(); err == nil {
+		t.Fatal("duplicated node name should fail")
+	}
+	config.Nodes = []util.SpdkNodeConfig{{Name: "node1", URL: "http://127.0.0.1:9009"}}
+	if err := config.Validate(); err == nil {
+		t.Fatal("node without target should fail")
+	}
+	config.Nodes = []util.SpdkNodeConfig{node}
+	config.Nodes[0].TargetType = "nvmf-tcp"
+	if err := config.Validate(); err == nil {
+		t.Fatal("invalid target type should fail")
+	}
+	config.Nodes = []util.SpdkNodeConfig{node}
+	config.Nodes[0].URL = "127.0.0.1:9009"
+	if err := config.Validate(); err == nil {
+		t.Fatal("rpcURL without scheme should fail")
+	}
+	config.Nodes = []util.SpdkNodeConfig{node}
+	config.Nodes[0].Topology = map[string]string{util.TopologyKeyZone: "zone1"}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	config.Nodes[0].Topology = map[string]string{"kubernetes.io/hostname": "worker1"}
+	if err := config.Validate(); err == nil {
+		t.Fatal("topology key not reported by CSI nodes should fail")
+	}
+
+	xpuConfig := util.NodeServerConfig{XpuList: []*util.XpuConfig{{Name: "xpu0", TargetType: "xpu-opi-nvme", TargetAddr: "127.0.0.1:50051"}}}
+	if err := xpuConfig.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	xpuConfig.XpuList[0].TargetType = "opi-nvme"
+	if err := xpuConfig.Validate(); err == nil {
+		t.Fatal("invalid xPU target type should fail")
+	}
+}
@@ -170,8 +170,8 @@ func (xpu *xpuInitiator) tryGetXpuContext() (map[string]string, error) {
 	return xPUContext, nil
 }
 
-func (xpu *xpuInitiator) Connect( /*ctx *context.Context*/ ) (string, error) {
-	ctx, cancel := xpu.ctxTimeout()
+func (xpu *xpuInitiator) Connect(ctx context.Context) (string, error) {
+	ctx, cancel := xpu.ctxTimeout(ctx)
 	defer cancel()
 
 	var devicePath string
@@ -208,8 +208,7 @@ func (xpu *xpuInitiator) ConnectNvmfTCP(ctx context.Context) (string, error) {
 
 	// Initiate target connection with cmd:
 	// nvme connect -t tcp -a "127.0.0.1" -s 4421 -n "nqn.2022-04.io.spdk.csi:cnode0:uuid:*"
-	//nolint: contextcheck, gocritic
-	devicePath, err := newInitiatorNVMf(xpu.volumeContext["model"]).Connect()
+	devicePath, err := newInitiatorNVMf(xpu.volumeContext["model"]).Connect(ctx)
 	if err != nil {
 		// Call Disconnect(), to clean up if nvme connect failed, while CreateDevice and AttachVolume succeeded
 		if errx := xpu.backend.Disconnect(ctx); errx != nil {
@@ -359,8 +358,8 @@ func (xpu *xpuInitiator) ConnectVirtioBlk(ctx context.Context) (string, error) {
 	return devicePath, nil
 }
 
-func (xpu *xpuInitiator) Disconnect( /*ctx context.Context*/ ) error {
-	ctx, cancel := xpu.ctxTimeout()
+func (xpu *xpuInitiator) Disconnect(ctx context.Context) error {
+	ctx, cancel := xpu.ctxTimeout(ctx)
 	defer cancel()
 
 	var err error
@@ -384,8 +383,7 @@ func (xpu *xpuInitiator) Disconnect( /*ctx context.Context*/ ) error {
 // device.
 func (xpu *xpuInitiator) DisconnectNvmfTCP(ctx context.Context) error {
 	// nvme disconnect -n "nqn.2022-04.io.spdk.csi:cnode0:uuid:*"
-	//nolint: contextcheck, gocritic
-	if err := newInitiatorNVMf(xpu.volumeContext["model"]).Disconnect(); err != nil {
+	if err := newInitiatorNVMf(xpu.volumeContext["model"]).Disconnect(ctx); err != nil {
 		return fmt.Errorf("failed to disconnect: %w", err)
 	}
 
@@ -424,6 +422,47 @@ func (xpu *xpuInitiator) DisconnectVirtioBlk(ctx context.Context) error {
 	return waitForDeviceGone(xpu.devicePath)
 }
 
+// Rescan refreshes the block device after the backing volume is resized.
+// VirtioBlk devices are notified by the device itself via a config change interrupt.
+func (xpu *xpuInitiator) Rescan(ctx context.Context) error {
+	switch xpu.targetInfo.TrType {
+	case TransportTypeNvmfTCP:
+		return newInitiatorNVMf(xpu.volumeContext["model"]).Rescan(ctx)
+	case TransportTypeNvme:
+		if xpu.devicePath == "" {
+			return fmt.Errorf("failed to get block device path")
+		}
+		return rescanNvmeDevice(ctx, xpu.devicePath)
+	case TransportTypeVirtioBlk:
+		klog.Infof("xpu virtioblk device '%s' is resized by the device", xpu.devicePath)
+		return nil
+	default:
+		return fmt.Errorf("unsupported xpu transport type %q", xpu.targetInfo.TrType)
+	}
+}
+
+// Health checks the emulated device is still present, and the nvmf connection is alive
+// for NvmfTCP transport.
+func (xpu *xpuInitiator) Health(ctx context.Context) error {
+	switch xpu.targetInfo.TrType {
+	case TransportTypeNvmfTCP:
+		return newInitiatorNVMf(xpu.volumeContext["model"]).Health(ctx)
+	case TransportTypeNvme:
+		if xpu.devicePath == "" {
+			return fmt.Errorf("failed to get block device path")
+		}
+		return checkNvmeControllerState(xpu.devicePath)
+	case TransportTypeVirtioBlk:
+		if xpu.devicePath == "" {
+			return fmt.Errorf("failed to get block device path")
+		}
+		_, err := os.Stat(xpu.devicePath)
+		return err
+	default:
+		return fmt.Errorf("unsupported xpu transport type %q", xpu.targetInfo.TrType)
+	}
+}
+
 func parseSpdkXpuTargetType(xpuTargetType string) (*XpuTargetType, error) {
 	parts := strings.Split(xpuTargetType, "-")
 	if parts[0] != "xpu" || len(parts) != 3 {
@@ -433,8 +472,10 @@ func parseSpdkXpuTargetType(xpuTargetType string) (*XpuTargetType, error) {
 	return &XpuTargetType{Backend: parts[1], TrType: TransportType(parts[2])}, nil
 }
 
-func (xpu *xpuInitiator) ctxTimeout() (context.Context, context.CancelFunc) {
-	ctxTimeout, cancel := context.WithTimeout(context.Background(), xpu.timeout)
+// xpu operations are limited by xpu timeout instead of the request deadline,
+// the derived context carries the span of ctx to propagate trace context to xpu
+func (xpu *xpuInitiator) ctxTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctxTimeout, cancel := context.WithTimeout(detachedContext(ctx), xpu.timeout)
 	return ctxTimeout, cancel
 }
 